@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	ErrKind_Unauthorized   = "OBS_UNAUTHORIZED"
+	ErrKind_InvalidRequest = "OBS_INVALID_REQUEST"
+)
+
+type apiErrorResponse struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// handleAPI serves the bearer token authenticated JSON API.
+func (h *signingHandler) handleAPI(ctx *fasthttp.RequestCtx) {
+	if !h.auth.Check(string(ctx.Request.Header.Peek("Authorization"))) {
+		ctx.Response.Header.Set("WWW-Authenticate", `Bearer realm="obs-access-signer"`)
+		h.apiError(ctx, http.StatusUnauthorized, ErrKind_Unauthorized, "invalid bearer token")
+		return
+	}
+
+	callCtx, cancel := callContext()
+	defer cancel()
+	endpoint := strings.TrimPrefix(string(ctx.Path()), apiPrefix)
+	switch {
+	case endpoint == "upload":
+		h.upload(ctx, callCtx)
+	case endpoint == "sign":
+		h.sign(ctx, callCtx)
+	case endpoint == "post-policy":
+		h.postPolicy(ctx, callCtx)
+	case strings.HasPrefix(endpoint, "multipart/"):
+		h.multipart(ctx, callCtx, strings.TrimPrefix(endpoint, "multipart/"))
+	default:
+		h.apiError(ctx, http.StatusNotFound, ErrKind_ResourceNotFound, "unknown endpoint")
+	}
+}
+
+// apiError reports err along with a JSON body.
+func (h *signingHandler) apiError(ctx *fasthttp.RequestCtx, statusCode int, errType string, err any) {
+	h.reportError(ctx, errType, err)
+	var res apiErrorResponse
+	res.Error.Code = errType
+	res.Error.Message = string(ctx.Response.Header.Peek("x-error-message"))
+	h.apiJSON(ctx, statusCode, res)
+}
+
+func (h *signingHandler) apiJSON(ctx *fasthttp.RequestCtx, statusCode int, v any) {
+	b, _ := json.Marshal(v)
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(statusCode)
+	ctx.SetBody(b)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// objectInfo is object metadata returned by backends, zero values
+// are unknown.
+type objectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+	// version ID, empty if unversioned
+	VersionID string
+	// `x-amz-website-redirect-location`
+	WebsiteRedirect string
+}
+
+// objectBackend checks object existence, independent of the URL signer.
+type objectBackend interface {
+	Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error)
+	Name() string
+	StatObject(ctx context.Context, bucket, key string) (*objectInfo, error)
+}
+
+// clientPool lazily creates backend clients shared between backends
+// and signers of a server.
+type clientPool struct {
+	opts serverOptions
+
+	mu      sync.Mutex
+	s3creds *s3Credentials
+	s3sets  *s3CredentialSets
+	s3c     *minio.Client
+	storj   *storjAggegrateClient
+	gcs     *gcsClient
+	azure   *azureBlobClient
+	swift   *swiftClient
+	fs      *fsClient
+}
+
+func newClientPool(opts serverOptions) *clientPool {
+	return &clientPool{opts: opts}
+}
+
+func (p *clientPool) S3() (_ *minio.Client, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.s3c == nil {
+		var creds *s3Credentials
+		if creds, err = p.s3Credentials(); err != nil {
+			return
+		}
+		p.s3c, err = newObsS3Client(p.opts.GetS3Opts(), creds)
+	}
+	return p.s3c, err
+}
+
+func (p *clientPool) S3Credentials() (*s3Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.s3Credentials()
+}
+
+func (p *clientPool) S3CredentialSets(ctx context.Context) (_ *s3CredentialSets, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.s3sets == nil {
+		logger := p.opts.Logger
+		if logger == nil {
+			logger = zap.NewNop()
+		}
+		p.s3sets, err = newObsS3CredentialSets(ctx, p.opts.GetS3Opts(), logger)
+	}
+	return p.s3sets, err
+}
+
+func (p *clientPool) s3Credentials() (_ *s3Credentials, err error) {
+	if p.s3creds == nil {
+		p.s3creds, err = newObsS3Credentials(p.opts.GetS3Opts())
+	}
+	return p.s3creds, err
+}
+
+func (p *clientPool) Storj(ctx context.Context) (_ *storjAggegrateClient, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.storj == nil {
+		opts := p.opts.GetUplinkOpts()
+		if opts.ShareBucket == "" {
+			opts.ShareBucket = p.opts.GetOpts().BucketName
+		}
+		p.storj, err = newObsStorjClient(ctx, opts, p.opts.Logger)
+	}
+	return p.storj, err
+}
+
+func (p *clientPool) GCS() (_ *gcsClient, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.gcs == nil {
+		p.gcs, err = newObsGCSClient(p.opts.GetGCSOpts())
+	}
+	return p.gcs, err
+}
+
+func (p *clientPool) Azure() (_ *azureBlobClient, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.azure == nil {
+		p.azure, err = newObsAzureClient(p.opts.GetAzureOpts())
+	}
+	return p.azure, err
+}
+
+func (p *clientPool) Swift(ctx context.Context) (_ *swiftClient, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.swift == nil {
+		p.swift, err = newObsSwiftClient(ctx, p.opts.GetSwiftOpts())
+	}
+	return p.swift, err
+}
+
+func (p *clientPool) FS() (_ *fsClient, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fs == nil {
+		p.fs, err = newObsFSClient(p.opts.GetFSOpts())
+	}
+	return p.fs, err
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	ErrKind_CORSForbidden = "OBS_CORS_FORBIDDEN"
+)
+
+// methods of a corsRule without allowed methods
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead}
+
+// corsRule answers CORS requests of browser clients for a route.
+type corsRule struct {
+	// origins, ex. `https://*.example.com`, `*` matches any characters
+	AllowedOrigins []string `json:"allowed_origins"`
+	// empty allows GET and HEAD
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+	// request headers, `*` allows any
+	AllowedHeaders []string `json:"allowed_headers,omitempty"`
+	// response headers readable by the client, ex. `x-error-code`
+	ExposedHeaders []string `json:"exposed_headers,omitempty"`
+	// seconds a preflight is cached, zero leaves it to the browser
+	MaxAge int `json:"max_age,omitempty"`
+	// allow cookies and authorization
+	AllowCredentials bool `json:"allow_credentials,omitempty"`
+}
+
+func (cr *corsRule) validate() error {
+	if len(cr.AllowedOrigins) == 0 {
+		return errors.New("no allowed origins")
+	}
+	for _, origin := range cr.AllowedOrigins {
+		if origin == "" || !validHeaderValue(origin) {
+			return errors.Errorf("invalid origin %q", origin)
+		}
+		// any site could read responses with the user's cookies
+		if cr.AllowCredentials && strings.Trim(origin, "*") == "" {
+			return errors.Errorf("origin %q with allow_credentials", origin)
+		}
+	}
+	if len(cr.AllowedMethods) == 0 {
+		cr.AllowedMethods = append([]string{}, defaultCORSMethods...)
+	}
+	for i, method := range cr.AllowedMethods {
+		cr.AllowedMethods[i] = strings.ToUpper(method)
+		if !validHeaderToken(method) {
+			return errors.Errorf("invalid method %q", method)
+		}
+	}
+	for _, header := range append(append([]string{}, cr.AllowedHeaders...), cr.ExposedHeaders...) {
+		if header != "*" && !validHeaderToken(header) {
+			return errors.Errorf("invalid header %q", header)
+		}
+	}
+	if cr.MaxAge < 0 {
+		return errors.Errorf("invalid max age %d", cr.MaxAge)
+	}
+	return nil
+}
+
+// AllowOrigin reports whether origin matches an allowed origin.
+func (cr *corsRule) AllowOrigin(origin string) bool {
+	for _, pattern := range cr.AllowedOrigins {
+		if matchWildcard(strings.ToLower(pattern), strings.ToLower(origin)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cr *corsRule) allowMethod(method string) bool {
+	for _, allowed := range cr.AllowedMethods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHeaders reports whether every header of an
+// `Access-Control-Request-Headers` list is allowed.
+func (cr *corsRule) allowHeaders(headers string) bool {
+	for _, header := range strings.Split(headers, ",") {
+		if header = strings.TrimSpace(header); header == "" {
+			continue
+		}
+		var ok bool
+		for _, allowed := range cr.AllowedHeaders {
+			if allowed == "*" || strings.EqualFold(allowed, header) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// corsOf returns the CORS rule of the route, nil if it has none, r can
+// be nil.
+func corsOf(r *route) *corsRule {
+	if r == nil {
+		return nil
+	}
+	return r.CORS
+}
+
+// cors adds the CORS headers of the route to the response, preflights
+// are answered without touching the backend. handled is true when a
+// response has been written.
+func (h *signingHandler) cors(ctx *fasthttp.RequestCtx, r *route) (handled bool) {
+	rule := corsOf(r)
+	if rule == nil {
+		return
+	}
+	preflight := ctx.IsOptions() &&
+		len(ctx.Request.Header.Peek("Access-Control-Request-Method")) > 0
+	ctx.Response.Header.Add("Vary", "Origin")
+	if preflight {
+		ctx.Response.Header.Add("Vary", "Access-Control-Request-Method")
+		ctx.Response.Header.Add("Vary", "Access-Control-Request-Headers")
+	}
+	origin := string(ctx.Request.Header.Peek("Origin"))
+	if origin == "" {
+		return
+	}
+	if !rule.AllowOrigin(origin) {
+		if preflight {
+			ctx.SetStatusCode(http.StatusForbidden)
+			h.reportError(ctx, ErrKind_CORSForbidden, "origin not allowed")
+		}
+		return preflight
+	}
+
+	header := &ctx.Response.Header
+	header.Set("Access-Control-Allow-Origin", origin)
+	if rule.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		if len(rule.ExposedHeaders) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(rule.ExposedHeaders, ", "))
+		}
+		return
+	}
+
+	method := string(ctx.Request.Header.Peek("Access-Control-Request-Method"))
+	headers := string(ctx.Request.Header.Peek("Access-Control-Request-Headers"))
+	if !rule.allowMethod(method) || !rule.allowHeaders(headers) {
+		header.Del("Access-Control-Allow-Origin")
+		header.Del("Access-Control-Allow-Credentials")
+		ctx.SetStatusCode(http.StatusForbidden)
+		h.reportError(ctx, ErrKind_CORSForbidden, "method or headers not allowed")
+		return true
+	}
+	header.Set("Access-Control-Allow-Methods", strings.Join(rule.AllowedMethods, ", "))
+	if headers != "" {
+		header.Set("Access-Control-Allow-Headers", headers)
+	}
+	if rule.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(rule.MaxAge))
+	}
+	ctx.SetStatusCode(http.StatusNoContent)
+	return true
+}
+
+// matchWildcard matches s against pattern, `*` matches any characters.
+func matchWildcard(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// validHeaderToken reports whether s is an RFC 9110 token, ex. a
+// header name or method.
+func validHeaderToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= 0x20 || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
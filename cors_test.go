@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func TestMatchWildcard(t *testing.T) {
+	for _, c := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"https://app.example.com", "https://app.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://evil.com", false},
+		{"*", "null", true},
+		{"http://localhost:*", "http://localhost:3000", true},
+		{"a*b*c", "abc", true},
+		{"a*a", "a", false},
+	} {
+		require.Equal(t, c.want, matchWildcard(c.pattern, c.s), c)
+	}
+}
+
+func TestCORSRuleValidate(t *testing.T) {
+	rule := &corsRule{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"get"}}
+	require.NoError(t, rule.validate())
+	require.Equal(t, []string{"GET"}, rule.AllowedMethods)
+
+	rule = &corsRule{AllowedOrigins: []string{"*"}}
+	require.NoError(t, rule.validate())
+	require.Equal(t, defaultCORSMethods, rule.AllowedMethods)
+
+	// patterns are fine with credentials
+	rule = &corsRule{AllowedOrigins: []string{"https://*.example.com"}, AllowCredentials: true}
+	require.NoError(t, rule.validate())
+
+	for _, rule := range []*corsRule{
+		{},
+		{AllowedOrigins: []string{""}},
+		{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET POST"}},
+		{AllowedOrigins: []string{"*"}, AllowedHeaders: []string{"a:b"}},
+		{AllowedOrigins: []string{"*"}, MaxAge: -1},
+		{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+		{AllowedOrigins: []string{"https://a.example.com", "**"}, AllowCredentials: true},
+	} {
+		require.Error(t, rule.validate(), rule)
+	}
+}
+
+func TestSigningHandlerCORS(t *testing.T) {
+	c := newTestServer(t, &serverFS{}, testFSServerOptions(t, map[string]string{
+		"app/a.txt":   "app/a.txt",
+		"other/b.txt": "other/b.txt",
+	}, `{"routes":[
+		{"prefix":"app/","cors":{
+			"allowed_origins":["https://*.example.com"],
+			"allowed_headers":["Range"],
+			"exposed_headers":["x-error-code"],
+			"max_age":600,
+			"allow_credentials":true
+		}}
+	]}`))
+	do := func(method, uri string, headers ...string) *fasthttp.Response {
+		req := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(req)
+		req.Header.SetMethod(method)
+		req.SetRequestURI(uri)
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp := &fasthttp.Response{}
+		require.NoError(t, c.Do(req, resp))
+		return resp
+	}
+	origin := "https://app.example.com"
+
+	// preflights
+	for _, uri := range []string{"http://signer/app/a.txt", "http://signer/_obj/app/a.txt"} {
+		resp := do(http.MethodOptions, uri,
+			"Origin", origin,
+			"Access-Control-Request-Method", "GET",
+			"Access-Control-Request-Headers", "range")
+		require.Equal(t, http.StatusNoContent, resp.StatusCode(), uri)
+		require.Equal(t, origin, string(resp.Header.Peek("Access-Control-Allow-Origin")))
+		require.Equal(t, "true", string(resp.Header.Peek("Access-Control-Allow-Credentials")))
+		require.Equal(t, "GET, HEAD", string(resp.Header.Peek("Access-Control-Allow-Methods")))
+		require.Equal(t, "range", string(resp.Header.Peek("Access-Control-Allow-Headers")))
+		require.Equal(t, "600", string(resp.Header.Peek("Access-Control-Max-Age")))
+	}
+	for _, headers := range [][]string{
+		{"Origin", "https://evil.com", "Access-Control-Request-Method", "GET"},
+		{"Origin", origin, "Access-Control-Request-Method", "PUT"},
+		{"Origin", origin, "Access-Control-Request-Method", "GET", "Access-Control-Request-Headers", "x-secret"},
+	} {
+		resp := do(http.MethodOptions, "http://signer/app/a.txt", headers...)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode(), headers)
+		require.Empty(t, resp.Header.Peek("Access-Control-Allow-Origin"), headers)
+	}
+	// no preflight, no CORS route
+	resp := do(http.MethodOptions, "http://signer/app/a.txt", "Origin", origin)
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode())
+	resp = do(http.MethodOptions, "http://signer/other/b.txt", "Origin", origin, "Access-Control-Request-Method", "GET")
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode())
+
+	// actual requests, errors included
+	resp = do(http.MethodGet, "http://signer/app/a.txt", "Origin", origin)
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+	require.Equal(t, origin, string(resp.Header.Peek("Access-Control-Allow-Origin")))
+	require.Equal(t, "x-error-code", string(resp.Header.Peek("Access-Control-Expose-Headers")))
+	require.Equal(t, "Origin", string(resp.Header.Peek("Vary")))
+	resp = do(http.MethodGet, string(resp.Header.Peek("Location")), "Origin", origin)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	require.Equal(t, origin, string(resp.Header.Peek("Access-Control-Allow-Origin")))
+	resp = do(http.MethodGet, "http://signer/app/missing.txt", "Origin", origin)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode())
+	require.Equal(t, origin, string(resp.Header.Peek("Access-Control-Allow-Origin")))
+
+	resp = do(http.MethodGet, "http://signer/app/a.txt", "Origin", "https://evil.com")
+	require.Empty(t, resp.Header.Peek("Access-Control-Allow-Origin"))
+	resp = do(http.MethodGet, "http://signer/other/b.txt", "Origin", origin)
+	require.Empty(t, resp.Header.Peek("Access-Control-Allow-Origin"))
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrKind_SignURL = "OBS_SIGN_URL"
+)
+
+// bounds the backend and signer calls of a request
+const callTimeout = 30 * time.Second
+
+// callContext returns the context of the backend and signer calls of a
+// request. The fasthttp request context isn't one, it is reused once the
+// handler returns while HTTP clients may still read it.
+func callContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), callTimeout)
+}
+
+// signingHandler checks requested objects against a backend and
+// redirects to URLs signed by a signer, routes may pick another
+// backend or signer by object key prefix.
+type signingHandler struct {
+	opts obsOptions
+
+	logger    *zap.SugaredLogger
+	filter    *keyFilter
+	routes    *routeTable
+	responses *responseOverrides
+	// nil disables negotiation
+	negotiator *negotiator
+	// server website, nil if disabled, and route websites
+	website  *website
+	websites map[*route]*website
+
+	clients *clientPool
+
+	defaultBackend string
+	defaultSigner  string
+	backends       map[string]objectBackend
+	signers        map[string]URLSigner
+
+	// health checked credential sets, nil if none
+	credSets *s3CredentialSets
+	checkKey func(ctx context.Context, v s3Creds) error
+	// cached results of checkKey
+	healthChecks *healthChecks
+
+	// API, disabled without tokens
+	auth         *apiAuth
+	uploadPolicy *uploadPolicy
+	uploaders    map[string]objectUploader
+
+	// stream objects instead of redirecting, see proxyOf
+	proxy bool
+}
+
+func (h *signingHandler) Init(ctx context.Context, opts serverOptions, name, defaultBackend, defaultSigner string) (err error) {
+	h.opts = opts.GetOpts()
+	apiOpts := opts.GetAPIOpts()
+	h.logger = opts.Logger.Named(name).Sugar()
+
+	if err = checkKeyPolicy(h.opts.KeyPolicy); err != nil {
+		return
+	}
+
+	if h.filter, err = h.opts.KeyFilter(); err != nil {
+		err = errors.Wrap(err, "key filter")
+		return
+	}
+
+	if h.routes, err = h.opts.Routes(); err != nil {
+		err = errors.Wrap(err, "routes")
+		return
+	}
+
+	if h.responses, err = h.opts.ResponseOverrides(); err != nil {
+		err = errors.Wrap(err, "response overrides")
+		return
+	}
+
+	if h.negotiator, err = h.opts.Negotiator(); err != nil {
+		err = errors.Wrap(err, "negotiation")
+		return
+	}
+
+	h.clients = newClientPool(opts)
+	h.defaultBackend = defaultBackend
+	h.defaultSigner = defaultSigner
+	h.backends = map[string]objectBackend{}
+	h.signers = map[string]URLSigner{}
+
+	// init every referenced backend and signer upfront, so misconfiguration
+	// fails at startup instead of at request time.
+	if err = h.initBackend(ctx, opts, defaultBackend); err != nil {
+		return
+	}
+	if err = h.initSigner(ctx, opts, defaultSigner); err != nil {
+		return
+	}
+	for _, r := range h.routes.routes {
+		if r.Backend != "" {
+			if err = h.initBackend(ctx, opts, r.Backend); err != nil {
+				err = errors.Wrapf(err, "route %q", r.Prefix)
+				return
+			}
+		}
+		if r.Signer != "" {
+			if err = h.initSigner(ctx, opts, r.Signer); err != nil {
+				err = errors.Wrapf(err, "route %q", r.Prefix)
+				return
+			}
+		}
+		if r.Response != nil {
+			if !h.honorsOverrides(r) {
+				err = errors.Wrapf(errResponseOverridesUnsupported, "route %q: signer %q", r.Prefix, h.signerOf(r).Name())
+				return
+			}
+		}
+		if r.Credentials != "" {
+			var sets *s3CredentialSets
+			if sets, err = h.clients.S3CredentialSets(ctx); err != nil {
+				err = errors.Wrapf(err, "route %q", r.Prefix)
+				return
+			}
+			if err = sets.Require(r.Credentials); err != nil {
+				err = errors.Wrapf(err, "route %q", r.Prefix)
+				return
+			}
+		}
+	}
+
+	if err = h.initWebsites(); err != nil {
+		err = errors.Wrap(err, "website")
+		return
+	}
+	if err = h.initListings(); err != nil {
+		err = errors.Wrap(err, "listing")
+		return
+	}
+	if err = h.initVersions(); err != nil {
+		err = errors.Wrap(err, "versions")
+		return
+	}
+	if h.proxy {
+		if err = h.initProxy(); err != nil {
+			err = errors.Wrap(err, "proxy")
+			return
+		}
+	}
+
+	h.auth = newAPIAuth(splitList(apiOpts.Tokens))
+	h.uploaders = map[string]objectUploader{}
+	if h.auth.Enabled() {
+		if err = h.initUploads(ctx, opts, apiOpts); err != nil {
+			err = errors.Wrap(err, "uploads")
+			return
+		}
+		if apiOpts.MultipartMaxAge > 0 && apiOpts.MultipartCleanupInterval > 0 {
+			h.initMultipartCleanup(ctx, apiOpts.MultipartCleanupInterval, apiOpts.MultipartMaxAge)
+		}
+	}
+
+	if h.opts.HealthPath != "" && opts.GetS3Opts().CredentialSetsFile != "" {
+		if h.credSets, err = h.clients.S3CredentialSets(ctx); err != nil {
+			err = errors.Wrap(err, "s3 credential sets")
+			return
+		}
+		if h.checkKey, err = newS3KeyChecker(opts.GetS3Opts(), h.opts.BucketName); err != nil {
+			err = errors.Wrap(err, "s3 key checker")
+			return
+		}
+		h.healthChecks = &healthChecks{}
+	}
+	return
+}
+
+// initUploads compiles upload policies and inits uploaders of the
+// backends that have one.
+func (h *signingHandler) initUploads(ctx context.Context, opts serverOptions, apiOpts obsAPIOptions) (err error) {
+	h.uploadPolicy = apiOpts.UploadPolicy()
+	if err = h.uploadPolicy.compile(nil); err != nil {
+		return
+	}
+	if err = h.initUploader(ctx, opts, h.defaultBackend); err != nil {
+		return
+	}
+	for _, r := range h.routes.routes {
+		if r.Upload != nil {
+			if err = r.Upload.compile(h.uploadPolicy); err != nil {
+				err = errors.Wrapf(err, "route %q", r.Prefix)
+				return
+			}
+			if !strings.HasPrefix(r.Upload.tmpl.Prefix(), r.Prefix) {
+				err = errors.Errorf("route %q: key template %q is outside of the route", r.Prefix, r.Upload.KeyTemplate)
+				return
+			}
+		}
+		if r.Backend != "" {
+			if err = h.initUploader(ctx, opts, r.Backend); err != nil {
+				err = errors.Wrapf(err, "route %q", r.Prefix)
+				return
+			}
+		}
+	}
+	return
+}
+
+// initUploader inits uploader of the backend, if there's one.
+func (h *signingHandler) initUploader(ctx context.Context, opts serverOptions, name string) (err error) {
+	if _, exist := h.uploaders[name]; exist {
+		return
+	}
+	newUploader, exist := mappedUploaders[name]
+	if !exist {
+		return
+	}
+	u := newUploader()
+	if err = u.Init(ctx, opts, h.clients); err != nil {
+		return errors.Wrapf(err, "uploader %q", name)
+	}
+	h.uploaders[name] = u
+	return
+}
+
+func (h *signingHandler) initBackend(ctx context.Context, opts serverOptions, name string) (err error) {
+	if _, exist := h.backends[name]; exist {
+		return
+	}
+	newBackend, exist := mappedBackends[name]
+	if !exist {
+		return errors.Errorf("unknown backend %q", name)
+	}
+	b := newBackend()
+	if err = b.Init(ctx, opts, h.clients); err != nil {
+		return errors.Wrapf(err, "backend %q", name)
+	}
+	h.backends[name] = b
+	return
+}
+
+func (h *signingHandler) initSigner(ctx context.Context, opts serverOptions, name string) (err error) {
+	if _, exist := h.signers[name]; exist {
+		return
+	}
+	newSigner, exist := mappedSigners[name]
+	if !exist {
+		return errors.Errorf("unknown signer %q", name)
+	}
+	s := newSigner()
+	if err = s.Init(ctx, opts, h.clients); err != nil {
+		return errors.Wrapf(err, "signer %q", name)
+	}
+	h.signers[name] = s
+	return
+}
+
+func (h *signingHandler) getLogger() *zap.SugaredLogger { return h.logger }
+func (h *signingHandler) reportError(ctx *fasthttp.RequestCtx, errType string, err any) {
+	reportError(h, ctx, errType, err)
+}
+
+// backendOf returns backend of the route, r can be nil.
+func (h *signingHandler) backendOf(r *route) objectBackend {
+	if r != nil && r.Backend != "" {
+		return h.backends[r.Backend]
+	}
+	return h.backends[h.defaultBackend]
+}
+
+// signerOf returns signer of the route, r can be nil.
+func (h *signingHandler) signerOf(r *route) URLSigner {
+	if r != nil && r.Signer != "" {
+		return h.signers[r.Signer]
+	}
+	return h.signers[h.defaultSigner]
+}
+
+func (h *signingHandler) handle(ctx *fasthttp.RequestCtx) {
+	if h.opts.HealthPath != "" && string(ctx.Path()) == h.opts.HealthPath {
+		h.health(ctx)
+		return
+	}
+	if h.auth.Enabled() && strings.HasPrefix(string(ctx.Path()), apiPrefix) {
+		h.handleAPI(ctx)
+		return
+	}
+
+	isMethodGet := bytes.Equal(ctx.Method(), MethodGet)
+	isMethodHead := bytes.Equal(ctx.Method(), MethodHead)
+	isMethodOptions := bytes.Equal(ctx.Method(), MethodOptions)
+	if !isMethodGet && !isMethodHead && !isMethodOptions {
+		ctx.SetStatusCode(http.StatusMethodNotAllowed)
+		h.reportError(ctx, ErrKind_MethodNotAllowed, "")
+		return
+	}
+
+	if isMethodHead {
+		// Doc: https://www.rfc-editor.org/rfc/rfc9110.html#section-9.3.2-1
+		ctx.Response.Header.Set("Content-Length", "0")
+	}
+	callCtx, cancel := callContext()
+	defer cancel()
+
+	bucketName := h.opts.BucketName
+	objectName, err := resolveObjectName(ctx, h.opts)
+	if err != nil {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		h.reportError(ctx, ErrKind_InvalidObjectKey, err)
+		return
+	}
+
+	h.logger.Debugw("handle",
+		"bucket", bucketName,
+		"objectName", objectName)
+
+	r := h.routes.Match(objectName)
+	if h.cors(ctx, r) {
+		return
+	}
+	if isMethodOptions {
+		// not a preflight of a CORS route
+		ctx.SetStatusCode(http.StatusMethodNotAllowed)
+		h.reportError(ctx, ErrKind_MethodNotAllowed, "")
+		return
+	}
+	if rule := listingOf(r); rule != nil && (objectName == "" || strings.HasSuffix(objectName, "/")) {
+		h.list(ctx, callCtx, r, rule, bucketName, objectName)
+		return
+	}
+
+	// directory-like keys of websites are their index document
+	site := h.websiteOf(r)
+	if site != nil && (objectName == "" || strings.HasSuffix(objectName, "/")) {
+		objectName += site.index
+		r = h.routes.Match(objectName)
+	}
+
+	// blocked keys are reported as not found to not reveal hidden prefixes
+	if !h.filter.Allow(objectName) {
+		h.notFound(ctx, callCtx, r, site, bucketName, "object not found")
+		return
+	}
+
+	var rule *responseRule
+	if r != nil {
+		rule = r.Response
+	}
+	overrides, err := h.responses.Of(ctx.QueryArgs(), rule, objectName)
+	// proxied overrides become headers
+	if err == nil && h.proxyOf(r) == nil {
+		err = checkResponseOverrides(h.signerOf(r), overrides)
+	}
+	if err != nil {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		h.reportError(ctx, ErrKind_ResponseOverride, err)
+		return
+	}
+	version := h.versionOf(r)
+	versionID, err := requestedVersion(ctx.QueryArgs(), version)
+	if err != nil {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		h.reportError(ctx, ErrKind_ObjectVersion, err)
+		return
+	}
+
+	signReq := signRequest{
+		Method:            http.MethodGet,
+		Bucket:            bucketName,
+		Key:               objectName,
+		VersionID:         versionID,
+		Expiry:            h.opts.URLExpiry,
+		ResponseOverrides: overrides,
+	}
+	if r != nil {
+		signReq.RoutePrefix = r.Prefix
+		signReq.Credentials = r.Credentials
+	}
+
+	// variants of an explicit version aren't negotiated
+	var candidates []negotiatedKey
+	if versionID == "" {
+		var vary []string
+		candidates, vary = h.negotiator.Candidates(objectName,
+			ctx.Request.Header.Peek("Accept"),
+			ctx.Request.Header.Peek("Accept-Encoding"))
+		for _, header := range vary {
+			ctx.Response.Header.Add("Vary", header)
+		}
+	}
+
+	// check if we had access to the object
+	negotiated, info, err := h.statNegotiated(callCtx, r, bucketName, objectName, versionID, candidates)
+	if err != nil {
+		if site == nil {
+			ctx.SetStatusCode(http.StatusNotFound)
+			h.reportError(ctx, ErrKind_ResourceNotFound, err)
+			return
+		}
+		var ok bool
+		if negotiated.Key, ok = h.websiteMiss(ctx, callCtx, r, site, bucketName, objectName, err); !ok {
+			return
+		}
+	} else {
+		if site != nil {
+			if location := websiteRedirectLocation(info.WebsiteRedirect); location != "" {
+				ctx.Redirect(location, http.StatusMovedPermanently)
+				return
+			}
+		}
+		if versionID == "" && version.PinLatest {
+			signReq.VersionID = pinnedVersion(info)
+		}
+	}
+	if negotiated.Key != objectName {
+		h.logger.Debugw("negotiated",
+			"bucket", bucketName,
+			"objectName", objectName,
+			"variant", negotiated.Key)
+		signReq.Key = negotiated.Key
+	}
+	if negotiated.Encoding != "" {
+		signReq.ResponseOverrides = precompressedOverrides(h.honorsOverrides(r), signReq.ResponseOverrides, objectName, negotiated.Encoding)
+	}
+
+	if downloader := h.proxyOf(r); downloader != nil {
+		// info is nil for website fallbacks
+		if info == nil {
+			if info, err = downloader.StatObject(callCtx, bucketName, signReq.Key); err != nil {
+				ctx.SetStatusCode(http.StatusNotFound)
+				h.reportError(ctx, ErrKind_ResourceNotFound, err)
+				return
+			}
+		}
+		h.proxyObject(ctx, downloader, bucketName, signReq.Key, info, signReq.ResponseOverrides)
+		return
+	}
+
+	signed, err := h.signerOf(r).SignURL(callCtx, signReq)
+	if err != nil {
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		h.reportError(ctx, ErrKind_SignURL, err)
+		return
+	}
+
+	for _, cookie := range signed.Cookies {
+		setCookie(ctx, cookie)
+	}
+	// info is nil for website fallbacks
+	if info != nil && immutableOf(r).Match(signReq.Key) {
+		redirectImmutable(ctx, h.opts, signed.URL, signed.ExpireAt, info.ETag)
+		return
+	}
+	redirect(ctx, h.opts, signed.URL, signed.ExpireAt)
+}
+
+// statNegotiated stats the negotiated candidates of key in order, then
+// key itself at versionID. Candidates have to pass the key filter and
+// stay in the route of key.
+func (h *signingHandler) statNegotiated(ctx context.Context, r *route, bucket, key, versionID string, candidates []negotiatedKey) (_ negotiatedKey, info *objectInfo, err error) {
+	backend := h.backendOf(r)
+	for _, c := range candidates {
+		if !h.filter.Allow(c.Key) || h.routes.Match(c.Key) != r {
+			continue
+		}
+		if info, err = backend.StatObject(ctx, bucket, c.Key); err == nil {
+			return c, info, nil
+		}
+	}
+	if info, err = statVersion(ctx, backend, bucket, key, versionID); err != nil {
+		return
+	}
+	return negotiatedKey{Key: key}, info, nil
+}
+
+// honorsOverrides reports whether response overrides of the route reach
+// the client, as headers of proxied objects or signed URL parameters.
+func (h *signingHandler) honorsOverrides(r *route) bool {
+	if h.proxyOf(r) != nil {
+		return true
+	}
+	_, ok := h.signerOf(r).(responseOverrideSigner)
+	return ok
+}
+
+// precompressedOverrides adds the content headers of the precompressed
+// sibling of key to overrides, if they're honored. Other signers rely on
+// the object metadata.
+func precompressedOverrides(honored bool, overrides url.Values, key, encoding string) url.Values {
+	if !honored {
+		return overrides
+	}
+	if overrides == nil {
+		overrides = url.Values{}
+	}
+	overrides.Set("response-content-encoding", encoding)
+	if overrides.Get("response-content-type") == "" {
+		if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+			overrides.Set("response-content-type", contentType)
+		}
+	}
+	return overrides
+}
+
+// setCookie sets net/http cookie on the response.
+func setCookie(ctx *fasthttp.RequestCtx, cookie *http.Cookie) {
+	c := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(c)
+	c.SetKey(cookie.Name)
+	c.SetValue(cookie.Value)
+	c.SetPath(cookie.Path)
+	c.SetDomain(cookie.Domain)
+	c.SetHTTPOnly(cookie.HttpOnly)
+	c.SetSecure(cookie.Secure)
+	if !cookie.Expires.IsZero() {
+		c.SetExpire(cookie.Expires)
+	}
+	ctx.Response.Header.SetCookie(c)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestSigningHandlerRoutes(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "cdn"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "cdn", "b.txt"), []byte("b"), 0o644))
+
+	routesFile := filepath.Join(t.TempDir(), "routes.json")
+	require.NoError(t, os.WriteFile(routesFile, []byte(`{"routes":[
+		{"prefix":"cdn/","signer":"cloudfront"}
+	]}`), 0o644))
+	keyFile, _ := newTestRSAKeyFile(t)
+
+	opts := defaultObsOpts
+	opts.URLExpiry = time.Hour
+	opts.HostRedirect = "cdn.example.com"
+	opts.RedirectSecure = true
+	opts.RoutesFile = routesFile
+	c := newTestServer(t, &serverFS{}, serverOptions{
+		Opts:   &opts,
+		FSOpts: &obsFSOptions{Root: root, Secret: "test"},
+		CloudFrontOpts: &obsCloudFrontOptions{
+			KeyPairID:      "K2JCJMDEHXQW5F",
+			PrivateKeyFile: keyFile,
+			SignedCookies:  true,
+		},
+	})
+
+	// default fs signer
+	resp := doTestRequest(t, c, http.MethodGet, "http://signer/a.txt")
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+	require.True(t, strings.HasPrefix(string(resp.Header.Peek("Location")), "https://cdn.example.com/_obj/a.txt?"))
+
+	// fs backend, cloudfront signer
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer/cdn/b.txt")
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+	location := string(resp.Header.Peek("Location"))
+	require.True(t, strings.HasPrefix(location, "https://cdn.example.com/cdn/b.txt?"))
+	require.Contains(t, location, "Key-Pair-Id=K2JCJMDEHXQW5F")
+	require.Contains(t, string(resp.Header.PeekCookie("CloudFront-Signature")), "path=/cdn/")
+
+	// still checked against the backend
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer/cdn/missing.txt")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode())
+
+	// cloudfront needs a finite expiry
+	noExpiry := opts
+	noExpiry.URLExpiry = maxURLExpiry
+	require.Error(t, (&serverFS{}).Init(context.Background(), serverOptions{
+		Logger:         zap.NewNop(),
+		Opts:           &noExpiry,
+		FSOpts:         &obsFSOptions{Root: root, Secret: "test"},
+		CloudFrontOpts: &obsCloudFrontOptions{KeyPairID: "K2JCJMDEHXQW5F", PrivateKeyFile: keyFile},
+	}))
+
+	// unknown signer fails at init
+	require.NoError(t, os.WriteFile(routesFile, []byte(`{"routes":[{"prefix":"x/","signer":"unknown"}]}`), 0o644))
+	require.Error(t, (&serverFS{}).Init(context.Background(), serverOptions{
+		Logger: zap.NewNop(),
+		Opts:   &opts,
+		FSOpts: &obsFSOptions{Root: root},
+	}))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// credential set checks are reused this long, the endpoint is public and
+// every check hits the storage once per key.
+const healthCheckTTL = 30 * time.Second
+
+// bounds a round of credential set checks
+const healthCheckTimeout = 30 * time.Second
+
+type healthReport struct {
+	Status string `json:"status"`
+	// `ok` or `failed` per set
+	CredentialSets map[string]string `json:"credential_sets,omitempty"`
+}
+
+// healthChecks caches the last credential set checks, concurrent
+// requests wait for the running round instead of starting their own.
+type healthChecks struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	sets      map[string]string
+	healthy   bool
+}
+
+func (hc *healthChecks) Check(sets *s3CredentialSets, check func(ctx context.Context, v s3Creds) error) (map[string]string, bool) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if !hc.checkedAt.IsZero() && time.Since(hc.checkedAt) < healthCheckTTL {
+		return hc.sets, hc.healthy
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	hc.sets, hc.healthy = sets.Check(ctx, check)
+	hc.checkedAt = time.Now()
+	return hc.sets, hc.healthy
+}
+
+// health reports whether the server can sign, key details and errors
+// are logged only.
+func (h *signingHandler) health(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsGet() && !ctx.IsHead() {
+		ctx.SetStatusCode(http.StatusMethodNotAllowed)
+		h.reportError(ctx, ErrKind_MethodNotAllowed, "")
+		return
+	}
+
+	report := healthReport{Status: "ok"}
+	statusCode := http.StatusOK
+	if h.credSets != nil {
+		var healthy bool
+		report.CredentialSets, healthy = h.healthChecks.Check(h.credSets, h.checkKey)
+		if !healthy {
+			report.Status = "unhealthy"
+			statusCode = http.StatusServiceUnavailable
+		}
+	}
+
+	b, _ := json.Marshal(report)
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(statusCode)
+	ctx.SetBody(b)
+}
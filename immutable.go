@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+// redirect cache lifetime of immutable keys signed without expiry
+const immutableMaxAge = 365 * 24 * time.Hour
+
+// immutableRule marks keys of a route as immutable, ex. keys embedding
+// a content hash, their redirects are cached as long as the URL is
+// valid.
+type immutableRule struct {
+	// regular expression matched anywhere in the key, ex. `[0-9a-f]{32}`,
+	// empty matches every key of the route
+	Pattern string `json:"pattern,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+func (ir *immutableRule) compile() (err error) {
+	if ir.Pattern == "" {
+		return
+	}
+	if ir.pattern, err = regexp.Compile(ir.Pattern); err != nil {
+		err = errors.Wrap(err, "pattern")
+	}
+	return
+}
+
+// Match reports whether key is immutable, ir can be nil.
+func (ir *immutableRule) Match(key string) bool {
+	if ir == nil {
+		return false
+	}
+	return ir.pattern == nil || ir.pattern.MatchString(key)
+}
+
+// immutableOf returns the immutable rule of the route, nil if it has
+// none, r can be nil.
+func immutableOf(r *route) *immutableRule {
+	if r == nil {
+		return nil
+	}
+	return r.Immutable
+}
+
+// redirectImmutable redirects to an immutable object, the redirect is
+// public and cached until the URL expires. etag is exposed so caches
+// can revalidate with `If-None-Match`, which is only answered with 304
+// for URLs that never expire, since a 304 keeps the cached location.
+func redirectImmutable(ctx *fasthttp.RequestCtx, opts obsOptions, location string, expireAt time.Time, etag string) {
+	maxAge := immutableMaxAge
+	if !expireAt.IsZero() {
+		maxAge = time.Until(expireAt)
+	}
+	if etag != "" {
+		etag = `"` + strings.Trim(etag, `"`) + `"`
+		ctx.Response.Header.Set("ETag", etag)
+	}
+	if etag != "" && expireAt.IsZero() && etagMatch(string(ctx.Request.Header.Peek("If-None-Match")), etag) {
+		ctx.Response.Header.Set("Cache-Control", immutableCacheControl(maxAge))
+		ctx.SetStatusCode(http.StatusNotModified)
+		return
+	}
+	redirect(ctx, opts, location, expireAt)
+	ctx.Response.Header.Set("Cache-Control", immutableCacheControl(maxAge))
+}
+
+func immutableCacheControl(maxAge time.Duration) string {
+	return fmt.Sprintf("public, max-age=%d, immutable", int64(maxAge/time.Second))
+}
+
+// etagMatch reports whether an `If-None-Match` header matches etag,
+// weak comparison as RFC 9110 section 13.1.2 requires.
+func etagMatch(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
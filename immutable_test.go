@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func TestImmutableRule(t *testing.T) {
+	rule := &immutableRule{Pattern: `[0-9a-f]{32}`}
+	require.NoError(t, rule.compile())
+	require.True(t, rule.Match("assets/app.0123456789abcdef0123456789abcdef.js"))
+	require.False(t, rule.Match("assets/app.js"))
+	require.False(t, (*immutableRule)(nil).Match("assets/app.js"))
+
+	rule = &immutableRule{}
+	require.NoError(t, rule.compile())
+	require.True(t, rule.Match("assets/app.js"))
+	require.Error(t, (&immutableRule{Pattern: "("}).compile())
+}
+
+func TestETagMatch(t *testing.T) {
+	require.True(t, etagMatch(`"a", "b"`, `"b"`))
+	require.True(t, etagMatch(`W/"b"`, `"b"`))
+	require.True(t, etagMatch(`*`, `"b"`))
+	require.False(t, etagMatch(`"a"`, `"b"`))
+	require.False(t, etagMatch(``, `"b"`))
+}
+
+const testImmutableKey = "assets/app.0123456789abcdef0123456789abcdef.js"
+
+const testImmutableRoutes = `{"routes":[
+	{"prefix":"assets/","immutable":{"pattern":"[0-9a-f]{32}"}}
+]}`
+
+func TestSigningHandlerImmutable(t *testing.T) {
+	endpoint := newTestS3Endpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket/"+testImmutableKey && r.URL.Path != "/bucket/assets/app.js" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+	})
+	c := newTestServer(t, &serverS3{}, testS3ServerOptions(t, endpoint, testImmutableRoutes))
+
+	resp := doTestRequest(t, c, http.MethodGet, "http://signer/"+testImmutableKey)
+	require.Equal(t, http.StatusMovedPermanently, resp.StatusCode())
+	require.Equal(t, `"etag"`, string(resp.Header.Peek("ETag")))
+	require.Equal(t, "public, max-age=31536000, immutable", string(resp.Header.Peek("Cache-Control")))
+
+	// URLs that never expire revalidate
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI("http://signer/" + testImmutableKey)
+	req.Header.Set("If-None-Match", `W/"etag"`)
+	resp = &fasthttp.Response{}
+	require.NoError(t, c.Do(req, resp))
+	require.Equal(t, http.StatusNotModified, resp.StatusCode())
+	require.Equal(t, `"etag"`, string(resp.Header.Peek("ETag")))
+	require.Empty(t, resp.Header.Peek("Location"))
+
+	// keys not matching the pattern
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer/assets/app.js")
+	require.Equal(t, http.StatusMovedPermanently, resp.StatusCode())
+	require.Empty(t, resp.Header.Peek("ETag"))
+	require.Empty(t, resp.Header.Peek("Cache-Control"))
+}
+
+func TestSigningHandlerImmutableExpiry(t *testing.T) {
+	c := newTestServer(t, &serverFS{}, testFSServerOptions(t, map[string]string{testImmutableKey: "js"}, testImmutableRoutes))
+
+	// aligned to the URL validity
+	resp := doTestRequest(t, c, http.MethodGet, "http://signer/"+testImmutableKey)
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+	cacheControl := string(resp.Header.Peek("Cache-Control"))
+	require.True(t, strings.HasPrefix(cacheControl, "public, max-age="), cacheControl)
+	require.True(t, strings.HasSuffix(cacheControl, ", immutable"), cacheControl)
+	maxAge, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(cacheControl, "public, max-age="), ", immutable"))
+	require.NoError(t, err)
+	require.InDelta(t, time.Hour.Seconds(), maxAge, 5)
+}
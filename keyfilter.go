@@ -0,0 +1,140 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// keyFilter decides whether an object key can be served.
+//
+// Patterns are glob patterns matched against the resolved object key,
+// `**` matches any number of path segments, a pattern prefixed with `!`
+// excludes matching keys. When there's no include pattern, every key
+// is included unless excluded.
+type keyFilter struct {
+	include    []string
+	exclude    []string
+	extensions map[string]struct{}
+}
+
+func newKeyFilter(patterns, extensions []string) (f *keyFilter, err error) {
+	f = &keyFilter{}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		exclude := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimLeft(strings.TrimPrefix(pattern, "!"), "/")
+		// validate pattern syntax
+		if _, err = path.Match(pattern, ""); err != nil {
+			err = errors.Wrapf(err, "key pattern %q", pattern)
+			return
+		}
+		if exclude {
+			f.exclude = append(f.exclude, pattern)
+		} else {
+			f.include = append(f.include, pattern)
+		}
+	}
+	for _, ext := range extensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if f.extensions == nil {
+			f.extensions = map[string]struct{}{}
+		}
+		f.extensions[ext] = struct{}{}
+	}
+	return
+}
+
+// Allow reports whether key passes the filter, a nil filter allows everything.
+func (f *keyFilter) Allow(key string) bool {
+	if f == nil {
+		return true
+	}
+	if f.extensions != nil {
+		if _, ok := f.extensions[strings.ToLower(path.Ext(key))]; !ok {
+			return false
+		}
+	}
+	for _, pattern := range f.exclude {
+		if matchGlob(pattern, key) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pattern := range f.include {
+		if matchGlob(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowPrefix reports whether no exclude pattern matches prefix, the
+// include patterns and extensions apply to object keys only.
+func (f *keyFilter) AllowPrefix(prefix string) bool {
+	if f == nil {
+		return true
+	}
+	for _, pattern := range f.exclude {
+		if matchGlob(pattern, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchGlob matches key against pattern segment by segment,
+// `**` segment matches zero or more key segments.
+func matchGlob(pattern, key string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(key, "/"))
+}
+
+func matchSegments(pattern, key []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// collapse consecutive `**`
+			for len(pattern) > 0 && pattern[0] == "**" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := range key {
+				if matchSegments(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(key) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], key[0]); !ok {
+			return false
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return len(key) == 0
+}
+
+// splitList splits comma separated list, empty items are dropped.
+func splitList(s string) (res []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"**/*.jpg", "a.jpg", true},
+		{"**/*.jpg", "a/b/c.jpg", true},
+		{"**/*.jpg", "a/b/c.png", false},
+		{"internal/**", "internal/a/b", true},
+		{"internal/**", "internal", true},
+		{"internal/**", "internalx/a", false},
+		{"a/**/z", "a/z", true},
+		{"a/**/z", "a/b/c/z", true},
+		{"a/*/z", "a/b/c/z", false},
+		{".private/*", ".private/key", true},
+	} {
+		require.Equal(t, tc.match, matchGlob(tc.pattern, tc.key), "%s ~ %s", tc.pattern, tc.key)
+	}
+}
+
+func TestKeyFilter(t *testing.T) {
+	f, err := newKeyFilter([]string{"**/*.jpg", "**/*.png", "!internal/**"}, []string{"jpg", ".PNG"})
+	require.NoError(t, err)
+	require.True(t, f.Allow("img/a.jpg"))
+	require.False(t, f.Allow("img/a.PNG")) // glob is case sensitive
+	require.True(t, f.Allow("b.png"))
+	require.False(t, f.Allow("internal/a.jpg"))
+	require.False(t, f.Allow("backups/db.sql"))
+
+	f, err = newKeyFilter([]string{"!backups/**", "!.private/**"}, nil)
+	require.NoError(t, err)
+	require.True(t, f.Allow("a/b.txt"))
+	require.False(t, f.Allow("backups/db.sql"))
+	require.False(t, f.Allow(".private/key"))
+
+	_, err = newKeyFilter([]string{"[a-"}, nil)
+	require.Error(t, err)
+
+	var nilFilter *keyFilter
+	require.True(t, nilFilter.Allow("anything"))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// reject keys having `.` or `..` segments
+	keyPolicyStrict = "strict"
+	// resolve `.` and `..` segments, keys escaping the root are still rejected
+	keyPolicyCanonicalize = "canonicalize"
+
+	// S3 object key limit in bytes
+	defaultMaxKeyLength = 1024
+)
+
+var (
+	errKeyInvalidEscape = errors.New("invalid percent-encoding")
+	errKeyInvalidChar   = errors.New("invalid character")
+	errKeyDotSegment    = errors.New("dot segment not allowed")
+	errKeyTraversal     = errors.New("path escapes root")
+	errKeyTooLong       = errors.New("key too long")
+)
+
+// checkKeyPolicy rejects unknown key policies, those would silently
+// behave as strict.
+func checkKeyPolicy(policy string) error {
+	switch policy {
+	case keyPolicyStrict, keyPolicyCanonicalize:
+		return nil
+	}
+	return errors.Errorf("unknown key policy %q (available [%s, %s])", policy, keyPolicyStrict, keyPolicyCanonicalize)
+}
+
+// normalizeObjectKey turns a raw (percent-encoded) request path into
+// an object key. Leading slash is removed, repeated slashes are collapsed
+// and trailing slash is preserved.
+func normalizeObjectKey(rawPath string, policy string, maxLength int) (key string, err error) {
+	var decoded string
+	if decoded, err = url.PathUnescape(rawPath); err != nil {
+		err = errKeyInvalidEscape
+		return
+	}
+	return normalizeKey(decoded, policy, maxLength)
+}
+
+// normalizeKey normalizes an object key given as is, like keys of API
+// requests, `%` is a literal character.
+func normalizeKey(decoded string, policy string, maxLength int) (key string, err error) {
+	if !utf8.ValidString(decoded) {
+		err = errKeyInvalidChar
+		return
+	}
+	for i := 0; i < len(decoded); i++ {
+		if c := decoded[i]; c < 0x20 || c == 0x7f {
+			err = errKeyInvalidChar
+			return
+		}
+	}
+
+	segments := strings.Split(decoded, "/")
+	res := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		switch segment {
+		case "":
+			// collapse `//`
+			continue
+		case ".", "..":
+			if policy != keyPolicyCanonicalize {
+				err = errKeyDotSegment
+				return
+			}
+			if segment == ".." {
+				if len(res) == 0 {
+					err = errKeyTraversal
+					return
+				}
+				res = res[:len(res)-1]
+			}
+			continue
+		}
+		res = append(res, segment)
+	}
+
+	key = strings.Join(res, "/")
+	if key != "" && strings.HasSuffix(decoded, "/") {
+		key += "/"
+	}
+	if maxLength > 0 && len(key) > maxLength {
+		return "", errKeyTooLong
+	}
+	return
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func TestNormalizeObjectKey(t *testing.T) {
+	for _, tc := range []struct {
+		raw, policy, key string
+		err              error
+	}{
+		{"/a/b.jpg", keyPolicyStrict, "a/b.jpg", nil},
+		{"//a///b.jpg", keyPolicyStrict, "a/b.jpg", nil},
+		{"/docs/", keyPolicyStrict, "docs/", nil},
+		{"/a%20b/c%2Ed", keyPolicyStrict, "a b/c.d", nil},
+		{"/a/%zz", keyPolicyStrict, "", errKeyInvalidEscape},
+		{"/a/%0a", keyPolicyStrict, "", errKeyInvalidChar},
+		{"/a/%ff", keyPolicyStrict, "", errKeyInvalidChar},
+		{"/a/./b", keyPolicyStrict, "", errKeyDotSegment},
+		{"/a/%2e%2e/b", keyPolicyStrict, "", errKeyDotSegment},
+		{"/a/./b", keyPolicyCanonicalize, "a/b", nil},
+		{"/a/../b/", keyPolicyCanonicalize, "b/", nil},
+		{"/a/..%2f..%2fb", keyPolicyCanonicalize, "", errKeyTraversal},
+		{"/../etc/passwd", keyPolicyCanonicalize, "", errKeyTraversal},
+		{"/" + strings.Repeat("a", 1025), keyPolicyCanonicalize, "", errKeyTooLong},
+	} {
+		key, err := normalizeObjectKey(tc.raw, tc.policy, defaultMaxKeyLength)
+		require.Equal(t, tc.err, err, tc.raw)
+		require.Equal(t, tc.key, key, tc.raw)
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	// API keys aren't percent-decoded
+	for raw, want := range map[string]string{
+		"100%.txt":   "100%.txt",
+		"a%20b.txt":  "a%20b.txt",
+		"a%2Fb":      "a%2Fb",
+		"/a//b.txt":  "a/b.txt",
+		"a b/c.txt":  "a b/c.txt",
+		"%2e%2e/etc": "%2e%2e/etc",
+	} {
+		key, err := normalizeKey(raw, keyPolicyStrict, defaultMaxKeyLength)
+		require.NoError(t, err, raw)
+		require.Equal(t, want, key, raw)
+	}
+	for raw, want := range map[string]error{
+		"a/../b":                  errKeyDotSegment,
+		"a\nb":                    errKeyInvalidChar,
+		"a\x7fb":                  errKeyInvalidChar,
+		strings.Repeat("a", 1025): errKeyTooLong,
+	} {
+		_, err := normalizeKey(raw, keyPolicyStrict, defaultMaxKeyLength)
+		require.Equal(t, want, err, raw)
+	}
+}
+
+func TestCheckKeyPolicy(t *testing.T) {
+	require.NoError(t, checkKeyPolicy(keyPolicyStrict))
+	require.NoError(t, checkKeyPolicy(keyPolicyCanonicalize))
+	require.Error(t, checkKeyPolicy("canonicalise"))
+	require.Error(t, checkKeyPolicy(""))
+}
+
+func TestResolveObjectName(t *testing.T) {
+	opts := defaultObsOpts
+	opts.RemoveBucketName = true
+	opts.MaxKeyLength = 5
+
+	ctx := &fasthttp.RequestCtx{}
+	// the bucket segment doesn't count toward the limit
+	ctx.Request.SetRequestURI("/bucket/a.txt")
+	key, err := resolveObjectName(ctx, opts)
+	require.NoError(t, err)
+	require.Equal(t, "a.txt", key)
+
+	ctx.Request.SetRequestURI("/bucket/ab.txt")
+	_, err = resolveObjectName(ctx, opts)
+	require.Equal(t, errKeyTooLong, err)
+}
+
+func FuzzNormalizeObjectKey(f *testing.F) {
+	for _, seed := range []string{"/a/b.jpg", "//a//b/", "/a/../../b", "/%2e%2e/x", "/a%00b", "/./"} {
+		f.Add(seed, true)
+		f.Add(seed, false)
+	}
+	f.Fuzz(func(t *testing.T, raw string, canonicalize bool) {
+		policy := keyPolicyStrict
+		if canonicalize {
+			policy = keyPolicyCanonicalize
+		}
+		key, err := normalizeObjectKey(raw, policy, defaultMaxKeyLength)
+		if err != nil {
+			require.Empty(t, key)
+			return
+		}
+		require.True(t, utf8.ValidString(key))
+		require.LessOrEqual(t, len(key), defaultMaxKeyLength)
+		require.False(t, strings.HasPrefix(key, "/"))
+		require.NotContains(t, key, "//")
+		for _, segment := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+			require.NotEqual(t, ".", segment)
+			require.NotEqual(t, "..", segment)
+		}
+		for _, c := range key {
+			require.False(t, c < 0x20 || c == 0x7f)
+		}
+	})
+}
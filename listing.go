@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	ErrKind_ListObjects = "OBS_LIST_OBJECTS"
+)
+
+// S3 ListObjects page limit
+const maxListingKeys = 1000
+
+// listingRule enables directory listings of a route, for keys ending
+// with `/`.
+type listingRule struct {
+	// page size, zero or more than 1000 is 1000
+	MaxKeys int `json:"max_keys,omitempty"`
+	// glob patterns of hidden keys and prefixes, `**` matches any number
+	// of segments
+	Hidden []string `json:"hidden,omitempty"`
+
+	hidden *keyFilter
+}
+
+func (lr *listingRule) compile() (err error) {
+	if lr.MaxKeys <= 0 || lr.MaxKeys > maxListingKeys {
+		lr.MaxKeys = maxListingKeys
+	}
+	patterns := make([]string, 0, len(lr.Hidden))
+	for _, pattern := range lr.Hidden {
+		patterns = append(patterns, "!"+strings.TrimPrefix(pattern, "!"))
+	}
+	lr.hidden, err = newKeyFilter(patterns, nil)
+	return
+}
+
+// Visible reports whether key isn't hidden, prefixes are matched with
+// and without their trailing slash.
+func (lr *listingRule) Visible(key string) bool {
+	return lr.hidden.AllowPrefix(key) && lr.hidden.AllowPrefix(strings.TrimSuffix(key, "/"))
+}
+
+// objectList is a page of a prefix listing.
+type objectList struct {
+	// common prefixes, ending with `/`
+	Prefixes []string
+	Objects  []objectInfo
+	// key the next page starts after, empty on the last page
+	NextToken string
+}
+
+// objectLister is a backend that lists prefixes, one level deep.
+type objectLister interface {
+	objectBackend
+	ListObjects(ctx context.Context, bucket, prefix, token string, maxKeys int) (*objectList, error)
+}
+
+type listingResponse struct {
+	Prefix    string         `json:"prefix"`
+	Prefixes  []listingEntry `json:"prefixes"`
+	Objects   []listingEntry `json:"objects"`
+	NextToken string         `json:"next_token,omitempty"`
+
+	// HTML links relative to the listing
+	ParentURL string `json:"-"`
+	NextURL   string `json:"-"`
+}
+
+type listingEntry struct {
+	// relative to the listed prefix
+	Name         string     `json:"name"`
+	Key          string     `json:"key"`
+	Size         int64      `json:"size,omitempty"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+	// signed object URL, prefix listing URL relative to the listing
+	URL string `json:"url,omitempty"`
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of /{{.Prefix}}</title></head>
+<body>
+<h1>Index of /{{.Prefix}}</h1>
+<table>
+<thead><tr><th>Name</th><th>Size</th><th>Last modified</th></tr></thead>
+<tbody>
+{{with .ParentURL}}<tr><td><a href="{{.}}">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Prefixes}}<tr><td><a href="{{.URL}}">{{.Name}}</a></td><td>-</td><td></td></tr>
+{{end}}{{range .Objects}}<tr><td>{{if .URL}}<a href="{{.URL}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}</td><td>{{.Size}}</td><td>{{with .LastModified}}{{.Format "2006-01-02 15:04:05 MST"}}{{end}}</td></tr>
+{{end}}</tbody>
+</table>
+{{with .NextURL}}<p><a href="{{.}}">Next page</a></p>
+{{end}}</body>
+</html>
+`))
+
+// initListings compiles listing rules of routes, their backend has to
+// list objects.
+func (h *signingHandler) initListings() (err error) {
+	for _, r := range h.routes.routes {
+		if r.Listing == nil {
+			continue
+		}
+		if err = r.Listing.compile(); err != nil {
+			return errors.Wrapf(err, "route %q", r.Prefix)
+		}
+		if _, ok := h.backendOf(r).(objectLister); !ok {
+			return errors.Errorf("route %q: backend %q can't list objects", r.Prefix, h.backendOf(r).Name())
+		}
+	}
+	return
+}
+
+// listingOf returns the listing rule of the route, nil if disabled.
+func listingOf(r *route) *listingRule {
+	if r == nil {
+		return nil
+	}
+	return r.Listing
+}
+
+// list responds the listing of prefix as HTML, or JSON when asked by
+// `Accept` or `?format=json`. `?token=` continues a listing.
+func (h *signingHandler) list(ctx *fasthttp.RequestCtx, callCtx context.Context, r *route, rule *listingRule, bucket, prefix string) {
+	ctx.Response.Header.Add("Vary", "Accept")
+	if !rule.Visible(prefix) || !h.filter.AllowPrefix(prefix) {
+		ctx.SetStatusCode(http.StatusNotFound)
+		h.reportError(ctx, ErrKind_ResourceNotFound, "prefix not found")
+		return
+	}
+	args := ctx.QueryArgs()
+	token := string(args.Peek("token"))
+	if token != "" && (!strings.HasPrefix(token, prefix) || !validHeaderValue(token)) {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		h.reportError(ctx, ErrKind_InvalidRequest, "invalid token")
+		return
+	}
+	maxKeys := rule.MaxKeys
+	if v := args.Peek("max-keys"); len(v) > 0 {
+		n, err := strconv.Atoi(string(v))
+		if err != nil || n <= 0 {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			h.reportError(ctx, ErrKind_InvalidRequest, "invalid max-keys")
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	list, err := h.backendOf(r).(objectLister).ListObjects(callCtx, bucket, prefix, token, maxKeys)
+	if err != nil {
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		h.reportError(ctx, ErrKind_ListObjects, err)
+		return
+	}
+
+	res := listingResponse{
+		Prefix:    prefix,
+		Prefixes:  []listingEntry{},
+		Objects:   []listingEntry{},
+		NextToken: list.NextToken,
+	}
+	for _, p := range list.Prefixes {
+		if !rule.Visible(p) || !h.filter.AllowPrefix(p) {
+			continue
+		}
+		name := strings.TrimPrefix(p, prefix)
+		res.Prefixes = append(res.Prefixes, listingEntry{
+			Name: name,
+			Key:  p,
+			URL:  url.PathEscape(strings.TrimSuffix(name, "/")) + "/",
+		})
+	}
+	for _, obj := range list.Objects {
+		if !rule.Visible(obj.Key) || !h.filter.Allow(obj.Key) {
+			continue
+		}
+		entry := listingEntry{
+			Name: strings.TrimPrefix(obj.Key, prefix),
+			Key:  obj.Key,
+			Size: obj.Size,
+		}
+		if !obj.LastModified.IsZero() {
+			lastModified := obj.LastModified.UTC()
+			entry.LastModified = &lastModified
+		}
+		entry.URL = h.signListed(callCtx, bucket, obj.Key)
+		res.Objects = append(res.Objects, entry)
+	}
+	if prefix != "" && (r == nil || prefix != r.Prefix) {
+		res.ParentURL = "../"
+	}
+	if res.NextToken != "" {
+		query := url.Values{"token": {res.NextToken}}
+		if v := args.Peek("max-keys"); len(v) > 0 {
+			query.Set("max-keys", string(v))
+		}
+		if v := args.Peek("format"); len(v) > 0 {
+			query.Set("format", string(v))
+		}
+		res.NextURL = "?" + query.Encode()
+	}
+
+	h.logger.Debugw("list",
+		"bucket", bucket,
+		"prefix", prefix,
+		"prefixes", len(res.Prefixes),
+		"objects", len(res.Objects))
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	if string(args.Peek("format")) == "json" || acceptsToken(string(ctx.Request.Header.Peek("Accept")), "application/json") {
+		h.apiJSON(ctx, http.StatusOK, res)
+		return
+	}
+	var b bytes.Buffer
+	if err = listingTemplate.Execute(&b, res); err != nil {
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		h.reportError(ctx, ErrKind_ListObjects, err)
+		return
+	}
+	ctx.SetContentType("text/html; charset=utf-8")
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetBody(b.Bytes())
+}
+
+// signListed signs the link of a listed object like a redirect would,
+// empty if signing fails.
+func (h *signingHandler) signListed(ctx context.Context, bucket, key string) string {
+	r := h.routes.Match(key)
+	signReq := signRequest{
+		Method: http.MethodGet,
+		Bucket: bucket,
+		Key:    key,
+		Expiry: h.opts.URLExpiry,
+	}
+	if r != nil {
+		signReq.RoutePrefix = r.Prefix
+		signReq.Credentials = r.Credentials
+	}
+	signed, err := h.signerOf(r).SignURL(ctx, signReq)
+	if err != nil {
+		h.logger.Warnw("list sign",
+			"bucket", bucket,
+			"objectName", key,
+			"error", err)
+		return ""
+	}
+	return signed.URL
+}
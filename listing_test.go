@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListingRuleVisible(t *testing.T) {
+	rule := &listingRule{Hidden: []string{"**/.*", "a/secret/**"}}
+	require.NoError(t, rule.compile())
+	require.Equal(t, maxListingKeys, rule.MaxKeys)
+	require.True(t, rule.Visible("a/b.txt"))
+	require.False(t, rule.Visible("a/.env"))
+	require.False(t, rule.Visible("a/.git/"))
+	require.False(t, rule.Visible("a/secret/"))
+	require.False(t, rule.Visible("a/secret/x"))
+}
+
+// testS3ListObjectsV2 lists sorted keys like S3 does, keys after
+// start-after rolled up into common prefixes at the delimiter, pages of
+// max-keys entries.
+func testS3ListObjectsV2(keys []string) http.HandlerFunc {
+	type content struct {
+		Key          string
+		Size         int64
+		ETag         string
+		LastModified string
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	type result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string
+		Contents              []content
+		CommonPrefixes        []commonPrefix
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("list-type") != "2" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+		after := q.Get("start-after")
+		if s := q.Get("continuation-token"); s != "" {
+			after = s
+		}
+		maxKeys, _ := strconv.Atoi(q.Get("max-keys"))
+		res := result{Name: "bucket", Prefix: prefix}
+		if strings.HasSuffix(q.Get("continuation-token"), delimiter) {
+			// the previous page ended on this common prefix
+			res.NextContinuationToken = q.Get("continuation-token")
+		}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) || key <= after {
+				continue
+			}
+			if res.KeyCount == maxKeys {
+				res.IsTruncated = true
+				break
+			}
+			if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+				cp := key[:len(prefix)+i+len(delimiter)]
+				if cp != res.NextContinuationToken {
+					res.CommonPrefixes = append(res.CommonPrefixes, commonPrefix{Prefix: cp})
+					res.KeyCount++
+				}
+				// continue after every key under the common prefix
+				res.NextContinuationToken = cp
+				after = cp + "\U0010FFFF"
+				continue
+			}
+			res.KeyCount++
+			res.NextContinuationToken = key
+			res.Contents = append(res.Contents, content{
+				Key:          key,
+				Size:         int64(len(key)),
+				ETag:         `"etag"`,
+				LastModified: "2023-01-02T03:04:05.000Z",
+			})
+		}
+		if !res.IsTruncated {
+			res.NextContinuationToken = ""
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		_ = xml.NewEncoder(w).Encode(res)
+	}
+}
+
+func TestSigningHandlerListingS3(t *testing.T) {
+	endpoint := newTestS3Endpoint(t, testS3ListObjectsV2([]string{
+		"artifacts/a.txt",
+		"artifacts/b/1.txt",
+		"artifacts/b/2.txt",
+		"artifacts/b/\U0010FFFFz.txt",
+		"artifacts/c.txt",
+	}))
+	c := newTestServer(t, &serverS3{}, testS3ServerOptions(t, endpoint, `{"routes":[
+		{"prefix":"artifacts/","listing":{"max_keys":2}}
+	]}`))
+	listJSON := func(uri string) (res listingResponse) {
+		resp := doTestRequest(t, c, http.MethodGet, uri)
+		require.Equal(t, http.StatusOK, resp.StatusCode(), uri)
+		require.NoError(t, json.Unmarshal(resp.Body(), &res))
+		return
+	}
+
+	// the page ends on a common prefix
+	res := listJSON("http://signer/artifacts/?format=json")
+	require.Len(t, res.Objects, 1)
+	require.Equal(t, "artifacts/a.txt", res.Objects[0].Key)
+	require.Equal(t, []listingEntry{{Name: "b/", Key: "artifacts/b/", URL: "b/"}}, res.Prefixes)
+	require.Equal(t, "artifacts/b/", res.NextToken)
+
+	// keys under it aren't rolled up into it again
+	res = listJSON("http://signer/artifacts/?format=json&token=" + url.QueryEscape(res.NextToken))
+	require.Len(t, res.Objects, 1)
+	require.Equal(t, "artifacts/c.txt", res.Objects[0].Key)
+	require.Empty(t, res.Prefixes)
+	require.Empty(t, res.NextToken)
+}
+
+func TestSigningHandlerListing(t *testing.T) {
+	opts := testFSServerOptions(t, map[string]string{
+		"artifacts/a.txt":       "artifacts/a.txt",
+		"artifacts/b.txt":       "artifacts/b.txt",
+		"artifacts/c/d.txt":     "artifacts/c/d.txt",
+		"artifacts/.env":        "artifacts/.env",
+		"artifacts/private.key": "artifacts/private.key",
+		"other/x.txt":           "other/x.txt",
+	}, `{"routes":[
+		{"prefix":"artifacts/","listing":{"max_keys":2,"hidden":["**/.*"]}}
+	]}`)
+	opts.Opts.KeyPatterns = "!**/*.key"
+	c := newTestServer(t, &serverFS{}, opts)
+	listJSON := func(uri string) (res listingResponse) {
+		resp := doTestRequest(t, c, http.MethodGet, uri)
+		require.Equal(t, http.StatusOK, resp.StatusCode(), uri)
+		require.Equal(t, "no-store", string(resp.Header.Peek("Cache-Control")))
+		require.NoError(t, json.Unmarshal(resp.Body(), &res))
+		return
+	}
+
+	// hidden and blocked keys count toward pages but aren't listed
+	res := listJSON("http://signer/artifacts/?format=json")
+	require.Equal(t, "artifacts/", res.Prefix)
+	require.Len(t, res.Objects, 1)
+	require.Equal(t, "a.txt", res.Objects[0].Name)
+	require.Equal(t, "artifacts/a.txt", res.NextToken)
+
+	// listed URLs are signed
+	resp := doTestRequest(t, c, http.MethodGet, "http://signer"+res.Objects[0].URL)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	require.Equal(t, "artifacts/a.txt", string(resp.Body()))
+
+	res = listJSON("http://signer/artifacts/?format=json&token=" + res.NextToken)
+	require.Len(t, res.Objects, 1)
+	require.Equal(t, "artifacts/b.txt", res.Objects[0].Key)
+	require.EqualValues(t, len("artifacts/b.txt"), res.Objects[0].Size)
+	require.NotNil(t, res.Objects[0].LastModified)
+	require.Equal(t, []listingEntry{{Name: "c/", Key: "artifacts/c/", URL: "c/"}}, res.Prefixes)
+	require.Equal(t, "artifacts/c/", res.NextToken)
+
+	res = listJSON("http://signer/artifacts/?format=json&token=" + res.NextToken)
+	require.Empty(t, res.Objects)
+	require.Empty(t, res.Prefixes)
+	require.Empty(t, res.NextToken)
+
+	res = listJSON("http://signer/artifacts/c/?format=json")
+	require.Len(t, res.Objects, 1)
+	require.Equal(t, "d.txt", res.Objects[0].Name)
+
+	// HTML
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer/artifacts/?max-keys=1")
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	require.Equal(t, "text/html; charset=utf-8", string(resp.Header.ContentType()))
+	require.Contains(t, string(resp.Body()), "Index of /artifacts/")
+	require.NotContains(t, string(resp.Body()), "a.txt")
+	require.Contains(t, string(resp.Body()), `href="?max-keys=1&amp;token=artifacts%2F.env"`)
+
+	for uri, status := range map[string]int{
+		"http://signer/artifacts/?token=other/x.txt": http.StatusBadRequest,
+		"http://signer/artifacts/?max-keys=0":        http.StatusBadRequest,
+		"http://signer/artifacts/.git/":              http.StatusNotFound,
+	} {
+		resp = doTestRequest(t, c, http.MethodGet, uri)
+		require.Equal(t, status, resp.StatusCode(), uri)
+	}
+
+	// routes without listing aren't listed
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer/other/")
+	require.NotEqual(t, http.StatusOK, resp.StatusCode())
+
+	// listings need a backend listing objects
+	h := &signingHandler{
+		defaultBackend: backendStorjName,
+		backends:       map[string]objectBackend{backendStorjName: &backendStorj{}},
+		routes:         &routeTable{routes: []*route{{Prefix: "a/", Listing: &listingRule{}}}},
+	}
+	require.NoError(t, h.initListings())
+	h.backends = map[string]objectBackend{backendStorjName: &backendAzure{}}
+	require.Error(t, h.initListings())
+}
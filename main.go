@@ -22,8 +22,40 @@ var (
 	registeredServers = []Server{
 		&serverS3{},
 		&serverStorj{},
+		&serverGCS{},
+		&serverAzure{},
+		&serverSwift{},
+		&serverFS{},
 	}
 	mappedServers = map[string]Server{}
+
+	registeredBackends = []func() objectBackend{
+		func() objectBackend { return &backendS3{} },
+		func() objectBackend { return &backendStorj{} },
+		func() objectBackend { return &backendGCS{} },
+		func() objectBackend { return &backendAzure{} },
+		func() objectBackend { return &backendSwift{} },
+		func() objectBackend { return &backendFS{} },
+	}
+	mappedBackends = map[string]func() objectBackend{}
+
+	registeredSigners = []func() URLSigner{
+		func() URLSigner { return &signerS3V2{} },
+		func() URLSigner { return &signerS3V4{} },
+		func() URLSigner { return &signerStorj{} },
+		func() URLSigner { return &signerCloudFront{} },
+		func() URLSigner { return &signerGCS{} },
+		func() URLSigner { return &signerAzure{} },
+		func() URLSigner { return &signerSwift{} },
+		func() URLSigner { return &signerFS{} },
+	}
+	mappedSigners = map[string]func() URLSigner{}
+
+	registeredUploaders = []func() objectUploader{
+		func() objectUploader { return &uploaderS3{} },
+		func() objectUploader { return &uploaderStorj{} },
+	}
+	mappedUploaders = map[string]func() objectUploader{}
 )
 
 func init() {
@@ -40,6 +72,30 @@ func init() {
 		mappedServers[serverName] = s
 		availableServerNames = append(availableServerNames, serverName)
 	}
+	for _, newBackend := range registeredBackends {
+		backendName := newBackend().Name()
+		if _, exist := mappedBackends[backendName]; exist {
+			panic(fmt.Sprintf("duplicate backend name %q", backendName))
+		}
+		mappedBackends[backendName] = newBackend
+	}
+	for _, newSigner := range registeredSigners {
+		signerName := newSigner().Name()
+		if _, exist := mappedSigners[signerName]; exist {
+			panic(fmt.Sprintf("duplicate signer name %q", signerName))
+		}
+		mappedSigners[signerName] = newSigner
+	}
+	for _, newUploader := range registeredUploaders {
+		uploaderName := newUploader().Name()
+		if _, exist := mappedBackends[uploaderName]; !exist {
+			panic(fmt.Sprintf("uploader of unknown backend %q", uploaderName))
+		}
+		if _, exist := mappedUploaders[uploaderName]; exist {
+			panic(fmt.Sprintf("duplicate uploader name %q", uploaderName))
+		}
+		mappedUploaders[uploaderName] = newUploader
+	}
 
 	/* --- app --- */
 	var vHttpAddr = httpAddr
@@ -90,6 +146,36 @@ func init() {
 	if err = defaultObsUplinkOpts.Bind(flag.CommandLine); err != nil {
 		panic(err)
 	}
+
+	/* --- OBS GCS --- */
+	if err = defaultObsGCSOpts.Bind(flag.CommandLine); err != nil {
+		panic(err)
+	}
+
+	/* --- OBS Azure Blob --- */
+	if err = defaultObsAzureOpts.Bind(flag.CommandLine); err != nil {
+		panic(err)
+	}
+
+	/* --- OBS OpenStack Swift --- */
+	if err = defaultObsSwiftOpts.Bind(flag.CommandLine); err != nil {
+		panic(err)
+	}
+
+	/* --- OBS Local filesystem --- */
+	if err = defaultObsFSOpts.Bind(flag.CommandLine); err != nil {
+		panic(err)
+	}
+
+	/* --- CloudFront signer --- */
+	if err = defaultObsCloudFrontOpts.Bind(flag.CommandLine); err != nil {
+		panic(err)
+	}
+
+	/* --- API --- */
+	if err = defaultObsAPIOpts.Bind(flag.CommandLine); err != nil {
+		panic(err)
+	}
 }
 
 func qpostFlagParse(f func()) {
@@ -122,10 +208,37 @@ func main() {
 		"obs_host_redirect", defaultObsOpts.HostRedirect,
 		"obs_redirect_code", defaultObsOpts.RedirectCode,
 		"obs_url_expiry", defaultObsOpts.URLExpiry.String(),
+		"obs_key_patterns", defaultObsOpts.KeyPatterns,
+		"obs_key_extensions", defaultObsOpts.KeyExtensions,
+		"obs_key_policy", defaultObsOpts.KeyPolicy,
+		"obs_routes_file", defaultObsOpts.RoutesFile,
 		// S3
 		"obs_s3_endpoint", defaultObsS3Opts.Endpoint,
 		// Storj (via LibUplink)
 		"obs_storj_satellite_addr", defaultObsUplinkOpts.SatelliteAddress,
+		"obs_storj_share_prefixes", defaultObsUplinkOpts.SharePrefixes,
+		"obs_storj_share_ttl", defaultObsUplinkOpts.ShareTTL.String(),
+		"obs_storj_state_file", defaultObsUplinkOpts.StateFile,
+		"obs_storj_auth_service_addr", defaultObsUplinkOpts.AuthServiceAddress,
+		"obs_storj_proxy", defaultObsUplinkOpts.Proxy,
+		"obs_storj_proxy_parallelism", defaultObsUplinkOpts.ProxyParallelism,
+		// GCS
+		"obs_gcs_endpoint", defaultObsGCSOpts.Endpoint,
+		// Azure Blob
+		"obs_azure_account", defaultObsAzureOpts.AccountName,
+		"obs_azure_endpoint", defaultObsAzureOpts.Endpoint,
+		// OpenStack Swift
+		"obs_swift_storage_url", defaultObsSwiftOpts.StorageURL,
+		"obs_swift_auth_url", defaultObsSwiftOpts.AuthURL,
+		"obs_swift_temp_url_digest", defaultObsSwiftOpts.TempURLDigest,
+		// Local filesystem
+		"obs_fs_root", defaultObsFSOpts.Root,
+		// CloudFront
+		"obs_cloudfront_key_pair_id", defaultObsCloudFrontOpts.KeyPairID,
+		"obs_cloudfront_policy", defaultObsCloudFrontOpts.Policy,
+		// API
+		"obs_api_enabled", defaultObsAPIOpts.Tokens != "",
+		"obs_upload_key_template", defaultObsAPIOpts.UploadKeyTemplate,
 	)
 
 	// lookup server mode handler
@@ -144,5 +257,12 @@ func main() {
 			Opts:       &defaultObsOpts,
 			S3Opts:     &defaultObsS3Opts,
 			UplinkOpts: &defaultObsUplinkOpts,
+			GCSOpts:    &defaultObsGCSOpts,
+			AzureOpts:  &defaultObsAzureOpts,
+			SwiftOpts:  &defaultObsSwiftOpts,
+			FSOpts:     &defaultObsFSOpts,
+
+			CloudFrontOpts: &defaultObsCloudFrontOpts,
+			APIOpts:        &defaultObsAPIOpts,
 		})
 }
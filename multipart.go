@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	ErrKind_Multipart = "OBS_MULTIPART"
+)
+
+const (
+	// S3 part number limit
+	maxUploadParts = 10000
+	// presigned part URLs per request
+	maxSignedParts = 1000
+)
+
+var errUploadTooLarge = errors.New("upload is larger than the policy allows")
+
+type uploadPart struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// multipartUploader is an uploader orchestrating multipart uploads,
+// parts are uploaded by clients to presigned URLs.
+type multipartUploader interface {
+	objectUploader
+	NewMultipartUpload(ctx context.Context, req uploadRequest) (uploadID string, err error)
+	SignUploadPart(ctx context.Context, req uploadRequest, uploadID string, partNumber int) (*signedUpload, error)
+	// CompleteMultipartUpload returns errUploadTooLarge when the parts
+	// add up to more than maxSize.
+	CompleteMultipartUpload(ctx context.Context, req uploadRequest, uploadID string, parts []uploadPart, maxSize int64) (etag string, err error)
+	AbortMultipartUpload(ctx context.Context, req uploadRequest, uploadID string) error
+	// AbortStaleUploads aborts uploads under prefix initiated before
+	// initiatedBefore, with the credential set, empty is the default.
+	AbortStaleUploads(ctx context.Context, bucket, prefix, credentials string, initiatedBefore time.Time) (n int, err error)
+}
+
+type apiMultipartRequest struct {
+	Key      string `json:"key"`
+	UploadID string `json:"upload_id"`
+	// parts to sign, First to Last
+	First int `json:"first,omitempty"`
+	Last  int `json:"last,omitempty"`
+	// parts to complete with
+	Parts []uploadPart `json:"parts,omitempty"`
+}
+
+type apiMultipartResponse struct {
+	Key       string             `json:"key"`
+	UploadID  string             `json:"upload_id,omitempty"`
+	ETag      string             `json:"etag,omitempty"`
+	Parts     []apiMultipartPart `json:"parts,omitempty"`
+	ExpiresAt *time.Time         `json:"expires_at,omitempty"`
+}
+
+type apiMultipartPart struct {
+	PartNumber int    `json:"part_number"`
+	URL        string `json:"url"`
+}
+
+// multipart serves the multipart upload endpoints, action is the path
+// after `multipart/`.
+func (h *signingHandler) multipart(ctx *fasthttp.RequestCtx, callCtx context.Context, action string) {
+	if !ctx.IsPost() {
+		h.apiError(ctx, http.StatusMethodNotAllowed, ErrKind_MethodNotAllowed, "")
+		return
+	}
+	switch action {
+	case "initiate":
+		h.multipartInitiate(ctx, callCtx)
+		return
+	case "parts", "complete", "abort":
+	default:
+		h.apiError(ctx, http.StatusNotFound, ErrKind_ResourceNotFound, "unknown endpoint")
+		return
+	}
+
+	var req apiMultipartRequest
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_InvalidRequest, err)
+		return
+	}
+	if req.Key == "" || req.UploadID == "" {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_InvalidRequest, "key and upload_id are required")
+		return
+	}
+	// the key is validated again, upload IDs aren't bound to a policy
+	r, policy, ok := h.uploadRouteOf(ctx, "", &req.Key)
+	if !ok {
+		return
+	}
+	if _, ok = h.uploadKey(ctx, r, policy, req.Key, "", ""); !ok {
+		return
+	}
+	uploader, ok := h.multipartUploaderOf(ctx, r)
+	if !ok {
+		return
+	}
+	ureq := uploadRequest{
+		Bucket: h.opts.BucketName,
+		Key:    req.Key,
+		Expiry: time.Duration(policy.Expiry),
+	}
+	if r != nil {
+		ureq.Credentials = r.Credentials
+	}
+
+	switch action {
+	case "parts":
+		h.multipartParts(ctx, callCtx, uploader, ureq, req)
+	case "complete":
+		h.multipartComplete(ctx, callCtx, uploader, ureq, req, policy)
+	case "abort":
+		if err := uploader.AbortMultipartUpload(callCtx, ureq, req.UploadID); err != nil {
+			h.apiError(ctx, multipartStatusCode(err), ErrKind_Multipart, err)
+			return
+		}
+		h.logger.Infow("multipart abort",
+			"bucket", ureq.Bucket,
+			"objectName", ureq.Key,
+			"uploadId", req.UploadID)
+		h.apiJSON(ctx, http.StatusOK, apiMultipartResponse{Key: req.Key, UploadID: req.UploadID})
+	}
+}
+
+// multipartInitiate starts a multipart upload of a key chosen like
+// upload does, the declared size is checked against the policy, the
+// completed one too.
+func (h *signingHandler) multipartInitiate(ctx *fasthttp.RequestCtx, callCtx context.Context) {
+	var req apiUploadRequest
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_InvalidRequest, err)
+		return
+	}
+	r, policy, ok := h.uploadRouteOf(ctx, req.Prefix, &req.Key)
+	if !ok {
+		return
+	}
+	if req.Size <= 0 || req.Size > policy.MaxSize {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_UploadPolicy, errors.Errorf("size must be within 1..%d bytes", policy.MaxSize))
+		return
+	}
+	if req.ContentType == "" {
+		req.ContentType = "application/octet-stream"
+	}
+	if !policy.AllowContentType(req.ContentType) {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_UploadPolicy, errors.Errorf("content type %q not allowed", req.ContentType))
+		return
+	}
+	key, ok := h.uploadKey(ctx, r, policy, req.Key, req.Filename, req.ContentType)
+	if !ok {
+		return
+	}
+	uploader, ok := h.multipartUploaderOf(ctx, r)
+	if !ok {
+		return
+	}
+
+	ureq := uploadRequest{
+		Bucket:      h.opts.BucketName,
+		Key:         key,
+		ContentType: req.ContentType,
+		Size:        req.Size,
+	}
+	if r != nil {
+		ureq.Credentials = r.Credentials
+	}
+	uploadID, err := uploader.NewMultipartUpload(callCtx, ureq)
+	if err != nil {
+		h.apiError(ctx, multipartStatusCode(err), ErrKind_Multipart, err)
+		return
+	}
+	h.logger.Infow("multipart initiate",
+		"bucket", ureq.Bucket,
+		"objectName", key,
+		"uploadId", uploadID,
+		"size", req.Size,
+		"contentType", req.ContentType)
+	h.apiJSON(ctx, http.StatusOK, apiMultipartResponse{Key: key, UploadID: uploadID})
+}
+
+// multipartParts presigns part uploads First to Last.
+func (h *signingHandler) multipartParts(ctx *fasthttp.RequestCtx, callCtx context.Context, uploader multipartUploader, ureq uploadRequest, req apiMultipartRequest) {
+	if req.Last == 0 {
+		req.Last = req.First
+	}
+	if req.First < 1 || req.Last > maxUploadParts || req.First > req.Last || req.Last-req.First >= maxSignedParts {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_InvalidRequest,
+			errors.Errorf("parts must be within 1..%d, %d at most per request", maxUploadParts, maxSignedParts))
+		return
+	}
+	res := apiMultipartResponse{Key: ureq.Key, UploadID: req.UploadID}
+	for n := req.First; n <= req.Last; n++ {
+		signed, err := uploader.SignUploadPart(callCtx, ureq, req.UploadID, n)
+		if err != nil {
+			h.apiError(ctx, http.StatusInternalServerError, ErrKind_SignURL, err)
+			return
+		}
+		res.Parts = append(res.Parts, apiMultipartPart{PartNumber: n, URL: signed.URL})
+		res.ExpiresAt = &signed.ExpireAt
+	}
+	h.apiJSON(ctx, http.StatusOK, res)
+}
+
+// multipartComplete completes the upload, it's aborted when the parts
+// exceed the policy max size.
+func (h *signingHandler) multipartComplete(ctx *fasthttp.RequestCtx, callCtx context.Context, uploader multipartUploader, ureq uploadRequest, req apiMultipartRequest, policy *uploadPolicy) {
+	if len(req.Parts) == 0 || len(req.Parts) > maxUploadParts {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_InvalidRequest, errors.Errorf("1..%d parts are required", maxUploadParts))
+		return
+	}
+	sort.Slice(req.Parts, func(i, j int) bool { return req.Parts[i].PartNumber < req.Parts[j].PartNumber })
+	etag, err := uploader.CompleteMultipartUpload(callCtx, ureq, req.UploadID, req.Parts, policy.MaxSize)
+	if errors.Cause(err) == errUploadTooLarge {
+		if abortErr := uploader.AbortMultipartUpload(callCtx, ureq, req.UploadID); abortErr != nil {
+			h.logger.Errorw("abort too large multipart upload",
+				"objectName", ureq.Key,
+				"uploadId", req.UploadID,
+				"err", abortErr)
+		}
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_UploadPolicy, err)
+		return
+	}
+	if err != nil {
+		h.apiError(ctx, multipartStatusCode(err), ErrKind_Multipart, err)
+		return
+	}
+	h.logger.Infow("multipart complete",
+		"bucket", ureq.Bucket,
+		"objectName", ureq.Key,
+		"uploadId", req.UploadID,
+		"parts", len(req.Parts))
+	h.apiJSON(ctx, http.StatusOK, apiMultipartResponse{Key: ureq.Key, ETag: etag})
+}
+
+// multipartUploaderOf returns multipart uploader of the route backend,
+// r can be nil. ok is false when an error response has been written.
+func (h *signingHandler) multipartUploaderOf(ctx *fasthttp.RequestCtx, r *route) (_ multipartUploader, ok bool) {
+	uploader, ok := h.uploaderOf(ctx, r)
+	if !ok {
+		return
+	}
+	mu, ok := uploader.(multipartUploader)
+	if !ok {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_UploadPolicy, errors.Errorf("backend %q doesn't support multipart uploads", uploader.Name()))
+		return
+	}
+	return mu, true
+}
+
+// multipartStatusCode relays client errors of the backend, ex. an
+// unknown upload ID or a missing part.
+func multipartStatusCode(err error) int {
+	res := minio.ToErrorResponse(errors.Cause(err))
+	// abort reports a missing upload without a status code
+	if res.Code == "NoSuchUpload" || res.StatusCode >= 400 && res.StatusCode < 500 {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// multipartCleanup aborts stale uploads under a key prefix.
+type multipartCleanup struct {
+	uploader    multipartUploader
+	prefix      string
+	credentials string
+}
+
+// initMultipartCleanup aborts, every interval, multipart uploads older
+// than maxAge under the key prefixes of the upload policies.
+func (h *signingHandler) initMultipartCleanup(ctx context.Context, interval, maxAge time.Duration) {
+	var jobs []multipartCleanup
+	add := func(r *route, policy *uploadPolicy) {
+		backend := h.defaultBackend
+		if r != nil && r.Backend != "" {
+			backend = r.Backend
+		}
+		if mu, ok := h.uploaders[backend].(multipartUploader); ok {
+			job := multipartCleanup{uploader: mu, prefix: policy.tmpl.Prefix()}
+			if r != nil {
+				job.credentials = r.Credentials
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	add(h.routes.Match(h.uploadPolicy.tmpl.Prefix()), h.uploadPolicy)
+	for _, r := range h.routes.routes {
+		add(r, h.uploadPolicyOf(r))
+	}
+	// drop prefixes covered by a shorter one
+	sort.SliceStable(jobs, func(i, j int) bool { return len(jobs[i].prefix) < len(jobs[j].prefix) })
+	deduped := jobs[:0]
+	for _, job := range jobs {
+		covered := false
+		for _, prev := range deduped {
+			covered = covered || (prev.uploader == job.uploader && prev.credentials == job.credentials && strings.HasPrefix(job.prefix, prev.prefix))
+		}
+		if !covered {
+			deduped = append(deduped, job)
+		}
+	}
+	jobs = deduped
+	if len(jobs) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			h.cleanupMultipart(ctx, jobs, time.Now().Add(-maxAge))
+		}
+	}()
+}
+
+func (h *signingHandler) cleanupMultipart(ctx context.Context, jobs []multipartCleanup, initiatedBefore time.Time) {
+	for _, job := range jobs {
+		n, err := job.uploader.AbortStaleUploads(ctx, h.opts.BucketName, job.prefix, job.credentials, initiatedBefore)
+		if err != nil {
+			h.logger.Errorw("abort stale multipart uploads",
+				"prefix", job.prefix,
+				"err", err)
+		}
+		if n > 0 {
+			h.logger.Infow("aborted stale multipart uploads",
+				"prefix", job.prefix,
+				"count", n)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// testS3Multipart is a fake S3 keeping multipart uploads in memory.
+type testS3Multipart struct {
+	mu        sync.Mutex
+	uploads   map[string]string // upload ID -> key
+	initiated map[string]time.Time
+	parts     map[string]map[int]int64
+	completed map[string]string // key -> complete request body
+	next      int
+	// access keys of the requests, in order
+	accessKeys []string
+}
+
+func newTestS3Multipart(t *testing.T) (*testS3Multipart, *httptest.Server) {
+	f := &testS3Multipart{
+		uploads:   map[string]string{},
+		initiated: map[string]time.Time{},
+		parts:     map[string]map[int]int64{},
+		completed: map[string]string{},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *testS3Multipart) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// V2 `AWS key:signature`
+	if accessKey, _, ok := strings.Cut(strings.TrimPrefix(r.Header.Get("Authorization"), "AWS "), ":"); ok {
+		f.accessKeys = append(f.accessKeys, accessKey)
+	}
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+	q := r.URL.Query()
+	uploadID := q.Get("uploadId")
+	if uploadID != "" && f.uploads[uploadID] != key {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<Error><Code>NoSuchUpload</Code><Message>no such upload</Message></Error>`)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.next++
+		uploadID = fmt.Sprintf("upload-%d", f.next)
+		f.uploads[uploadID] = key
+		f.initiated[uploadID] = time.Now()
+		f.parts[uploadID] = map[int]int64{}
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, key, uploadID)
+	case r.Method == http.MethodGet && q.Has("uploads"):
+		fmt.Fprint(w, `<ListMultipartUploadsResult><Bucket>bucket</Bucket><IsTruncated>false</IsTruncated>`)
+		for id, k := range f.uploads {
+			if strings.HasPrefix(k, q.Get("prefix")) {
+				fmt.Fprintf(w, `<Upload><Key>%s</Key><UploadId>%s</UploadId><Initiated>%s</Initiated></Upload>`,
+					k, id, f.initiated[id].UTC().Format(time.RFC3339))
+			}
+		}
+		fmt.Fprint(w, `</ListMultipartUploadsResult>`)
+	case r.Method == http.MethodGet && uploadID != "":
+		fmt.Fprint(w, `<ListPartsResult><Bucket>bucket</Bucket><IsTruncated>false</IsTruncated>`)
+		for n, size := range f.parts[uploadID] {
+			fmt.Fprintf(w, `<Part><PartNumber>%d</PartNumber><ETag>"etag-%d"</ETag><Size>%d</Size></Part>`, n, n, size)
+		}
+		fmt.Fprint(w, `</ListPartsResult>`)
+	case r.Method == http.MethodPost && uploadID != "":
+		b, _ := io.ReadAll(r.Body)
+		f.completed[key] = string(b)
+		f.deleteUpload(uploadID)
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><ETag>"final-etag"</ETag></CompleteMultipartUploadResult>`, key)
+	case r.Method == http.MethodDelete && uploadID != "":
+		f.deleteUpload(uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (f *testS3Multipart) deleteUpload(uploadID string) {
+	delete(f.uploads, uploadID)
+	delete(f.initiated, uploadID)
+	delete(f.parts, uploadID)
+}
+
+func (f *testS3Multipart) uploadPart(uploadID string, n int, size int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.parts[uploadID][n] = size
+}
+
+func testMultipartServerOptions(t *testing.T, s3URL string) serverOptions {
+	u, _ := url.Parse(s3URL)
+	opts := testS3ServerOptions(t, u.Host, `{"routes":[
+		{"prefix":"videos/","upload":{"key_template":"videos/{uuid}.{ext}","max_size":10485760}}
+	]}`)
+	apiOpts := defaultObsAPIOpts
+	apiOpts.Tokens = "token"
+	apiOpts.MultipartMaxAge = 0
+	opts.APIOpts = &apiOpts
+	return opts
+}
+
+func TestSigningHandlerMultipart(t *testing.T) {
+	fake, srv := newTestS3Multipart(t)
+	c := newTestServer(t, &serverS3{}, testMultipartServerOptions(t, srv.URL))
+	call := func(action, body string, res any) int {
+		resp := doTestAPIRequest(t, c, "http://signer/_api/multipart/"+action, "token", body)
+		if res != nil && resp.StatusCode() == http.StatusOK {
+			require.NoError(t, json.Unmarshal(resp.Body(), res))
+		}
+		return resp.StatusCode()
+	}
+
+	var initiated apiMultipartResponse
+	require.Equal(t, http.StatusOK, call("initiate", `{"prefix":"videos/","filename":"a.mp4","content_type":"video/mp4","size":8388608}`, &initiated))
+	require.Regexp(t, `^videos/[0-9a-f-]{36}\.mp4$`, initiated.Key)
+	require.Equal(t, "upload-1", initiated.UploadID)
+
+	var parts apiMultipartResponse
+	require.Equal(t, http.StatusOK, call("parts", fmt.Sprintf(`{"key":%q,"upload_id":"upload-1","first":1,"last":2}`, initiated.Key), &parts))
+	require.Len(t, parts.Parts, 2)
+	u, err := url.Parse(parts.Parts[1].URL)
+	require.NoError(t, err)
+	require.Equal(t, "2", u.Query().Get("partNumber"))
+	require.Equal(t, "upload-1", u.Query().Get("uploadId"))
+	require.Equal(t, "/bucket/"+initiated.Key, u.Path)
+	require.NotEmpty(t, u.Query().Get("X-Amz-Signature"))
+	require.NotNil(t, parts.ExpiresAt)
+
+	fake.uploadPart("upload-1", 1, 5<<20)
+	fake.uploadPart("upload-1", 2, 3<<20)
+	var completed apiMultipartResponse
+	require.Equal(t, http.StatusOK, call("complete", fmt.Sprintf(`{"key":%q,"upload_id":"upload-1","parts":[
+		{"part_number":2,"etag":"\"etag-2\""},{"part_number":1,"etag":"\"etag-1\""}]}`, initiated.Key), &completed))
+	require.Equal(t, "final-etag", completed.ETag)
+	var body struct {
+		Parts []struct{ PartNumber int } `xml:"Part"`
+	}
+	require.NoError(t, xml.Unmarshal([]byte(fake.completed[initiated.Key]), &body))
+	require.Len(t, body.Parts, 2)
+	require.Equal(t, 1, body.Parts[0].PartNumber)
+
+	// completed parts over the max size abort the upload
+	require.Equal(t, http.StatusOK, call("initiate", `{"prefix":"videos/","filename":"b.mp4","size":1024}`, &initiated))
+	fake.uploadPart(initiated.UploadID, 1, 6<<20)
+	fake.uploadPart(initiated.UploadID, 2, 6<<20)
+	require.Equal(t, http.StatusBadRequest, call("complete", fmt.Sprintf(`{"key":%q,"upload_id":%q,"parts":[
+		{"part_number":1,"etag":"a"},{"part_number":2,"etag":"b"}]}`, initiated.Key, initiated.UploadID), nil))
+	require.NotContains(t, fake.uploads, initiated.UploadID)
+
+	// abort
+	require.Equal(t, http.StatusOK, call("initiate", `{"prefix":"videos/","filename":"c.mp4","size":1024}`, &initiated))
+	require.Equal(t, http.StatusOK, call("abort", fmt.Sprintf(`{"key":%q,"upload_id":%q}`, initiated.Key, initiated.UploadID), nil))
+	require.Equal(t, http.StatusBadRequest, call("abort", fmt.Sprintf(`{"key":%q,"upload_id":%q}`, initiated.Key, initiated.UploadID), nil))
+
+	for action, body := range map[string]string{
+		"initiate": `{"prefix":"videos/","filename":"big.mp4","size":10485761}`,
+		"parts":    `{"key":"videos/mine.mp4","upload_id":"upload-1","first":1}`,
+		"complete": `{"key":"uploads/0f8fad5b-d9cb-469f-a165-70867728950e.mp4","upload_id":"upload-1"}`,
+		"abort":    `{"key":"videos/0f8fad5b-d9cb-469f-a165-70867728950e.mp4"}`,
+	} {
+		require.Equal(t, http.StatusBadRequest, call(action, body, nil), action)
+	}
+	require.Equal(t, http.StatusBadRequest, call("parts", fmt.Sprintf(`{"key":%q,"upload_id":"x","first":1,"last":1001}`, initiated.Key), nil))
+	require.Equal(t, http.StatusBadRequest, call("parts", fmt.Sprintf(`{"key":%q,"upload_id":"x","first":10001}`, initiated.Key), nil))
+	require.Equal(t, http.StatusNotFound, call("unknown", `{"key":"a","upload_id":"b"}`, nil))
+}
+
+func TestSigningHandlerMultipartCredentialSets(t *testing.T) {
+	fake, srv := newTestS3Multipart(t)
+	opts := testMultipartServerOptions(t, srv.URL)
+	setsFile := filepath.Join(t.TempDir(), "sets.json")
+	writeTestCredentialSets(t, setsFile, `{"sets":{"videos":{"keys":[{"access_key":"VIDEOS","secret_key":"s"}]}}}`)
+	opts.S3Opts.CredentialSetsFile = setsFile
+	opts.Opts.RoutesFile = writeTestRoutes(t, `{"routes":[
+		{"prefix":"videos/","credentials":"videos","upload":{"key_template":"videos/{uuid}.{ext}","max_size":10485760}}
+	]}`)
+	c := newTestServer(t, &serverS3{}, opts)
+	call := func(action, body string, res any) int {
+		resp := doTestAPIRequest(t, c, "http://signer/_api/multipart/"+action, "token", body)
+		if res != nil && resp.StatusCode() == http.StatusOK {
+			require.NoError(t, json.Unmarshal(resp.Body(), res))
+		}
+		return resp.StatusCode()
+	}
+
+	// parts are signed with the set, so are the server calls
+	var initiated, parts apiMultipartResponse
+	require.Equal(t, http.StatusOK, call("initiate", `{"prefix":"videos/","filename":"a.mp4","size":1024}`, &initiated))
+	require.Equal(t, http.StatusOK, call("parts", fmt.Sprintf(`{"key":%q,"upload_id":%q,"first":1}`, initiated.Key, initiated.UploadID), &parts))
+	u, err := url.Parse(parts.Parts[0].URL)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(u.Query().Get("X-Amz-Credential"), "VIDEOS/"))
+	fake.uploadPart(initiated.UploadID, 1, 1024)
+	require.Equal(t, http.StatusOK, call("complete", fmt.Sprintf(`{"key":%q,"upload_id":%q,"parts":[{"part_number":1,"etag":"a"}]}`, initiated.Key, initiated.UploadID), nil))
+	require.Equal(t, http.StatusOK, call("initiate", `{"prefix":"videos/","filename":"b.mp4","size":1024}`, &initiated))
+	require.Equal(t, http.StatusOK, call("abort", fmt.Sprintf(`{"key":%q,"upload_id":%q}`, initiated.Key, initiated.UploadID), nil))
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	require.NotEmpty(t, fake.accessKeys)
+	for _, accessKey := range fake.accessKeys {
+		require.Equal(t, "VIDEOS", accessKey)
+	}
+}
+
+func TestSigningHandlerMultipartCleanup(t *testing.T) {
+	fake, srv := newTestS3Multipart(t)
+	s := &serverS3{}
+	opts := testMultipartServerOptions(t, srv.URL)
+	opts.Logger = zap.NewNop()
+	require.NoError(t, s.Init(context.Background(), opts))
+
+	fake.uploads["old"], fake.initiated["old"] = "videos/old.mp4", time.Now().Add(-48*time.Hour)
+	fake.uploads["new"], fake.initiated["new"] = "videos/new.mp4", time.Now()
+	fake.uploads["other"], fake.initiated["other"] = "other/old.mp4", time.Now().Add(-48*time.Hour)
+
+	s.cleanupMultipart(context.Background(), []multipartCleanup{
+		{uploader: s.uploaders[backendS3Name].(multipartUploader), prefix: "videos/"},
+	}, time.Now().Add(-24*time.Hour))
+	require.NotContains(t, fake.uploads, "old")
+	require.Contains(t, fake.uploads, "new")
+	require.Contains(t, fake.uploads, "other")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// image variant formats, the variant of `x.jpg` is `x.<format>`
+var imageVariantTypes = map[string]string{
+	"avif": "image/avif",
+	"webp": "image/webp",
+	"jxl":  "image/jxl",
+}
+
+// content codings, the precompressed `x.js` is `x.js<ext>`
+var encodingExts = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// keys having image variants
+var imageSourceExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+}
+
+// negotiator picks sibling keys of an object by the request `Accept`
+// and `Accept-Encoding` headers.
+type negotiator struct {
+	// variant formats in preference order
+	images []string
+	// content codings in preference order
+	encodings []string
+	// extensions of keys having precompressed siblings
+	precompressed map[string]bool
+}
+
+func newNegotiator(images, encodings, extensions []string) (n *negotiator, err error) {
+	n = &negotiator{precompressed: map[string]bool{}}
+	for _, format := range images {
+		format = strings.ToLower(format)
+		if _, ok := imageVariantTypes[format]; !ok {
+			return nil, errors.Errorf("unknown image format %q", format)
+		}
+		n.images = append(n.images, format)
+	}
+	for _, encoding := range encodings {
+		encoding = strings.ToLower(encoding)
+		if _, ok := encodingExts[encoding]; !ok {
+			return nil, errors.Errorf("unknown encoding %q", encoding)
+		}
+		n.encodings = append(n.encodings, encoding)
+	}
+	for _, ext := range extensions {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		n.precompressed[ext] = true
+	}
+	return
+}
+
+// negotiatedKey is a sibling key candidate of a negotiated object.
+type negotiatedKey struct {
+	Key string
+	// content coding of a precompressed sibling
+	Encoding string
+}
+
+// Candidates returns sibling keys of key the request accepts, in
+// preference order, and the headers the response varies on. The key
+// itself isn't a candidate.
+func (n *negotiator) Candidates(key string, accept, acceptEncoding []byte) (candidates []negotiatedKey, vary []string) {
+	if n == nil {
+		return
+	}
+	ext := strings.ToLower(path.Ext(key))
+	if len(n.images) > 0 && imageSourceExts[ext] {
+		vary = append(vary, "Accept")
+		base := strings.TrimSuffix(key, path.Ext(key))
+		for _, format := range n.images {
+			if acceptsToken(string(accept), imageVariantTypes[format]) {
+				candidates = append(candidates, negotiatedKey{Key: base + "." + format})
+			}
+		}
+	}
+	if len(n.encodings) > 0 && n.precompressed[ext] {
+		vary = append(vary, "Accept-Encoding")
+		for _, encoding := range n.encodings {
+			if acceptsToken(string(acceptEncoding), encoding) {
+				candidates = append(candidates, negotiatedKey{Key: key + encodingExts[encoding], Encoding: encoding})
+			}
+		}
+	}
+	return
+}
+
+// acceptsToken reports whether an `Accept` like header lists token
+// with a non-zero quality, wildcards aren't taken as an explicit
+// support of a variant.
+func acceptsToken(header, token string) bool {
+	for _, item := range strings.Split(header, ",") {
+		value, params, _ := strings.Cut(item, ";")
+		if !strings.EqualFold(strings.TrimSpace(value), token) {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(k), "q") {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil || q <= 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
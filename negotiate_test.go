@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func TestAcceptsToken(t *testing.T) {
+	accept := "text/html,image/avif;q=0,image/WEBP,*/*;q=0.8"
+	require.True(t, acceptsToken(accept, "image/webp"))
+	require.False(t, acceptsToken(accept, "image/avif"))
+	require.False(t, acceptsToken(accept, "image/jxl"))
+	require.True(t, acceptsToken("gzip, deflate, br;q=0.5", "br"))
+	require.False(t, acceptsToken("gzip;q=x", "gzip"))
+	require.False(t, acceptsToken("", "gzip"))
+}
+
+func TestNegotiatorCandidates(t *testing.T) {
+	n, err := newNegotiator([]string{"avif", "webp"}, []string{"br", "gzip"}, []string{"js", ".css"})
+	require.NoError(t, err)
+
+	candidates, vary := n.Candidates("a/x.JPG", []byte("image/webp,image/avif"), []byte("br"))
+	require.Equal(t, []negotiatedKey{{Key: "a/x.avif"}, {Key: "a/x.webp"}}, candidates)
+	require.Equal(t, []string{"Accept"}, vary)
+
+	candidates, vary = n.Candidates("app.js", []byte("image/webp"), []byte("gzip, br"))
+	require.Equal(t, []negotiatedKey{{Key: "app.js.br", Encoding: "br"}, {Key: "app.js.gz", Encoding: "gzip"}}, candidates)
+	require.Equal(t, []string{"Accept-Encoding"}, vary)
+
+	candidates, vary = n.Candidates("a.png", nil, nil)
+	require.Empty(t, candidates)
+	require.Equal(t, []string{"Accept"}, vary)
+
+	candidates, vary = n.Candidates("doc.pdf", []byte("image/webp"), []byte("br"))
+	require.Empty(t, candidates)
+	require.Empty(t, vary)
+
+	candidates, vary = (*negotiator)(nil).Candidates("a.jpg", []byte("image/webp"), nil)
+	require.Empty(t, candidates)
+	require.Empty(t, vary)
+
+	_, err = newNegotiator([]string{"heic"}, nil, nil)
+	require.Error(t, err)
+	_, err = newNegotiator(nil, []string{"deflate"}, nil)
+	require.Error(t, err)
+}
+
+func TestSigningHandlerNegotiation(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"x.jpg", "x.webp", "y.jpg", "y.avif", "app.js", "app.js.br", "app.js.gz", "style.css"} {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(name), 0o644))
+	}
+
+	opts := defaultObsOpts
+	opts.URLExpiry = time.Hour
+	opts.NegotiateImages = "avif,webp"
+	opts.NegotiateEncodings = "br,gzip"
+	opts.KeyPatterns = "!y.avif"
+	c := newTestServer(t, &serverFS{}, serverOptions{
+		Opts:   &opts,
+		FSOpts: &obsFSOptions{Root: root, Secret: "test"},
+	})
+	get := func(uri, header, value string) *fasthttp.Response {
+		req := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(req)
+		req.SetRequestURI(uri)
+		req.Header.Set(header, value)
+		resp := &fasthttp.Response{}
+		require.NoError(t, c.Do(req, resp))
+		return resp
+	}
+	follow := func(resp *fasthttp.Response) *fasthttp.Response {
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+		return doTestRequest(t, c, http.MethodGet, string(resp.Header.Peek("Location")))
+	}
+
+	accept := "image/avif,image/webp,*/*"
+	resp := get("http://signer/x.jpg", "Accept", accept)
+	require.Equal(t, "Accept", string(resp.Header.Peek("Vary")))
+	require.Equal(t, "x.webp", string(follow(resp).Body()))
+	resp = get("http://signer/x.jpg", "Accept", "image/*")
+	require.Equal(t, "Accept", string(resp.Header.Peek("Vary")))
+	require.Equal(t, "x.jpg", string(follow(resp).Body()))
+	// blocked variants aren't candidates
+	require.Equal(t, "y.jpg", string(follow(get("http://signer/y.jpg", "Accept", accept)).Body()))
+
+	resp = get("http://signer/app.js", "Accept-Encoding", "gzip, br")
+	require.Equal(t, "Accept-Encoding", string(resp.Header.Peek("Vary")))
+	resp = follow(resp)
+	require.Equal(t, "app.js.br", string(resp.Body()))
+	require.Equal(t, "br", string(resp.Header.Peek("Content-Encoding")))
+	require.Equal(t, "text/javascript; charset=utf-8", string(resp.Header.Peek("Content-Type")))
+	resp = follow(get("http://signer/app.js", "Accept-Encoding", "gzip"))
+	require.Equal(t, "app.js.gz", string(resp.Body()))
+	require.Equal(t, "gzip", string(resp.Header.Peek("Content-Encoding")))
+	// no precompressed sibling
+	resp = follow(get("http://signer/style.css", "Accept-Encoding", "br"))
+	require.Equal(t, "style.css", string(resp.Body()))
+	require.Empty(t, resp.Header.Peek("Content-Encoding"))
+
+	resp = get("http://signer/missing.jpg", "Accept", accept)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode())
+}
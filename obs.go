@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"strconv"
@@ -18,12 +19,39 @@ type obsOptions struct {
 	HostRedirect   string
 
 	RemoveBucketName bool
+
+	KeyPatterns   string // comma separated glob patterns, `!` prefix excludes
+	KeyExtensions string // comma separated file extension allowlist
+
+	KeyPolicy    string // `strict` or `canonicalize` dot segments
+	MaxKeyLength int
+
+	RoutesFile string // JSON per-prefix route overrides
+
+	ResponseParams string // comma separated query overrides allowlist: download, filename, type
+	ResponseTypes  string // comma separated `type` allowlist, `type/*` wildcards
+
+	NegotiateImages         string // comma separated image variant formats by preference, ex. `avif,webp`
+	NegotiateEncodings      string // comma separated precompressed codings by preference, ex. `br,gzip`
+	PrecompressedExtensions string // comma separated extensions of keys having precompressed siblings
+
+	WebsiteIndex         string // index document of directory-like keys, empty disables website mode
+	WebsiteErrorDocument string // served with 404 for missing keys in website mode
+
+	VersionQuery     bool // allow `versionId` query parameter
+	VersionPinLatest bool // sign the explicit ID of the latest version
+
+	HealthPath string // health check endpoint, empty disables
 }
 
 var defaultObsOpts = obsOptions{
 	URLExpiry:        maxURLExpiry,
 	RedirectCode:     http.StatusMovedPermanently, // 301
 	RemoveBucketName: false,
+	KeyPolicy:        keyPolicyCanonicalize,
+	MaxKeyLength:     defaultMaxKeyLength,
+
+	PrecompressedExtensions: ".js,.mjs,.css,.svg,.html,.json,.wasm",
 }
 
 func (opts *obsOptions) Bind(fs *flag.FlagSet) (err error) {
@@ -73,5 +101,120 @@ func (opts *obsOptions) Bind(fs *flag.FlagSet) (err error) {
 		vObsRemoveBucketName, _ = strconv.ParseBool(sObsRemoveBucketName)
 	}
 	fs.BoolVar(&opts.RemoveBucketName, "obs-remove-bucket-name", vObsRemoveBucketName, "OBS Remove Bucket name from prefix")
+
+	var vObsKeyPatterns = opts.KeyPatterns
+	if sObsKeyPatterns := os.Getenv("OBS_KEY_PATTERNS"); sObsKeyPatterns != "" {
+		vObsKeyPatterns = sObsKeyPatterns
+	}
+	fs.StringVar(&opts.KeyPatterns, "obs-key-patterns", vObsKeyPatterns, "OBS Object key glob patterns, comma separated (ex. `**/*.jpg,!internal/**`)")
+
+	var vObsKeyExtensions = opts.KeyExtensions
+	if sObsKeyExtensions := os.Getenv("OBS_KEY_EXTENSIONS"); sObsKeyExtensions != "" {
+		vObsKeyExtensions = sObsKeyExtensions
+	}
+	fs.StringVar(&opts.KeyExtensions, "obs-key-extensions", vObsKeyExtensions, "OBS Object key file extension allowlist, comma separated (ex. `.jpg,.png`)")
+
+	var vObsKeyPolicy = opts.KeyPolicy
+	if sObsKeyPolicy := os.Getenv("OBS_KEY_POLICY"); sObsKeyPolicy != "" {
+		vObsKeyPolicy = sObsKeyPolicy
+	}
+	fs.StringVar(&opts.KeyPolicy, "obs-key-policy", vObsKeyPolicy,
+		fmt.Sprintf("OBS Object key dot segment policy (available [%s, %s])", keyPolicyStrict, keyPolicyCanonicalize))
+
+	var vObsMaxKeyLength = opts.MaxKeyLength
+	if sObsMaxKeyLength := os.Getenv("OBS_MAX_KEY_LENGTH"); sObsMaxKeyLength != "" {
+		var obsMaxKeyLength int64
+		if obsMaxKeyLength, err = strconv.ParseInt(sObsMaxKeyLength, 10, 64); err != nil {
+			err = errors.Wrap(err, "obs max key length")
+			return
+		}
+		vObsMaxKeyLength = int(obsMaxKeyLength)
+	}
+	fs.IntVar(&opts.MaxKeyLength, "obs-max-key-length", vObsMaxKeyLength, "OBS Object key max length in bytes")
+
+	var vObsRoutesFile = opts.RoutesFile
+	if sObsRoutesFile := os.Getenv("OBS_ROUTES_FILE"); sObsRoutesFile != "" {
+		vObsRoutesFile = sObsRoutesFile
+	}
+	fs.StringVar(&opts.RoutesFile, "obs-routes-file", vObsRoutesFile, "OBS Routes JSON file")
+
+	var vObsResponseParams = opts.ResponseParams
+	if sObsResponseParams := os.Getenv("OBS_RESPONSE_PARAMS"); sObsResponseParams != "" {
+		vObsResponseParams = sObsResponseParams
+	}
+	fs.StringVar(&opts.ResponseParams, "obs-response-params", vObsResponseParams, "OBS Query parameters signed as response overrides, comma separated (available [download, filename, type])")
+
+	var vObsResponseTypes = opts.ResponseTypes
+	if sObsResponseTypes := os.Getenv("OBS_RESPONSE_TYPES"); sObsResponseTypes != "" {
+		vObsResponseTypes = sObsResponseTypes
+	}
+	fs.StringVar(&opts.ResponseTypes, "obs-response-types", vObsResponseTypes, "OBS Content types allowed by the type parameter, comma separated (ex. `image/*,text/plain`)")
+
+	var vObsNegotiateImages = opts.NegotiateImages
+	if sObsNegotiateImages := os.Getenv("OBS_NEGOTIATE_IMAGES"); sObsNegotiateImages != "" {
+		vObsNegotiateImages = sObsNegotiateImages
+	}
+	fs.StringVar(&opts.NegotiateImages, "obs-negotiate-images", vObsNegotiateImages, "OBS Image variant formats negotiated by Accept in preference order, comma separated (available [avif, webp, jxl])")
+
+	var vObsNegotiateEncodings = opts.NegotiateEncodings
+	if sObsNegotiateEncodings := os.Getenv("OBS_NEGOTIATE_ENCODINGS"); sObsNegotiateEncodings != "" {
+		vObsNegotiateEncodings = sObsNegotiateEncodings
+	}
+	fs.StringVar(&opts.NegotiateEncodings, "obs-negotiate-encodings", vObsNegotiateEncodings, "OBS Precompressed codings negotiated by Accept-Encoding in preference order, comma separated (available [br, gzip, zstd])")
+
+	var vObsPrecompressedExtensions = opts.PrecompressedExtensions
+	if sObsPrecompressedExtensions := os.Getenv("OBS_PRECOMPRESSED_EXTENSIONS"); sObsPrecompressedExtensions != "" {
+		vObsPrecompressedExtensions = sObsPrecompressedExtensions
+	}
+	fs.StringVar(&opts.PrecompressedExtensions, "obs-precompressed-extensions", vObsPrecompressedExtensions, "OBS Extensions of keys having precompressed siblings, comma separated")
+
+	var vObsWebsiteIndex = opts.WebsiteIndex
+	if sObsWebsiteIndex := os.Getenv("OBS_WEBSITE_INDEX"); sObsWebsiteIndex != "" {
+		vObsWebsiteIndex = sObsWebsiteIndex
+	}
+	fs.StringVar(&opts.WebsiteIndex, "obs-website-index", vObsWebsiteIndex, "OBS Website index document of directory-like keys (ex. `index.html`), empty disables website mode")
+
+	var vObsWebsiteErrorDocument = opts.WebsiteErrorDocument
+	if sObsWebsiteErrorDocument := os.Getenv("OBS_WEBSITE_ERROR_DOCUMENT"); sObsWebsiteErrorDocument != "" {
+		vObsWebsiteErrorDocument = sObsWebsiteErrorDocument
+	}
+	fs.StringVar(&opts.WebsiteErrorDocument, "obs-website-error-document", vObsWebsiteErrorDocument, "OBS Website document served with 404 for missing keys (ex. `404.html`)")
+
+	var vObsVersionQuery = opts.VersionQuery
+	if sObsVersionQuery := os.Getenv("OBS_VERSION_QUERY"); sObsVersionQuery != "" {
+		vObsVersionQuery, _ = strconv.ParseBool(sObsVersionQuery)
+	}
+	fs.BoolVar(&opts.VersionQuery, "obs-version-query", vObsVersionQuery, "OBS Allow versionId query parameter selecting the object version")
+
+	var vObsVersionPinLatest = opts.VersionPinLatest
+	if sObsVersionPinLatest := os.Getenv("OBS_VERSION_PIN_LATEST"); sObsVersionPinLatest != "" {
+		vObsVersionPinLatest, _ = strconv.ParseBool(sObsVersionPinLatest)
+	}
+	fs.BoolVar(&opts.VersionPinLatest, "obs-version-pin-latest", vObsVersionPinLatest, "OBS Sign the explicit versionId of the latest object version")
+
+	var vObsHealthPath = opts.HealthPath
+	if sObsHealthPath := os.Getenv("OBS_HEALTH_PATH"); sObsHealthPath != "" {
+		vObsHealthPath = sObsHealthPath
+	}
+	fs.StringVar(&opts.HealthPath, "obs-health-path", vObsHealthPath, "OBS Health check endpoint path, empty disables")
 	return
 }
+
+func (opts *obsOptions) KeyFilter() (*keyFilter, error) {
+	return newKeyFilter(splitList(opts.KeyPatterns), splitList(opts.KeyExtensions))
+}
+
+func (opts *obsOptions) Routes() (*routeTable, error) {
+	return loadRoutes(opts.RoutesFile)
+}
+
+func (opts *obsOptions) Negotiator() (*negotiator, error) {
+	if opts.NegotiateImages == "" && opts.NegotiateEncodings == "" {
+		return nil, nil
+	}
+	return newNegotiator(splitList(opts.NegotiateImages), splitList(opts.NegotiateEncodings), splitList(opts.PrecompressedExtensions))
+}
+
+func (opts *obsOptions) ResponseOverrides() (*responseOverrides, error) {
+	return newResponseOverrides(splitList(opts.ResponseParams), splitList(opts.ResponseTypes))
+}
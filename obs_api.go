@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// obsAPIOptions configures the authenticated JSON API under apiPrefix.
+type obsAPIOptions struct {
+	Tokens string // comma separated bearer tokens, empty disables the API
+
+	// upload defaults, routes may override them
+	UploadKeyTemplate  string
+	UploadMaxSize      int64
+	UploadContentTypes string // comma separated, `type/*` wildcards
+	UploadURLExpiry    time.Duration
+	UploadRedirect     string // browser POST upload success redirect
+
+	// stale multipart uploads cleanup, zero disables
+	MultipartMaxAge          time.Duration
+	MultipartCleanupInterval time.Duration
+}
+
+const apiPrefix = "/_api/"
+
+// S3 single PUT and multipart upload limits
+const (
+	maxUploadSize          = 5 << 30
+	maxMultipartUploadSize = 5 << 40
+)
+
+var defaultObsAPIOpts = obsAPIOptions{
+	UploadKeyTemplate: "uploads/{uuid}.{ext}",
+	UploadMaxSize:     maxUploadSize,
+	UploadURLExpiry:   15 * time.Minute,
+
+	MultipartMaxAge:          24 * time.Hour,
+	MultipartCleanupInterval: time.Hour,
+}
+
+func (opts *obsAPIOptions) Bind(fs *flag.FlagSet) (err error) {
+	var vTokens = opts.Tokens
+	if sTokens := os.Getenv("OBS_API_TOKENS"); sTokens != "" {
+		vTokens = sTokens
+	}
+	fs.StringVar(&opts.Tokens, "obs-api-tokens", vTokens, "OBS API comma separated bearer tokens, empty disables the API")
+
+	var vUploadKeyTemplate = opts.UploadKeyTemplate
+	if sUploadKeyTemplate := os.Getenv("OBS_UPLOAD_KEY_TEMPLATE"); sUploadKeyTemplate != "" {
+		vUploadKeyTemplate = sUploadKeyTemplate
+	}
+	fs.StringVar(&opts.UploadKeyTemplate, "obs-upload-key-template", vUploadKeyTemplate, "OBS Upload key template, placeholders: {uuid}, {ext}, {date}")
+
+	var vUploadMaxSize = opts.UploadMaxSize
+	if sUploadMaxSize := os.Getenv("OBS_UPLOAD_MAX_SIZE"); sUploadMaxSize != "" {
+		if vUploadMaxSize, err = strconv.ParseInt(sUploadMaxSize, 10, 64); err != nil {
+			err = errors.Wrap(err, "obs upload max size")
+			return
+		}
+	}
+	fs.Int64Var(&opts.UploadMaxSize, "obs-upload-max-size", vUploadMaxSize, "OBS Upload max object size in bytes")
+
+	var vUploadContentTypes = opts.UploadContentTypes
+	if sUploadContentTypes := os.Getenv("OBS_UPLOAD_CONTENT_TYPES"); sUploadContentTypes != "" {
+		vUploadContentTypes = sUploadContentTypes
+	}
+	fs.StringVar(&opts.UploadContentTypes, "obs-upload-content-types", vUploadContentTypes, "OBS Upload allowed content types, empty allows any")
+
+	var vUploadURLExpiry = opts.UploadURLExpiry
+	if sUploadURLExpiry := os.Getenv("OBS_UPLOAD_URL_EXPIRY"); sUploadURLExpiry != "" {
+		if vUploadURLExpiry, err = time.ParseDuration(sUploadURLExpiry); err != nil {
+			err = errors.Wrap(err, "obs upload url expiry")
+			return
+		}
+	}
+	fs.DurationVar(&opts.UploadURLExpiry, "obs-upload-url-expiry", vUploadURLExpiry, "OBS Upload URL expiry")
+
+	var vUploadRedirect = opts.UploadRedirect
+	if sUploadRedirect := os.Getenv("OBS_UPLOAD_SUCCESS_REDIRECT"); sUploadRedirect != "" {
+		vUploadRedirect = sUploadRedirect
+	}
+	fs.StringVar(&opts.UploadRedirect, "obs-upload-success-redirect", vUploadRedirect, "OBS Upload browser POST success redirect URL, empty responds 204")
+
+	var vMultipartMaxAge = opts.MultipartMaxAge
+	if sMultipartMaxAge := os.Getenv("OBS_MULTIPART_MAX_AGE"); sMultipartMaxAge != "" {
+		if vMultipartMaxAge, err = time.ParseDuration(sMultipartMaxAge); err != nil {
+			err = errors.Wrap(err, "obs multipart max age")
+			return
+		}
+	}
+	fs.DurationVar(&opts.MultipartMaxAge, "obs-multipart-max-age", vMultipartMaxAge, "OBS Multipart uploads older than this are aborted, 0 disables")
+
+	var vMultipartCleanupInterval = opts.MultipartCleanupInterval
+	if sMultipartCleanupInterval := os.Getenv("OBS_MULTIPART_CLEANUP_INTERVAL"); sMultipartCleanupInterval != "" {
+		if vMultipartCleanupInterval, err = time.ParseDuration(sMultipartCleanupInterval); err != nil {
+			err = errors.Wrap(err, "obs multipart cleanup interval")
+			return
+		}
+	}
+	fs.DurationVar(&opts.MultipartCleanupInterval, "obs-multipart-cleanup-interval", vMultipartCleanupInterval, "OBS Multipart stale uploads cleanup interval, 0 disables")
+	return
+}
+
+// UploadPolicy returns the default upload policy.
+func (opts *obsAPIOptions) UploadPolicy() *uploadPolicy {
+	return &uploadPolicy{
+		KeyTemplate:  opts.UploadKeyTemplate,
+		MaxSize:      opts.UploadMaxSize,
+		ContentTypes: splitList(opts.UploadContentTypes),
+		Expiry:       jsonDuration(opts.UploadURLExpiry),
+
+		SuccessRedirect: opts.UploadRedirect,
+	}
+}
+
+// apiAuth checks bearer tokens, it keeps digests only so comparisons
+// take the same time whatever the token length.
+type apiAuth struct {
+	tokens [][sha256.Size]byte
+}
+
+func newAPIAuth(tokens []string) *apiAuth {
+	a := &apiAuth{}
+	for _, token := range tokens {
+		a.tokens = append(a.tokens, sha256.Sum256([]byte(token)))
+	}
+	return a
+}
+
+// Enabled reports whether any token is configured.
+func (a *apiAuth) Enabled() bool {
+	return a != nil && len(a.tokens) > 0
+}
+
+// Check checks the value of an Authorization header.
+func (a *apiAuth) Check(authorization string) bool {
+	if !a.Enabled() {
+		return false
+	}
+	scheme, token, found := strings.Cut(authorization, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	digest := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	ok := 0
+	for i := range a.tokens {
+		ok |= subtle.ConstantTimeCompare(digest[:], a.tokens[i][:])
+	}
+	return ok == 1
+}
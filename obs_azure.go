@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type obsAzureOptions struct {
+	AccountName string
+	AccountKey  string // base64 encoded shared key
+	// blob service endpoint, defaults to `https://<account>.blob.core.windows.net`
+	// ex. Azurite `http://127.0.0.1:10000/devstoreaccount1`
+	Endpoint string
+}
+
+const (
+	azureSASVersion = "2020-12-06"
+	// used as "no expiry" since service SAS requires `se`
+	azureMaxSASExpiry = "9999-12-31T23:59:59Z"
+)
+
+var defaultObsAzureOpts = obsAzureOptions{}
+
+func (opts *obsAzureOptions) Bind(fs *flag.FlagSet) (err error) {
+	var vAccountName = opts.AccountName
+	if sAccountName := os.Getenv("AZURE_STORAGE_ACCOUNT"); sAccountName != "" {
+		vAccountName = sAccountName
+	}
+	fs.StringVar(&opts.AccountName, "azure-account", vAccountName, "OBS Azure Storage account name")
+
+	var vAccountKey = opts.AccountKey
+	if sAccountKey := os.Getenv("AZURE_STORAGE_KEY"); sAccountKey != "" {
+		vAccountKey = sAccountKey
+	}
+	fs.StringVar(&opts.AccountKey, "azure-key", vAccountKey, "OBS Azure Storage account key")
+
+	var vEndpoint = opts.Endpoint
+	if sEndpoint := os.Getenv("AZURE_BLOB_ENDPOINT"); sEndpoint != "" {
+		vEndpoint = sEndpoint
+	}
+	fs.StringVar(&opts.Endpoint, "azure-endpoint", vEndpoint, "OBS Azure Blob endpoint")
+	return
+}
+
+type azureBlobClient struct {
+	accountName string
+	accountKey  []byte
+	endpoint    *url.URL
+	httpClient  *http.Client
+}
+
+func newObsAzureClient(opts obsAzureOptions) (client *azureBlobClient, err error) {
+	if opts.AccountName == "" {
+		err = errors.New("account name is required")
+		return
+	}
+	client = &azureBlobClient{
+		accountName: opts.AccountName,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+	}
+	if client.accountKey, err = base64.StdEncoding.DecodeString(opts.AccountKey); err != nil {
+		err = errors.Wrap(err, "decode account key")
+		return
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", opts.AccountName)
+	}
+	if client.endpoint, err = url.Parse(strings.TrimRight(opts.Endpoint, "/")); err != nil {
+		err = errors.Wrap(err, "parse endpoint")
+		return
+	}
+	return
+}
+
+func (c *azureBlobClient) blobURL(container, blob string) *url.URL {
+	u := *c.endpoint
+	u.Path = c.endpoint.Path + "/" + container + "/" + blob
+	u.RawPath = ""
+	return &u
+}
+
+// SAS generates a read-only service SAS query for a blob.
+//
+// Docs: https://learn.microsoft.com/en-us/rest/api/storageservices/create-service-sas
+func (c *azureBlobClient) SAS(container, blob, signedExpiry string) string {
+	stringToSign := strings.Join([]string{
+		"r", // signedPermissions
+		"",  // signedStart
+		signedExpiry,
+		"/blob/" + c.accountName + "/" + container + "/" + blob, // canonicalizedResource
+		"",              // signedIdentifier
+		"",              // signedIP
+		"",              // signedProtocol
+		azureSASVersion, // signedVersion
+		"b",             // signedResource
+		"",              // signedSnapshotTime
+		"",              // signedEncryptionScope
+		"",              // rscc
+		"",              // rscd
+		"",              // rsce
+		"",              // rscl
+		"",              // rsct
+	}, "\n")
+	mac := hmac.New(sha256.New, c.accountKey)
+	mac.Write([]byte(stringToSign))
+
+	query := url.Values{}
+	query.Set("sv", azureSASVersion)
+	query.Set("sp", "r")
+	query.Set("se", signedExpiry)
+	query.Set("sr", "b")
+	query.Set("sig", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return query.Encode()
+}
+
+// SignedURL returns the blob URL with SAS, zero expireAt means no expiry.
+func (c *azureBlobClient) SignedURL(container, blob string, expireAt time.Time) *url.URL {
+	signedExpiry := azureMaxSASExpiry
+	if !expireAt.IsZero() {
+		signedExpiry = expireAt.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	u := c.blobURL(container, blob)
+	u.RawQuery = c.SAS(container, blob, signedExpiry)
+	return u
+}
+
+// StatBlob checks the blob with `Get Blob Properties`, authorized by
+// a short-lived SAS.
+func (c *azureBlobClient) StatBlob(ctx context.Context, container, blob string) (header http.Header, err error) {
+	u := c.SignedURL(container, blob, time.Now().Add(5*time.Minute))
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil); err != nil {
+		return
+	}
+	req.Header.Set("x-ms-version", azureSASVersion)
+	var resp *http.Response
+	if resp, err = c.httpClient.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Errorf("stat blob: %s", resp.Status)
+		return
+	}
+	return resp.Header, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type obsCloudFrontOptions struct {
+	KeyPairID      string
+	PrivateKeyFile string // PEM encoded RSA private key of the key pair
+	Policy         string // `canned` or `custom`
+
+	// set signed cookies for the whole route prefix along with the redirect
+	SignedCookies bool
+	CookieDomain  string
+}
+
+const (
+	cloudFrontPolicyCanned = "canned"
+	cloudFrontPolicyCustom = "custom"
+
+	signerCloudFrontName = "cloudfront"
+)
+
+var defaultObsCloudFrontOpts = obsCloudFrontOptions{
+	Policy: cloudFrontPolicyCanned,
+}
+
+func (opts *obsCloudFrontOptions) Bind(fs *flag.FlagSet) (err error) {
+	var vKeyPairID = opts.KeyPairID
+	if sKeyPairID := os.Getenv("CLOUDFRONT_KEY_PAIR_ID"); sKeyPairID != "" {
+		vKeyPairID = sKeyPairID
+	}
+	fs.StringVar(&opts.KeyPairID, "cloudfront-key-pair-id", vKeyPairID, "OBS CloudFront Key pair ID")
+
+	var vPrivateKeyFile = opts.PrivateKeyFile
+	if sPrivateKeyFile := os.Getenv("CLOUDFRONT_PRIVATE_KEY_FILE"); sPrivateKeyFile != "" {
+		vPrivateKeyFile = sPrivateKeyFile
+	}
+	fs.StringVar(&opts.PrivateKeyFile, "cloudfront-private-key-file", vPrivateKeyFile, "OBS CloudFront Private key file")
+
+	var vPolicy = opts.Policy
+	if sPolicy := os.Getenv("CLOUDFRONT_POLICY"); sPolicy != "" {
+		vPolicy = sPolicy
+	}
+	fs.StringVar(&opts.Policy, "cloudfront-policy", vPolicy, "OBS CloudFront Signed URL policy (available [canned, custom])")
+
+	var vSignedCookies = opts.SignedCookies
+	if sSignedCookies := os.Getenv("CLOUDFRONT_SIGNED_COOKIES"); sSignedCookies != "" {
+		vSignedCookies, _ = strconv.ParseBool(sSignedCookies)
+	}
+	fs.BoolVar(&opts.SignedCookies, "cloudfront-signed-cookies", vSignedCookies, "OBS CloudFront Set signed cookies for the route prefix")
+
+	var vCookieDomain = opts.CookieDomain
+	if sCookieDomain := os.Getenv("CLOUDFRONT_COOKIE_DOMAIN"); sCookieDomain != "" {
+		vCookieDomain = sCookieDomain
+	}
+	fs.StringVar(&opts.CookieDomain, "cloudfront-cookie-domain", vCookieDomain, "OBS CloudFront Signed cookies domain")
+	return
+}
+
+type cloudFrontSigner struct {
+	opts       obsCloudFrontOptions
+	privateKey *rsa.PrivateKey
+}
+
+func newCloudFrontSigner(opts obsCloudFrontOptions) (signer *cloudFrontSigner, err error) {
+	switch opts.Policy {
+	case "":
+		opts.Policy = cloudFrontPolicyCanned
+	case cloudFrontPolicyCanned, cloudFrontPolicyCustom:
+	default:
+		err = errors.Errorf("unknown policy %q", opts.Policy)
+		return
+	}
+	signer = &cloudFrontSigner{opts: opts}
+	var b []byte
+	if b, err = os.ReadFile(opts.PrivateKeyFile); err != nil {
+		err = errors.Wrap(err, "read private key file")
+		return
+	}
+	if signer.privateKey, err = parseRSAPrivateKey(b); err != nil {
+		err = errors.Wrap(err, "private key")
+		return
+	}
+	return
+}
+
+type cloudFrontPolicy struct {
+	Statement []cloudFrontStatement `json:"Statement"`
+}
+
+type cloudFrontStatement struct {
+	Resource  string `json:"Resource"`
+	Condition struct {
+		DateLessThan struct {
+			EpochTime int64 `json:"AWS:EpochTime"`
+		} `json:"DateLessThan"`
+	} `json:"Condition"`
+}
+
+func newCloudFrontPolicy(resource string, expires int64) []byte {
+	var st cloudFrontStatement
+	st.Resource = resource
+	st.Condition.DateLessThan.EpochTime = expires
+	// canned policy is reconstructed by CloudFront, keep `&` in the
+	// resource URL unescaped and no trailing newline.
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(cloudFrontPolicy{Statement: []cloudFrontStatement{st}})
+	return bytes.TrimRight(b.Bytes(), "\n")
+}
+
+// cloudFrontEncode is base64 with CloudFront URL-safe replacements.
+func cloudFrontEncode(b []byte) string {
+	return strings.NewReplacer("+", "-", "=", "_", "/", "~").
+		Replace(base64.StdEncoding.EncodeToString(b))
+}
+
+func (s *cloudFrontSigner) sign(policy []byte) (string, error) {
+	digest := sha1.Sum(policy)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.privateKey, crypto.SHA1, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return cloudFrontEncode(sig), nil
+}
+
+// SignedURL signs resource URL that expires at UNIX time expires.
+//
+// Docs: https://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/private-content-signed-urls.html
+func (s *cloudFrontSigner) SignedURL(resource *url.URL, expires int64) (_ *url.URL, err error) {
+	policy := newCloudFrontPolicy(resource.String(), expires)
+	var sig string
+	if sig, err = s.sign(policy); err != nil {
+		err = errors.Wrap(err, "sign policy")
+		return
+	}
+	u := *resource
+	query := u.Query()
+	if s.opts.Policy == cloudFrontPolicyCustom {
+		query.Set("Policy", cloudFrontEncode(policy))
+	} else {
+		query.Set("Expires", strconv.FormatInt(expires, 10))
+	}
+	query.Set("Signature", sig)
+	query.Set("Key-Pair-Id", s.opts.KeyPairID)
+	u.RawQuery = query.Encode()
+	return &u, nil
+}
+
+// SignedCookies signs custom policy cookies for resources matching
+// the resource pattern, ex. `https://cdn.example.com/images/*`.
+//
+// Docs: https://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/private-content-setting-signed-cookie-custom-policy.html
+func (s *cloudFrontSigner) SignedCookies(resourcePattern string, expires int64) (cookies map[string]string, err error) {
+	policy := newCloudFrontPolicy(resourcePattern, expires)
+	var sig string
+	if sig, err = s.sign(policy); err != nil {
+		err = errors.Wrap(err, "sign policy")
+		return
+	}
+	return map[string]string{
+		"CloudFront-Policy":      cloudFrontEncode(policy),
+		"CloudFront-Signature":   sig,
+		"CloudFront-Key-Pair-Id": s.opts.KeyPairID,
+	}, nil
+}
+
+// signerCloudFront signs CDN URLs at the host redirect, the CDN
+// domain, optionally with signed cookies for the whole route prefix.
+type signerCloudFront struct {
+	opts   obsOptions
+	cfopts obsCloudFrontOptions
+	cfs    *cloudFrontSigner
+}
+
+func (s *signerCloudFront) Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error) {
+	s.opts = opts.GetOpts()
+	s.cfopts = opts.GetCloudFrontOpts()
+	if s.opts.HostRedirect == "" {
+		err = errors.New("cloudfront signer requires host redirect as the CDN domain")
+		return
+	}
+	// CloudFront policies need a real epoch time
+	if s.opts.URLExpiry == maxURLExpiry || s.opts.URLExpiry <= 0 {
+		err = errors.New("cloudfront signer requires a finite url expiry")
+		return
+	}
+	if s.cfs, err = newCloudFrontSigner(s.cfopts); err != nil {
+		err = errors.Wrap(err, "cloudfront signer")
+		return
+	}
+	return
+}
+
+func (s *signerCloudFront) Name() string {
+	return signerCloudFrontName
+}
+
+func (s *signerCloudFront) SignURL(ctx context.Context, sreq signRequest) (_ *signedURL, err error) {
+	expires, expireAt := sreq.expires(time.Now())
+	if expireAt.IsZero() {
+		err = errors.New("cloudfront url needs an expiry")
+		return
+	}
+
+	resource := &url.URL{
+		Scheme: "http",
+		Host:   s.opts.HostRedirect,
+		Path:   "/" + sreq.Key,
+	}
+	if s.opts.RedirectSecure {
+		resource.Scheme = "https"
+	}
+	res := &signedURL{ExpireAt: expireAt}
+	var u *url.URL
+	if u, err = s.cfs.SignedURL(resource, expires); err != nil {
+		return
+	}
+	res.URL = u.String()
+
+	if s.cfopts.SignedCookies {
+		// grant the whole route prefix
+		pattern := resource.Scheme + "://" + resource.Host + "/" + sreq.RoutePrefix + "*"
+		var cookies map[string]string
+		if cookies, err = s.cfs.SignedCookies(pattern, expires); err != nil {
+			return
+		}
+		for name, value := range cookies {
+			res.Cookies = append(res.Cookies, &http.Cookie{
+				Name:     name,
+				Value:    value,
+				Path:     "/" + sreq.RoutePrefix,
+				Domain:   s.cfopts.CookieDomain,
+				Expires:  expireAt,
+				HttpOnly: true,
+				Secure:   s.opts.RedirectSecure,
+			})
+		}
+	}
+	return res, nil
+}
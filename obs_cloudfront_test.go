@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func cloudFrontDecode(t *testing.T, s string) []byte {
+	b, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(s))
+	require.NoError(t, err)
+	return b
+}
+
+func newTestRSAKeyFile(t *testing.T) (string, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "pk.pem")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0o600))
+	return keyFile, key
+}
+
+func TestCloudFrontSigner(t *testing.T) {
+	keyFile, key := newTestRSAKeyFile(t)
+
+	resource := &url.URL{Scheme: "https", Host: "d111111abcdef8.cloudfront.net", Path: "/images/a.jpg", RawQuery: "w=1&h=2"}
+
+	// canned
+	signer, err := newCloudFrontSigner(obsCloudFrontOptions{KeyPairID: "K2JCJMDEHXQW5F", PrivateKeyFile: keyFile})
+	require.NoError(t, err)
+	u, err := signer.SignedURL(resource, 1357034400)
+	require.NoError(t, err)
+	q := u.Query()
+	require.Equal(t, "1357034400", q.Get("Expires"))
+	require.Equal(t, "K2JCJMDEHXQW5F", q.Get("Key-Pair-Id"))
+	require.Empty(t, q.Get("Policy"))
+	policy := `{"Statement":[{"Resource":"https://d111111abcdef8.cloudfront.net/images/a.jpg?w=1&h=2","Condition":{"DateLessThan":{"AWS:EpochTime":1357034400}}}]}`
+	digest := sha1.Sum([]byte(policy))
+	require.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, digest[:], cloudFrontDecode(t, q.Get("Signature"))))
+
+	// custom
+	signer, err = newCloudFrontSigner(obsCloudFrontOptions{KeyPairID: "K2JCJMDEHXQW5F", PrivateKeyFile: keyFile, Policy: cloudFrontPolicyCustom})
+	require.NoError(t, err)
+	u, err = signer.SignedURL(resource, 1357034400)
+	require.NoError(t, err)
+	require.Equal(t, policy, string(cloudFrontDecode(t, u.Query().Get("Policy"))))
+	require.Empty(t, u.Query().Get("Expires"))
+
+	// cookies
+	cookies, err := signer.SignedCookies("https://d111111abcdef8.cloudfront.net/images/*", 1357034400)
+	require.NoError(t, err)
+	require.Contains(t, string(cloudFrontDecode(t, cookies["CloudFront-Policy"])), `"Resource":"https://d111111abcdef8.cloudfront.net/images/*"`)
+	require.Equal(t, "K2JCJMDEHXQW5F", cookies["CloudFront-Key-Pair-Id"])
+
+	_, err = newCloudFrontSigner(obsCloudFrontOptions{PrivateKeyFile: keyFile, Policy: "other"})
+	require.Error(t, err)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type obsFSOptions struct {
+	Root   string // local directory served as the bucket
+	Secret string // HMAC secret for self-served URLs
+}
+
+// self-served object URL prefix
+const fsObjectPrefix = "/_obj/"
+
+var defaultObsFSOpts = obsFSOptions{}
+
+func (opts *obsFSOptions) Bind(fs *flag.FlagSet) (err error) {
+	var vRoot = opts.Root
+	if sRoot := os.Getenv("FS_ROOT"); sRoot != "" {
+		vRoot = sRoot
+	}
+	fs.StringVar(&opts.Root, "fs-root", vRoot, "OBS Local filesystem root directory")
+
+	var vSecret = opts.Secret
+	if sSecret := os.Getenv("FS_SECRET"); sSecret != "" {
+		vSecret = sSecret
+	}
+	fs.StringVar(&opts.Secret, "fs-secret", vSecret, "OBS Local filesystem URL signing secret")
+	return
+}
+
+type fsClient struct {
+	root   string
+	secret []byte
+}
+
+func newObsFSClient(opts obsFSOptions) (client *fsClient, err error) {
+	client = &fsClient{}
+	if client.root, err = filepath.Abs(opts.Root); err != nil {
+		err = errors.Wrap(err, "root")
+		return
+	}
+	var fi os.FileInfo
+	if fi, err = os.Stat(client.root); err != nil {
+		err = errors.Wrap(err, "root")
+		return
+	} else if !fi.IsDir() {
+		err = errors.Errorf("root %q is not a directory", client.root)
+		return
+	}
+
+	client.secret = []byte(opts.Secret)
+	if len(client.secret) == 0 {
+		// signed URLs won't survive restart
+		client.secret = make([]byte, 32)
+		if _, err = rand.Read(client.secret); err != nil {
+			err = errors.Wrap(err, "generate secret")
+			return
+		}
+	}
+	return
+}
+
+// filePath maps object key into path under root, key must be normalized.
+func (c *fsClient) filePath(key string) string {
+	return filepath.Join(c.root, filepath.FromSlash(key))
+}
+
+// StatObject stats regular file of the object key.
+func (c *fsClient) StatObject(key string) (fi os.FileInfo, err error) {
+	if fi, err = os.Stat(c.filePath(key)); err != nil {
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		err = errors.Errorf("%q is not a regular file", key)
+		return
+	}
+	return
+}
+
+func (c *fsClient) signature(key string, expires int64, overrides url.Values) string {
+	mac := hmac.New(sha256.New, c.secret)
+	fmt.Fprintf(mac, "GET\n%d\n%s", expires, key)
+	if len(overrides) > 0 {
+		// sorted by key
+		fmt.Fprintf(mac, "\n%s", overrides.Encode())
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignedURL returns path and query of the self-served object URL
+// that expires at UNIX time expires, overrides are signed `response-*`
+// header overrides.
+func (c *fsClient) SignedURL(key string, expires int64, overrides url.Values) *url.URL {
+	query := url.Values{}
+	for k, v := range overrides {
+		query[k] = v
+	}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", c.signature(key, expires, overrides))
+	return &url.URL{
+		Path:     fsObjectPrefix + key,
+		RawQuery: query.Encode(),
+	}
+}
+
+var (
+	errFSInvalidSignature = errors.New("invalid signature")
+	errFSURLExpired       = errors.New("url expired")
+)
+
+// Verify checks signature and expiry of the self-served object URL.
+func (c *fsClient) Verify(key, expires, signature string, overrides url.Values, now time.Time) error {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return errFSInvalidSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(c.signature(key, exp, overrides))) {
+		return errFSInvalidSignature
+	}
+	if now.Unix() > exp {
+		return errFSURLExpired
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type obsGCSOptions struct {
+	CredentialsFile string // service account JSON key file
+	Endpoint        string // JSON API and signed URL base
+}
+
+// GCS V4 signed URL lifetime limit
+const maxGCSURLExpiry = 7 * 24 * time.Hour
+
+var defaultObsGCSOpts = obsGCSOptions{
+	Endpoint: "https://storage.googleapis.com",
+}
+
+func (opts *obsGCSOptions) Bind(fs *flag.FlagSet) (err error) {
+	var vCredentialsFile = opts.CredentialsFile
+	if sCredentialsFile := os.Getenv("GCS_CREDENTIALS_FILE"); sCredentialsFile != "" {
+		vCredentialsFile = sCredentialsFile
+	} else if sCredentialsFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); sCredentialsFile != "" {
+		vCredentialsFile = sCredentialsFile
+	}
+	fs.StringVar(&opts.CredentialsFile, "gcs-credentials-file", vCredentialsFile, "OBS GCS Service account JSON key file")
+
+	var vEndpoint = opts.Endpoint
+	if sEndpoint := os.Getenv("GCS_ENDPOINT"); sEndpoint != "" {
+		vEndpoint = sEndpoint
+	}
+	fs.StringVar(&opts.Endpoint, "gcs-endpoint", vEndpoint, "OBS GCS Endpoint")
+	return
+}
+
+// gcsServiceAccount is the subset of service account JSON key we use.
+type gcsServiceAccount struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+type gcsClient struct {
+	endpoint   *url.URL
+	httpClient *http.Client
+
+	clientEmail  string
+	privateKeyID string
+	privateKey   *rsa.PrivateKey
+	tokenURI     string
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+type gcsObjectAttrs struct {
+	Name        string `json:"name"`
+	Bucket      string `json:"bucket"`
+	Size        string `json:"size"`
+	ContentType string `json:"contentType"`
+	ETag        string `json:"etag"`
+	Generation  string `json:"generation"`
+	Updated     string `json:"updated"`
+}
+
+func (attrs *gcsObjectAttrs) objectInfo() *objectInfo {
+	info := &objectInfo{
+		Key:         attrs.Name,
+		ContentType: attrs.ContentType,
+		ETag:        attrs.ETag,
+	}
+	info.Size, _ = strconv.ParseInt(attrs.Size, 10, 64)
+	info.LastModified, _ = time.Parse(time.RFC3339, attrs.Updated)
+	return info
+}
+
+func newObsGCSClient(opts obsGCSOptions) (client *gcsClient, err error) {
+	if opts.Endpoint == "" {
+		opts.Endpoint = defaultObsGCSOpts.Endpoint
+	}
+	client = &gcsClient{
+		// bounds token requests too, those hold mu
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+	if client.endpoint, err = url.Parse(opts.Endpoint); err != nil {
+		err = errors.Wrap(err, "parse endpoint")
+		return
+	}
+
+	var b []byte
+	if b, err = os.ReadFile(opts.CredentialsFile); err != nil {
+		err = errors.Wrap(err, "read credentials file")
+		return
+	}
+	var sa gcsServiceAccount
+	if err = json.Unmarshal(b, &sa); err != nil {
+		err = errors.Wrap(err, "parse credentials file")
+		return
+	}
+	if client.privateKey, err = parseRSAPrivateKey([]byte(sa.PrivateKey)); err != nil {
+		err = errors.Wrap(err, "service account private key")
+		return
+	}
+	client.clientEmail = sa.ClientEmail
+	client.privateKeyID = sa.PrivateKeyID
+	client.tokenURI = sa.TokenURI
+	return
+}
+
+// accessToken exchanges a self-signed JWT for an OAuth2 access token,
+// the token is cached until it's about to expire.
+func (c *gcsClient) accessToken(ctx context.Context) (_ string, err error) {
+	if c.tokenURI == "" {
+		// unauthenticated, ex. local emulator
+		return "", nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Add(time.Minute).Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": c.privateKeyID,
+	})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   c.clientEmail,
+		"scope": "https://www.googleapis.com/auth/devstorage.read_only",
+		"aud":   c.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	var sig []byte
+	if sig, err = rsa.SignPKCS1v15(rand.Reader, c.privateKey, crypto.SHA256, digest[:]); err != nil {
+		err = errors.Wrap(err, "sign jwt")
+		return
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", unsigned+"."+base64.RawURLEncoding.EncodeToString(sig))
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURI, strings.NewReader(form.Encode())); err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var resp *http.Response
+	if resp, err = c.httpClient.Do(req); err != nil {
+		err = errors.Wrap(err, "token request")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = errors.Errorf("token request: %s: %s", resp.Status, body)
+		return
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		err = errors.Wrap(err, "token response")
+		return
+	}
+	c.token = token.AccessToken
+	c.tokenExpiry = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+// StatObject fetches object metadata through the JSON API.
+func (c *gcsClient) StatObject(ctx context.Context, bucket, object string) (attrs *gcsObjectAttrs, err error) {
+	// object name is a single path segment, `/` must be escaped too.
+	statURL := strings.TrimRight(c.endpoint.String(), "/") +
+		"/storage/v1/b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(object)
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, statURL, nil); err != nil {
+		return
+	}
+	var token string
+	if token, err = c.accessToken(ctx); err != nil {
+		return
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	var resp *http.Response
+	if resp, err = c.httpClient.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Errorf("stat object: %s", resp.Status)
+		return
+	}
+	attrs = &gcsObjectAttrs{}
+	if err = json.NewDecoder(resp.Body).Decode(attrs); err != nil {
+		err = errors.Wrap(err, "stat object response")
+		return
+	}
+	return
+}
+
+// SignedURL generates a GOOG4-RSA-SHA256 signed URL using path style
+// addressing, host is the host the signed URL is served at.
+//
+// Docs: https://cloud.google.com/storage/docs/access-control/signed-urls#signing-process
+func (c *gcsClient) SignedURL(method, scheme, host, bucket, object string, expiry time.Duration, now time.Time) (_ string, err error) {
+	if expiry <= 0 || expiry > maxGCSURLExpiry {
+		err = errors.Errorf("expiry must be within (0, %s]", maxGCSURLExpiry)
+		return
+	}
+	now = now.UTC()
+	datestamp := now.Format("20060102")
+	timestamp := now.Format("20060102T150405Z")
+	credentialScope := datestamp + "/auto/storage/goog4_request"
+
+	canonicalURI := "/" + gcsEscapePath(bucket) + "/" + gcsEscapePath(object)
+	query := map[string]string{
+		"X-Goog-Algorithm":     "GOOG4-RSA-SHA256",
+		"X-Goog-Credential":    c.clientEmail + "/" + credentialScope,
+		"X-Goog-Date":          timestamp,
+		"X-Goog-Expires":       strconv.FormatInt(int64(expiry/time.Second), 10),
+		"X-Goog-SignedHeaders": "host",
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var canonicalQuery strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			canonicalQuery.WriteByte('&')
+		}
+		canonicalQuery.WriteString(gcsEscape(k) + "=" + gcsEscape(query[k]))
+	}
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalURI,
+		canonicalQuery.String(),
+		"host:" + host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"GOOG4-RSA-SHA256",
+		timestamp,
+		credentialScope,
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+	digest := sha256.Sum256([]byte(stringToSign))
+	var sig []byte
+	if sig, err = rsa.SignPKCS1v15(rand.Reader, c.privateKey, crypto.SHA256, digest[:]); err != nil {
+		err = errors.Wrap(err, "sign")
+		return
+	}
+	return fmt.Sprintf("%s://%s%s?%s&X-Goog-Signature=%s",
+		scheme, host, canonicalURI, canonicalQuery.String(), hex.EncodeToString(sig)), nil
+}
+
+// gcsEscape percent-encodes everything except RFC 3986 unreserved characters.
+func gcsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func gcsEscapePath(s string) string {
+	segments := strings.Split(s, "/")
+	for i, segment := range segments {
+		segments[i] = gcsEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
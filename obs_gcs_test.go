@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestGCSKeyFile(t *testing.T, tokenURI string) (string, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	b, err := json.Marshal(gcsServiceAccount{
+		ClientEmail:  "signer@project.iam.gserviceaccount.com",
+		PrivateKeyID: "kid",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:     tokenURI,
+	})
+	require.NoError(t, err)
+	fp := filepath.Join(t.TempDir(), "key.json")
+	require.NoError(t, os.WriteFile(fp, b, 0o600))
+	return fp, key
+}
+
+func TestGCSStatObject(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		require.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.PostForm.Get("grant_type"))
+		w.Write([]byte(`{"access_token":"tok","expires_in":3600}`))
+	})
+	mux.HandleFunc("/storage/v1/b/", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer tok", r.Header.Get("Authorization"))
+		if r.URL.EscapedPath() != "/storage/v1/b/bucket/o/a%2Fb.jpg" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"name":"a/b.jpg","bucket":"bucket","size":"3"}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	keyFile, _ := newTestGCSKeyFile(t, srv.URL+"/token")
+	client, err := newObsGCSClient(obsGCSOptions{
+		CredentialsFile: keyFile,
+		Endpoint:        srv.URL,
+	})
+	require.NoError(t, err)
+
+	attrs, err := client.StatObject(context.Background(), "bucket", "a/b.jpg")
+	require.NoError(t, err)
+	require.Equal(t, "a/b.jpg", attrs.Name)
+
+	_, err = client.StatObject(context.Background(), "bucket", "missing")
+	require.Error(t, err)
+}
+
+func TestGCSSignedURL(t *testing.T) {
+	keyFile, key := newTestGCSKeyFile(t, "")
+	client, err := newObsGCSClient(obsGCSOptions{CredentialsFile: keyFile})
+	require.NoError(t, err)
+
+	now := time.Date(2019, 2, 1, 9, 0, 0, 0, time.UTC)
+	signedURL, err := client.SignedURL(http.MethodGet, "https", "storage.googleapis.com", "bucket", "a b/c.jpg", time.Hour, now)
+	require.NoError(t, err)
+
+	u, err := url.Parse(signedURL)
+	require.NoError(t, err)
+	require.Equal(t, "/bucket/a%20b/c.jpg", u.EscapedPath())
+	q := u.Query()
+	require.Equal(t, "GOOG4-RSA-SHA256", q.Get("X-Goog-Algorithm"))
+	require.Equal(t, "signer@project.iam.gserviceaccount.com/20190201/auto/storage/goog4_request", q.Get("X-Goog-Credential"))
+	require.Equal(t, "20190201T090000Z", q.Get("X-Goog-Date"))
+	require.Equal(t, "3600", q.Get("X-Goog-Expires"))
+
+	// verify signature against the canonical request
+	rawQuery, sigHex, found := strings.Cut(u.RawQuery, "&X-Goog-Signature=")
+	require.True(t, found)
+	canonicalRequest := "GET\n/bucket/a%20b/c.jpg\n" + rawQuery + "\nhost:storage.googleapis.com\n\nhost\nUNSIGNED-PAYLOAD"
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "GOOG4-RSA-SHA256\n20190201T090000Z\n20190201/auto/storage/goog4_request\n" + hex.EncodeToString(hashedRequest[:])
+	digest := sha256.Sum256([]byte(stringToSign))
+	sig, err := hex.DecodeString(sigHex)
+	require.NoError(t, err)
+	require.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig))
+
+	_, err = client.SignedURL(http.MethodGet, "https", "storage.googleapis.com", "bucket", "a", 8*24*time.Hour, now)
+	require.Error(t, err)
+}
@@ -1,33 +1,54 @@
 package main
 
 import (
-	"context"
 	"flag"
-	"io"
-	"net/http"
-	"net/url"
 	"os"
-	"reflect"
 	"strconv"
 	"time"
-	"unsafe"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/pkg/errors"
-
-	_ "unsafe"
 )
 
 type obsS3Options struct {
-	Endpoint string
-	Region   string
-	Secure   bool // S3 secure
+	Endpoint     string
+	Region       string
+	Secure       bool   // S3 secure
+	BucketLookup string // auto, dns (vhost) or path
+
+	// credentials
+	Credentials          string // provider chain, see defaultS3CredsChain
+	AccessKey            string // static
+	SecretKey            string
+	SessionToken         string
+	CredentialsFile      string // shared credentials file, ~/.aws/credentials if empty
+	Profile              string
+	WebIdentityTokenFile string
+	RoleARN              string // web identity role
+	RoleSessionName      string
+	MetadataURL          string // EC2 instance metadata
+	AssumeRoleARN        string // assumed with the chain credentials if set
+	AssumeRoleDuration   time.Duration
+	STSEndpoint          string
+
+	// named credential sets for routes
+	CredentialSetsFile   string
+	CredentialSetsReload time.Duration // file poll interval, 0 disables reload
 }
 
 const maxURLExpiry = time.Duration(int64(^uint64(0) / 2))
 
-var defaultObsS3Opts = obsS3Options{}
+var defaultObsS3Opts = obsS3Options{
+	BucketLookup:       s3BucketLookupAuto,
+	Credentials:        defaultS3CredsChain,
+	Profile:            "default",
+	MetadataURL:        "http://169.254.169.254",
+	AssumeRoleDuration: time.Hour,
+	STSEndpoint:        "https://sts.amazonaws.com",
+
+	CredentialSetsReload: 30 * time.Second,
+}
 
 func (opts *obsS3Options) Bind(fs *flag.FlagSet) (err error) {
 	fs.StringVar(&opts.Endpoint, "obs-endpoint", os.Getenv("OBS_ENDPOINT"), "OBS S3 Host")
@@ -44,81 +65,91 @@ func (opts *obsS3Options) Bind(fs *flag.FlagSet) (err error) {
 	}
 	fs.BoolVar(&opts.Secure, "obs-secure", vObsSecure, "OBS S3 secure transport")
 
-	return
-}
+	var vBucketLookup = opts.BucketLookup
+	if sBucketLookup := os.Getenv("OBS_BUCKET_LOOKUP"); sBucketLookup != "" {
+		vBucketLookup = sBucketLookup
+	}
+	fs.StringVar(&opts.BucketLookup, "obs-bucket-lookup", vBucketLookup, "OBS S3 bucket lookup style: auto, dns or path")
 
-func newObsS3Client(opts obsS3Options) (*minio.Client, error) {
-	client, err := minio.New(opts.Endpoint, &minio.Options{
-		Creds:        credentials.NewEnvAWS(),
-		BucketLookup: minio.BucketLookupAuto, // vhost / path
-		Region:       opts.Region,
-		Secure:       opts.Secure,
-	})
-	if err != nil {
-		return nil, err
+	var vCredentials = opts.Credentials
+	if sCredentials := os.Getenv("OBS_S3_CREDENTIALS"); sCredentials != "" {
+		vCredentials = sCredentials
 	}
-	setOverrideSignerType(client, credentials.SignatureV2)
-	return client, nil
-}
+	fs.StringVar(&opts.Credentials, "obs-s3-credentials", vCredentials, "OBS S3 credential providers in order: static, env, file, web-identity, metadata")
 
-var (
-	offsetCredsProvider      uintptr
-	offsetOverrideSignerType uintptr
-)
+	fs.StringVar(&opts.AccessKey, "obs-s3-access-key", os.Getenv("OBS_S3_ACCESS_KEY"), "OBS S3 static access key")
+	fs.StringVar(&opts.SecretKey, "obs-s3-secret-key", os.Getenv("OBS_S3_SECRET_KEY"), "OBS S3 static secret key")
+	fs.StringVar(&opts.SessionToken, "obs-s3-session-token", os.Getenv("OBS_S3_SESSION_TOKEN"), "OBS S3 static session token")
 
-func init() {
-	vt := reflect.TypeOf(minio.Client{})
-	if field, ok := vt.FieldByName("credsProvider"); ok {
-		offsetCredsProvider = field.Offset
-	} else {
-		panic("cannot find credsProvider field")
+	var vCredentialsFile = opts.CredentialsFile
+	if sCredentialsFile := os.Getenv("OBS_S3_CREDENTIALS_FILE"); sCredentialsFile != "" {
+		vCredentialsFile = sCredentialsFile
+	} else if sCredentialsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); sCredentialsFile != "" {
+		vCredentialsFile = sCredentialsFile
 	}
+	fs.StringVar(&opts.CredentialsFile, "obs-s3-credentials-file", vCredentialsFile, "OBS S3 shared credentials file")
 
-	if field, ok := vt.FieldByName("overrideSignerType"); ok {
-		offsetOverrideSignerType = field.Offset
-	} else {
-		panic("cannot find overrideSignerType field")
+	var vProfile = opts.Profile
+	if sProfile := os.Getenv("OBS_S3_PROFILE"); sProfile != "" {
+		vProfile = sProfile
+	} else if sProfile := os.Getenv("AWS_PROFILE"); sProfile != "" {
+		vProfile = sProfile
 	}
-}
+	fs.StringVar(&opts.Profile, "obs-s3-profile", vProfile, "OBS S3 shared credentials file profile")
 
-func getCredsProvider(client *minio.Client) *credentials.Credentials {
-	return *(**credentials.Credentials)(unsafe.Add(unsafe.Pointer(client), offsetCredsProvider))
-}
+	fs.StringVar(&opts.WebIdentityTokenFile, "obs-s3-web-identity-token-file", os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), "OBS S3 web identity token file")
+	fs.StringVar(&opts.RoleARN, "obs-s3-role-arn", os.Getenv("AWS_ROLE_ARN"), "OBS S3 web identity role ARN")
+	fs.StringVar(&opts.RoleSessionName, "obs-s3-role-session-name", os.Getenv("AWS_ROLE_SESSION_NAME"), "OBS S3 STS role session name")
 
-func setOverrideSignerType(client *minio.Client, signerType credentials.SignatureType) {
-	ptr := (*credentials.SignatureType)(unsafe.Add(unsafe.Pointer(client), offsetOverrideSignerType))
-	*ptr = signerType
-}
+	var vMetadataURL = opts.MetadataURL
+	if sMetadataURL := os.Getenv("OBS_S3_METADATA_URL"); sMetadataURL != "" {
+		vMetadataURL = sMetadataURL
+	}
+	fs.StringVar(&opts.MetadataURL, "obs-s3-metadata-url", vMetadataURL, "OBS S3 EC2 instance metadata URL")
 
-//go:linkname isVirtualHostStyleRequest github.com/minio/minio-go/v7.(*Client).isVirtualHostStyleRequest
-func isVirtualHostStyleRequest(client *minio.Client, url url.URL, bucketName string) bool
-
-//go:linkname makeTargetURL github.com/minio/minio-go/v7.(*Client).makeTargetURL
-func makeTargetURL(client *minio.Client, bucketName, objectName, bucketLocation string, isVirtualHostStyle bool, queryValues url.Values) (*url.URL, error)
-
-// requestMetadata - is container for all the values to make a request.
-type requestMetadata struct {
-	// If set newRequest presigns the URL.
-	presignURL bool
-
-	// User supplied.
-	bucketName         string
-	objectName         string
-	queryValues        url.Values
-	customHeader       http.Header
-	extraPresignHeader http.Header
-	expires            int64
-
-	// Generated by our internal code.
-	bucketLocation   string
-	contentBody      io.Reader
-	contentLength    int64
-	contentMD5Base64 string // carries base64 encoded md5sum
-	contentSHA256Hex string // carries hex encoded sha256sum
-	streamSha256     bool
-	addCrc           bool
-	trailer          http.Header // (http.Request).Trailer. Requires v4 signature.
+	fs.StringVar(&opts.AssumeRoleARN, "obs-s3-assume-role-arn", os.Getenv("OBS_S3_ASSUME_ROLE_ARN"), "OBS S3 role to assume with the chain credentials")
+
+	var vAssumeRoleDuration = opts.AssumeRoleDuration
+	if sAssumeRoleDuration := os.Getenv("OBS_S3_ASSUME_ROLE_DURATION"); sAssumeRoleDuration != "" {
+		if vAssumeRoleDuration, err = time.ParseDuration(sAssumeRoleDuration); err != nil {
+			err = errors.Wrap(err, "obs s3 assume role duration")
+			return
+		}
+	}
+	fs.DurationVar(&opts.AssumeRoleDuration, "obs-s3-assume-role-duration", vAssumeRoleDuration, "OBS S3 assumed role session duration")
+
+	var vSTSEndpoint = opts.STSEndpoint
+	if sSTSEndpoint := os.Getenv("OBS_S3_STS_ENDPOINT"); sSTSEndpoint != "" {
+		vSTSEndpoint = sSTSEndpoint
+	}
+	fs.StringVar(&opts.STSEndpoint, "obs-s3-sts-endpoint", vSTSEndpoint, "OBS S3 STS endpoint")
+
+	fs.StringVar(&opts.CredentialSetsFile, "obs-s3-credential-sets-file", os.Getenv("OBS_S3_CREDENTIAL_SETS_FILE"), "OBS S3 named credential sets JSON file")
+
+	var vCredentialSetsReload = opts.CredentialSetsReload
+	if sCredentialSetsReload := os.Getenv("OBS_S3_CREDENTIAL_SETS_RELOAD"); sCredentialSetsReload != "" {
+		if vCredentialSetsReload, err = time.ParseDuration(sCredentialSetsReload); err != nil {
+			err = errors.Wrap(err, "obs s3 credential sets reload")
+			return
+		}
+	}
+	fs.DurationVar(&opts.CredentialSetsReload, "obs-s3-credential-sets-reload", vCredentialSetsReload, "OBS S3 credential sets file reload interval, 0 disables")
+
+	return
 }
 
-//go:linkname newRequest github.com/minio/minio-go/v7.(*Client).newRequest
-func newRequest(client *minio.Client, ctx context.Context, method string, metadata requestMetadata) (req *http.Request, err error)
+func newObsS3Client(opts obsS3Options, creds s3CredsSource) (*minio.Client, error) {
+	lookup := minio.BucketLookupAuto
+	switch opts.BucketLookup {
+	case s3BucketLookupDNS:
+		lookup = minio.BucketLookupDNS
+	case s3BucketLookupPath:
+		lookup = minio.BucketLookupPath
+	}
+	return minio.New(opts.Endpoint, &minio.Options{
+		Creds:        credentials.New(&s3MinioProvider{creds: creds}),
+		BucketLookup: lookup,
+		Region:       opts.Region,
+		Secure:       opts.Secure,
+	})
+}
@@ -4,8 +4,13 @@ import (
 	"context"
 	"flag"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 	"storj.io/uplink"
 	"storj.io/uplink/edge"
 )
@@ -19,6 +24,21 @@ type obsStorjOptions struct {
 
 	AccessKeyID  string
 	ShareBaseURL string
+
+	ShareBucket   string        // bucket registered shares are narrowed to, empty uses the served bucket
+	SharePrefixes string        // comma separated key prefixes of the bucket, empty is the whole bucket
+	ShareTTL      time.Duration // lifetime of registered shares, renewed at half of it, 0 never expires
+
+	StateFile string // registered credentials persisted across restarts, empty disables
+	StateKey  string // state file encryption key
+
+	AuthServiceAddress  string
+	AuthServiceCertFile string // PEM root certificates of the auth service, empty uses the system ones
+	AuthServiceInsecure bool   // connect without TLS, for tests only
+
+	Proxy            bool  // stream objects through uplink instead of redirecting to linkshare URLs
+	ProxyParallelism int   // chunks of a proxied download fetched at once
+	ProxyChunkSize   int64 // bytes of a proxied download chunk
 }
 
 var defaultObsUplinkOpts = obsStorjOptions{
@@ -26,6 +46,12 @@ var defaultObsUplinkOpts = obsStorjOptions{
 	// ex. "ap1.storj.io:7777"
 	SatelliteAddress: "",
 	ShareBaseURL:     "https://link.storjshare.io",
+	ShareTTL:         24 * time.Hour,
+
+	ProxyParallelism: 1,
+	ProxyChunkSize:   16 << 20,
+
+	AuthServiceAddress: defaultEdgeConfig.AuthServiceAddress,
 }
 
 func (opts *obsStorjOptions) Bind(fs *flag.FlagSet) (err error) {
@@ -67,6 +93,83 @@ func (opts *obsStorjOptions) Bind(fs *flag.FlagSet) (err error) {
 	}
 	fs.StringVar(&opts.ShareBaseURL, "uplink-share-base-url", vShareBaseURL, "OBS Storj Link Share base URL")
 
+	var vShareBucket = opts.ShareBucket
+	if sShareBucket := os.Getenv("UPLINK_SHARE_BUCKET"); sShareBucket != "" {
+		vShareBucket = sShareBucket
+	}
+	fs.StringVar(&opts.ShareBucket, "uplink-share-bucket", vShareBucket, "OBS Storj Bucket registered shares are restricted to, empty uses the served bucket")
+
+	var vSharePrefixes = opts.SharePrefixes
+	if sSharePrefixes := os.Getenv("UPLINK_SHARE_PREFIXES"); sSharePrefixes != "" {
+		vSharePrefixes = sSharePrefixes
+	}
+	fs.StringVar(&opts.SharePrefixes, "uplink-share-prefixes", vSharePrefixes, "OBS Storj Key prefixes registered shares are restricted to, comma separated, empty is the whole bucket")
+
+	var vShareTTL = opts.ShareTTL
+	if sShareTTL := os.Getenv("UPLINK_SHARE_TTL"); sShareTTL != "" {
+		if vShareTTL, err = time.ParseDuration(sShareTTL); err != nil {
+			err = errors.Wrap(err, "parse UPLINK_SHARE_TTL")
+			return
+		}
+	}
+	fs.DurationVar(&opts.ShareTTL, "uplink-share-ttl", vShareTTL, "OBS Storj Lifetime of registered shares, renewed at half of it, 0 never expires")
+
+	var vStateFile = opts.StateFile
+	if sStateFile := os.Getenv("UPLINK_STATE_FILE"); sStateFile != "" {
+		vStateFile = sStateFile
+	}
+	fs.StringVar(&opts.StateFile, "uplink-state-file", vStateFile, "OBS Storj File persisting registered credentials across restarts, empty disables")
+
+	var vStateKey = opts.StateKey
+	if sStateKey := os.Getenv("UPLINK_STATE_KEY"); sStateKey != "" {
+		vStateKey = sStateKey
+	}
+	fs.StringVar(&opts.StateKey, "uplink-state-key", vStateKey, "OBS Storj State file encryption key, 32 bytes in hex or base64")
+
+	var vAuthServiceAddress = opts.AuthServiceAddress
+	if sAuthServiceAddress := os.Getenv("UPLINK_AUTH_SERVICE_ADDR"); sAuthServiceAddress != "" {
+		vAuthServiceAddress = sAuthServiceAddress
+	}
+	fs.StringVar(&opts.AuthServiceAddress, "uplink-auth-service-addr", vAuthServiceAddress, "OBS Storj Auth service address registering credentials")
+
+	var vAuthServiceCertFile = opts.AuthServiceCertFile
+	if sAuthServiceCertFile := os.Getenv("UPLINK_AUTH_SERVICE_CERT_FILE"); sAuthServiceCertFile != "" {
+		vAuthServiceCertFile = sAuthServiceCertFile
+	}
+	fs.StringVar(&opts.AuthServiceCertFile, "uplink-auth-service-cert-file", vAuthServiceCertFile, "OBS Storj Auth service PEM root certificates, empty uses the system ones")
+
+	var vAuthServiceInsecure = opts.AuthServiceInsecure
+	if sAuthServiceInsecure := os.Getenv("UPLINK_AUTH_SERVICE_INSECURE"); sAuthServiceInsecure != "" {
+		vAuthServiceInsecure, _ = strconv.ParseBool(sAuthServiceInsecure)
+	}
+	fs.BoolVar(&opts.AuthServiceInsecure, "uplink-auth-service-insecure", vAuthServiceInsecure, "OBS Storj Connect to the auth service without TLS, for tests only")
+
+	var vProxy = opts.Proxy
+	if sProxy := os.Getenv("UPLINK_PROXY"); sProxy != "" {
+		vProxy, _ = strconv.ParseBool(sProxy)
+	}
+	fs.BoolVar(&opts.Proxy, "uplink-proxy", vProxy, "OBS Storj Stream objects through uplink instead of redirecting to linkshare URLs")
+
+	var vProxyParallelism = opts.ProxyParallelism
+	if sProxyParallelism := os.Getenv("UPLINK_PROXY_PARALLELISM"); sProxyParallelism != "" {
+		var proxyParallelism int64
+		if proxyParallelism, err = strconv.ParseInt(sProxyParallelism, 10, 64); err != nil {
+			err = errors.Wrap(err, "uplink proxy parallelism")
+			return
+		}
+		vProxyParallelism = int(proxyParallelism)
+	}
+	fs.IntVar(&opts.ProxyParallelism, "uplink-proxy-parallelism", vProxyParallelism, "OBS Storj Chunks of a proxied download fetched at once, 1 streams without buffering")
+
+	var vProxyChunkSize = opts.ProxyChunkSize
+	if sProxyChunkSize := os.Getenv("UPLINK_PROXY_CHUNK_SIZE"); sProxyChunkSize != "" {
+		if vProxyChunkSize, err = strconv.ParseInt(sProxyChunkSize, 10, 64); err != nil {
+			err = errors.Wrap(err, "uplink proxy chunk size")
+			return
+		}
+	}
+	fs.Int64Var(&opts.ProxyChunkSize, "uplink-proxy-chunk-size", vProxyChunkSize, "OBS Storj Bytes of a proxied download chunk, buffered in memory")
+
 	return
 }
 
@@ -76,50 +179,204 @@ var defaultEdgeConfig = edge.Config{
 
 type storjAggegrateClient struct {
 	edgeConfig *edge.Config
-	access     *uplink.Access
-	project    *uplink.Project
+	// edgeConfig.RegisterAccess
+	registerAccess func(ctx context.Context, access *uplink.Access, opts *edge.RegisterAccessOptions) (*edge.Credentials, error)
+	// full access, shares are narrowed from it
+	access  *uplink.Access
+	project *uplink.Project
 
-	creds *edge.Credentials
+	// public, read-only share of linkshare URLs
+	readShare *storjShare
+	// private share of presigned gateway uploads
+	uploadShare *storjShare
+	prefixes    []uplink.SharePrefix
+	shareTTL    time.Duration
+	// proxied downloads don't need the linkshare credentials upfront
+	proxy bool
 
 	accessKeyID  string
 	shareBaseURL string
+
+	// nil doesn't persist credentials
+	state       *storjStateFile
+	fingerprint string
+	stateMu     sync.Mutex
+	persisted   map[string]storjStateShare
+
+	logger *zap.SugaredLogger
+}
+
+// storjShare is the edge credentials of the access narrowed to a
+// permission, registered again at half of their lifetime.
+type storjShare struct {
+	name       string
+	permission uplink.Permission
+	public     bool
+
+	mu    sync.Mutex
+	creds *edge.Credentials
+	// zero never expires
+	notAfter time.Time
+	renewAt  time.Time
 }
 
 func (c *storjAggegrateClient) Init(ctx context.Context) (_ *storjAggegrateClient, err error) {
-	if c.access != nil {
-		// TODO: rate limit this, persist the registered access key ID
-		if c.creds, err = c.edgeConfig.RegisterAccess(ctx, c.access, &edge.RegisterAccessOptions{
-			// This will create `accessKeyID` that allow anonymous access
-			// to any objects that `c.access` has access to (just like `public-read` ACL).
-			Public: true,
-		}); err != nil {
-			err = errors.Wrap(err, "register access")
+	if c.access != nil && c.state != nil {
+		var authService string
+		if c.edgeConfig != nil {
+			authService = c.edgeConfig.AuthServiceAddress
+		}
+		if c.fingerprint, err = storjFingerprint(c.access, authService, c.prefixes, c.shareTTL); err != nil {
+			err = errors.Wrap(err, "fingerprint access")
+			return
+		}
+		c.loadState()
+	}
+	if c.access != nil && !c.proxy {
+		// register the linkshare credentials upfront to fail early
+		if _, _, err = c.shareCredentials(ctx, c.readShare); err != nil {
 			return
 		}
 	}
 	return c, nil
 }
 
-func (c *storjAggegrateClient) getAccessKeyID() (accessKeyID string) {
-	accessKeyID = c.accessKeyID
-	// fallback to `c.creds` if custom accessKeyID is not provided
-	// and `c.creds` is specified.
-	if accessKeyID == "" && c.creds != nil {
-		accessKeyID = c.creds.AccessKeyID
+// shareCredentials returns the registered credentials of share and
+// when they expire, zero is never. They are registered again once due,
+// a failed renewal keeps the previous credentials while valid.
+func (c *storjAggegrateClient) shareCredentials(ctx context.Context, share *storjShare) (_ *edge.Credentials, _ time.Time, err error) {
+	share.mu.Lock()
+	defer share.mu.Unlock()
+	now := time.Now()
+	if share.creds != nil && (share.renewAt.IsZero() || now.Before(share.renewAt)) {
+		return share.creds, share.notAfter, nil
 	}
-	return
+
+	permission := share.permission
+	if c.shareTTL > 0 {
+		permission.NotAfter = now.Add(c.shareTTL)
+	}
+	var shared *uplink.Access
+	var creds *edge.Credentials
+	if shared, err = c.access.Share(permission, c.prefixes...); err == nil {
+		creds, err = c.registerAccess(ctx, shared, &edge.RegisterAccessOptions{
+			// public credentials allow anonymous access to any objects
+			// of the share, just like `public-read` ACL.
+			Public: share.public,
+		})
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "register %s access", share.name)
+		if share.creds != nil && (share.notAfter.IsZero() || now.Before(share.notAfter)) {
+			c.logger.Errorw("renew share, keeping previous credentials",
+				"share", share.name,
+				"notAfter", share.notAfter,
+				"err", err)
+			return share.creds, share.notAfter, nil
+		}
+		return
+	}
+	share.creds = creds
+	share.notAfter, share.renewAt = time.Time{}, time.Time{}
+	if c.shareTTL > 0 {
+		share.notAfter = permission.NotAfter
+		share.renewAt = now.Add(c.shareTTL / 2)
+	}
+	c.logger.Infow("registered share",
+		"share", share.name,
+		"notAfter", share.notAfter)
+	c.saveShare(share.name, storjStateShare{
+		AccessKeyID: creds.AccessKeyID,
+		SecretKey:   creds.SecretKey,
+		Endpoint:    creds.Endpoint,
+		NotAfter:    share.notAfter,
+		RenewAt:     share.renewAt,
+	})
+	return share.creds, share.notAfter, nil
+}
+
+// loadState reuses the persisted credentials of the same grant, prefixes
+// and lifetime, an unreadable state file is registered again.
+func (c *storjAggegrateClient) loadState() {
+	state, err := c.state.Load()
+	if err != nil {
+		c.logger.Errorw("load state, registering again",
+			"file", c.state.file,
+			"err", err)
+		return
+	}
+	if state == nil || state.Fingerprint != c.fingerprint {
+		return
+	}
+	now := time.Now()
+	for _, share := range []*storjShare{c.readShare, c.uploadShare} {
+		saved, exist := state.Shares[share.name]
+		if !exist || (!saved.NotAfter.IsZero() && !now.Before(saved.NotAfter)) {
+			continue
+		}
+		// locked apart, shareCredentials saves under the share lock
+		share.mu.Lock()
+		share.creds = &edge.Credentials{
+			AccessKeyID: saved.AccessKeyID,
+			SecretKey:   saved.SecretKey,
+			Endpoint:    saved.Endpoint,
+		}
+		share.notAfter, share.renewAt = saved.NotAfter, saved.RenewAt
+		share.mu.Unlock()
+		c.stateMu.Lock()
+		c.persisted[share.name] = saved
+		c.stateMu.Unlock()
+	}
+}
+
+// saveShare persists the credentials of a share along with the others.
+func (c *storjAggegrateClient) saveShare(name string, saved storjStateShare) {
+	if c.state == nil {
+		return
+	}
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.persisted[name] = saved
+	if err := c.state.Save(&storjState{Fingerprint: c.fingerprint, Shares: c.persisted}); err != nil {
+		c.logger.Errorw("save state",
+			"file", c.state.file,
+			"err", err)
+	}
+}
+
+// UploadCredentials returns the private gateway credentials uploads are
+// presigned with, registered on first use.
+func (c *storjAggegrateClient) UploadCredentials(ctx context.Context) (*edge.Credentials, error) {
+	if c.access == nil {
+		// custom accessKeyID only, there's no secret to sign with.
+		return nil, errors.New("uploads need an access grant or api key")
+	}
+	creds, _, err := c.shareCredentials(ctx, c.uploadShare)
+	return creds, err
 }
 
 func (c *storjAggegrateClient) getProject() *uplink.Project {
 	return c.project
 }
 
-func (c *storjAggegrateClient) JoinShareURL(bucket, key string, opts *edge.ShareURLOptions) (string, error) {
-	accessKeyID := c.getAccessKeyID()
-	return edge.JoinShareURL(c.shareBaseURL, accessKeyID, bucket, key, opts)
+// JoinShareURL returns the linkshare URL of the object and when it stops
+// working, zero is never.
+func (c *storjAggegrateClient) JoinShareURL(ctx context.Context, bucket, key string, opts *edge.ShareURLOptions) (shareURL string, notAfter time.Time, err error) {
+	accessKeyID := c.accessKeyID
+	// fallback to the read share if custom accessKeyID is not provided
+	// and there's an access to register.
+	if accessKeyID == "" && c.access != nil {
+		var creds *edge.Credentials
+		if creds, notAfter, err = c.shareCredentials(ctx, c.readShare); err != nil {
+			return
+		}
+		accessKeyID = creds.AccessKeyID
+	}
+	shareURL, err = edge.JoinShareURL(c.shareBaseURL, accessKeyID, bucket, key, opts)
+	return
 }
 
-func newObsStorjClient(ctx context.Context, opts obsStorjOptions) (client *storjAggegrateClient, err error) {
+func newObsStorjClient(ctx context.Context, opts obsStorjOptions, logger *zap.Logger) (client *storjAggegrateClient, err error) {
 	var (
 		access  *uplink.Access
 		project *uplink.Project
@@ -147,18 +404,27 @@ func newObsStorjClient(ctx context.Context, opts obsStorjOptions) (client *storj
 		// using custom accessKeyID
 		access = nil
 	}
-	// TODO: limit access scope.
+	// shares and the project only see the served bucket prefixes
+	var prefixes []uplink.SharePrefix
+	if opts.ShareBucket != "" {
+		for _, prefix := range splitList(opts.SharePrefixes) {
+			prefixes = append(prefixes, uplink.SharePrefix{Bucket: opts.ShareBucket, Prefix: strings.TrimLeft(prefix, "/")})
+		}
+		if len(prefixes) == 0 {
+			prefixes = append(prefixes, uplink.SharePrefix{Bucket: opts.ShareBucket})
+		}
+	} else if opts.SharePrefixes != "" {
+		err = errors.New("share prefixes need a bucket")
+		return
+	}
 	if access != nil {
-		// Consider to limit the access to specific bucket and prefix
-		// access, err = access.Share(
-		// 	uplink.ReadOnlyPermission(),
-		// 	uplink.SharePrefix{
-		// 		Bucket: "",
-		// 		Prefix: "",
-		// 	})
-
+		var projectAccess *uplink.Access
+		if projectAccess, err = access.Share(uplink.ReadOnlyPermission(), prefixes...); err != nil {
+			err = errors.Wrap(err, "restrict access")
+			return
+		}
 		// open project
-		project, err = uplink.OpenProject(ctx, access)
+		project, err = uplink.OpenProject(ctx, projectAccess)
 		if err != nil {
 			err = errors.Wrap(err, "open project")
 			return
@@ -168,12 +434,45 @@ func newObsStorjClient(ctx context.Context, opts obsStorjOptions) (client *storj
 	if opts.ShareBaseURL == "" {
 		opts.ShareBaseURL = defaultObsUplinkOpts.ShareBaseURL
 	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	edgeConfig := defaultEdgeConfig
+	if opts.AuthServiceAddress != "" {
+		edgeConfig.AuthServiceAddress = opts.AuthServiceAddress
+	}
+	if opts.AuthServiceCertFile != "" {
+		if edgeConfig.CertificatePEM, err = os.ReadFile(opts.AuthServiceCertFile); err != nil {
+			err = errors.Wrap(err, "read auth service certificates")
+			return
+		}
+	}
+	edgeConfig.InsecureSkipVerify = opts.AuthServiceInsecure
+	var state *storjStateFile
+	if opts.StateFile != "" {
+		if state, err = newStorjStateFile(opts.StateFile, opts.StateKey); err != nil {
+			err = errors.Wrap(err, "state file")
+			return
+		}
+	}
 	return (&storjAggegrateClient{
-		edgeConfig: &defaultEdgeConfig,
-		access:     access,
-		project:    project,
+		edgeConfig:     &edgeConfig,
+		registerAccess: edgeConfig.RegisterAccess,
+		access:         access,
+		project:        project,
+
+		readShare:   &storjShare{name: "read", permission: uplink.ReadOnlyPermission(), public: true},
+		uploadShare: &storjShare{name: "upload", permission: uplink.Permission{AllowUpload: true}},
+		prefixes:    prefixes,
+		shareTTL:    opts.ShareTTL,
+		proxy:       opts.Proxy,
 
 		accessKeyID:  opts.AccessKeyID,
 		shareBaseURL: opts.ShareBaseURL,
+
+		state:     state,
+		persisted: map[string]storjStateShare{},
+
+		logger: logger.Named("storj").Sugar(),
 	}).Init(ctx)
 }
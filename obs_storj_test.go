@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"storj.io/uplink"
 	"storj.io/uplink/edge"
 )
 
@@ -24,14 +29,14 @@ func TestStorjUplink(t *testing.T) {
 		// > If you call this function a lot, and the use case allows it, please limit
 		// > the lifetime of the credentials by setting Permission.NotAfter when creating the Access.
 		AccessKeyID: "placeholder",
-	})
+	}, nil)
 	require.NoError(t, err)
 
 	if client.access != nil {
 		println(client.access.SatelliteAddress())
 	}
 
-	shareLinkURL, err := client.JoinShareURL(
+	shareLinkURL, _, err := client.JoinShareURL(context.Background(),
 		// "demo-bucket", "main.c",
 		"moe", "moe-onl/13744453-430b-4e6b-ae81-29e7f2491317.png",
 		&edge.ShareURLOptions{
@@ -40,3 +45,66 @@ func TestStorjUplink(t *testing.T) {
 	require.NoError(t, err)
 	println(shareLinkURL)
 }
+
+// testStorjAccessGrant is an offline access grant of a made up API key
+const testStorjAccessGrant = "13Swqbf6K2KYgr6neGL33948jqavYEHGYcgMCDCMFrkWbo2kwFZ5CiP86omr4PWG6ULvewtFUxMQjAYcESLb7RiVCovUo4Pd3143rNgxSzVvPUMnsCJ2HR9J1dh6xcAPCmk4em3xXwG7Va4SyovSZxx1j97XWzSA4XhuHBCkjUdE4GRb2adAKmCRpJ9Yv8xNpbUk9ejHYUAAETu3Nd5v93gvMV82LJ4gWXJegr5XG4HDLaxECUNsRCjzbJ6ESYK"
+
+func TestStorjShareCredentials(t *testing.T) {
+	access, err := uplink.ParseAccess(testStorjAccessGrant)
+	require.NoError(t, err)
+
+	var registered []*edge.RegisterAccessOptions
+	var fail bool
+	c := &storjAggegrateClient{
+		registerAccess: func(ctx context.Context, access *uplink.Access, opts *edge.RegisterAccessOptions) (*edge.Credentials, error) {
+			if fail {
+				return nil, errors.New("auth service down")
+			}
+			registered = append(registered, opts)
+			return &edge.Credentials{AccessKeyID: fmt.Sprintf("key%d", len(registered)), Endpoint: "https://gateway.example.com"}, nil
+		},
+		access:       access,
+		readShare:    &storjShare{name: "read", permission: uplink.ReadOnlyPermission(), public: true},
+		uploadShare:  &storjShare{name: "upload", permission: uplink.Permission{AllowUpload: true}},
+		prefixes:     []uplink.SharePrefix{{Bucket: "bucket", Prefix: "public/"}},
+		shareTTL:     time.Hour,
+		shareBaseURL: "https://link.example.com",
+		logger:       zap.NewNop().Sugar(),
+	}
+	ctx := context.Background()
+
+	shareURL, notAfter, err := c.JoinShareURL(ctx, "bucket", "public/a.txt", &edge.ShareURLOptions{Raw: true})
+	require.NoError(t, err)
+	require.Equal(t, "https://link.example.com/raw/key1/bucket/public/a.txt", shareURL)
+	require.WithinDuration(t, time.Now().Add(time.Hour), notAfter, time.Minute)
+	require.True(t, registered[0].Public)
+
+	// cached until half of the lifetime
+	_, _, err = c.JoinShareURL(ctx, "bucket", "public/b.txt", nil)
+	require.NoError(t, err)
+	require.Len(t, registered, 1)
+
+	// a failed renewal keeps valid credentials
+	c.readShare.renewAt = time.Now().Add(-time.Second)
+	fail = true
+	shareURL, _, err = c.JoinShareURL(ctx, "bucket", "public/a.txt", &edge.ShareURLOptions{Raw: true})
+	require.NoError(t, err)
+	require.Contains(t, shareURL, "/key1/")
+	c.readShare.notAfter = time.Now().Add(-time.Second)
+	_, _, err = c.JoinShareURL(ctx, "bucket", "public/a.txt", nil)
+	require.Error(t, err)
+
+	fail = false
+	shareURL, _, err = c.JoinShareURL(ctx, "bucket", "public/a.txt", &edge.ShareURLOptions{Raw: true})
+	require.NoError(t, err)
+	require.Contains(t, shareURL, "/key2/")
+
+	// uploads get private credentials of their own
+	creds, err := c.UploadCredentials(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "key3", creds.AccessKeyID)
+	require.False(t, registered[2].Public)
+
+	_, err = (&storjAggegrateClient{}).UploadCredentials(ctx)
+	require.Error(t, err)
+}
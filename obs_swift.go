@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type obsSwiftOptions struct {
+	// static token auth
+	StorageURL string // ex. `https://swift.example.com/v1/AUTH_account`
+	AuthToken  string
+
+	// v1 auth, takes precedence over static token
+	AuthURL string
+	User    string
+	Key     string
+
+	TempURLKey    string
+	TempURLDigest string // sha1, sha256 or sha512
+}
+
+var defaultObsSwiftOpts = obsSwiftOptions{
+	TempURLDigest: "sha256",
+}
+
+func (opts *obsSwiftOptions) Bind(fs *flag.FlagSet) (err error) {
+	var vStorageURL = opts.StorageURL
+	if sStorageURL := os.Getenv("SWIFT_STORAGE_URL"); sStorageURL != "" {
+		vStorageURL = sStorageURL
+	}
+	fs.StringVar(&opts.StorageURL, "swift-storage-url", vStorageURL, "OBS Swift Storage URL")
+
+	var vAuthToken = opts.AuthToken
+	if sAuthToken := os.Getenv("SWIFT_AUTH_TOKEN"); sAuthToken != "" {
+		vAuthToken = sAuthToken
+	}
+	fs.StringVar(&opts.AuthToken, "swift-auth-token", vAuthToken, "OBS Swift static auth token")
+
+	{
+		var vAuthURL = opts.AuthURL
+		if sAuthURL := os.Getenv("SWIFT_AUTH_URL"); sAuthURL != "" {
+			vAuthURL = sAuthURL
+		}
+		fs.StringVar(&opts.AuthURL, "swift-auth-url", vAuthURL, "OBS Swift v1 auth URL")
+
+		var vUser = opts.User
+		if sUser := os.Getenv("SWIFT_USER"); sUser != "" {
+			vUser = sUser
+		}
+		fs.StringVar(&opts.User, "swift-user", vUser, "OBS Swift v1 auth user")
+
+		var vKey = opts.Key
+		if sKey := os.Getenv("SWIFT_KEY"); sKey != "" {
+			vKey = sKey
+		}
+		fs.StringVar(&opts.Key, "swift-key", vKey, "OBS Swift v1 auth key")
+	}
+
+	var vTempURLKey = opts.TempURLKey
+	if sTempURLKey := os.Getenv("SWIFT_TEMP_URL_KEY"); sTempURLKey != "" {
+		vTempURLKey = sTempURLKey
+	}
+	fs.StringVar(&opts.TempURLKey, "swift-temp-url-key", vTempURLKey, "OBS Swift TempURL key")
+
+	var vTempURLDigest = opts.TempURLDigest
+	if sTempURLDigest := os.Getenv("SWIFT_TEMP_URL_DIGEST"); sTempURLDigest != "" {
+		vTempURLDigest = sTempURLDigest
+	}
+	fs.StringVar(&opts.TempURLDigest, "swift-temp-url-digest", vTempURLDigest, "OBS Swift TempURL digest (available [sha1, sha256, sha512])")
+	return
+}
+
+type swiftClient struct {
+	opts       obsSwiftOptions
+	httpClient *http.Client
+	digest     func() hash.Hash
+
+	mu         sync.RWMutex
+	storageURL *url.URL
+	authToken  string
+}
+
+func newObsSwiftClient(ctx context.Context, opts obsSwiftOptions) (client *swiftClient, err error) {
+	client = &swiftClient{
+		opts:       opts,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+	switch strings.ToLower(opts.TempURLDigest) {
+	case "sha1":
+		client.digest = sha1.New
+	case "", "sha256":
+		client.digest = sha256.New
+	case "sha512":
+		client.digest = sha512.New
+	default:
+		err = errors.Errorf("unknown temp url digest %q", opts.TempURLDigest)
+		return
+	}
+	if opts.TempURLKey == "" {
+		err = errors.New("temp url key is required")
+		return
+	}
+
+	if opts.AuthURL != "" {
+		if err = client.authenticate(ctx); err != nil {
+			err = errors.Wrap(err, "v1 auth")
+			return
+		}
+		return
+	}
+	if client.storageURL, err = url.Parse(strings.TrimRight(opts.StorageURL, "/")); err != nil {
+		err = errors.Wrap(err, "parse storage url")
+		return
+	}
+	client.authToken = opts.AuthToken
+	return
+}
+
+// authenticate fetches storage URL and token with v1 auth.
+//
+// Docs: https://docs.openstack.org/swift/latest/api/authentication.html
+func (c *swiftClient) authenticate(ctx context.Context) (err error) {
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, c.opts.AuthURL, nil); err != nil {
+		return
+	}
+	req.Header.Set("X-Auth-User", c.opts.User)
+	req.Header.Set("X-Auth-Key", c.opts.Key)
+	var resp *http.Response
+	if resp, err = c.httpClient.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		err = errors.Errorf("auth: %s", resp.Status)
+		return
+	}
+	var storageURL *url.URL
+	if storageURL, err = url.Parse(strings.TrimRight(resp.Header.Get("X-Storage-Url"), "/")); err != nil {
+		err = errors.Wrap(err, "parse storage url")
+		return
+	}
+	c.mu.Lock()
+	c.storageURL = storageURL
+	c.authToken = resp.Header.Get("X-Auth-Token")
+	c.mu.Unlock()
+	return
+}
+
+func (c *swiftClient) getStorageURL() (url.URL, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return *c.storageURL, c.authToken
+}
+
+func (c *swiftClient) objectURL(container, object string) *url.URL {
+	u, _ := c.getStorageURL()
+	u.Path = u.Path + "/" + container + "/" + object
+	u.RawPath = ""
+	return &u
+}
+
+// StatObject checks object existence, v1 auth token is renewed once when rejected.
+func (c *swiftClient) StatObject(ctx context.Context, container, object string) (header http.Header, err error) {
+	for attempt := 0; ; attempt++ {
+		_, authToken := c.getStorageURL()
+		var req *http.Request
+		if req, err = http.NewRequestWithContext(ctx, http.MethodHead, c.objectURL(container, object).String(), nil); err != nil {
+			return
+		}
+		req.Header.Set("X-Auth-Token", authToken)
+		var resp *http.Response
+		if resp, err = c.httpClient.Do(req); err != nil {
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized && c.opts.AuthURL != "" && attempt == 0 {
+			if err = c.authenticate(ctx); err != nil {
+				err = errors.Wrap(err, "v1 auth")
+				return
+			}
+			continue
+		}
+		if resp.StatusCode/100 != 2 {
+			err = errors.Errorf("stat object: %s", resp.Status)
+			return
+		}
+		return resp.Header, nil
+	}
+}
+
+// TempURL signs object URL that expires at UNIX time expires.
+//
+// Docs: https://docs.openstack.org/swift/latest/api/temporary_url_middleware.html
+func (c *swiftClient) TempURL(method, container, object string, expires int64) *url.URL {
+	u := c.objectURL(container, object)
+	mac := hmac.New(c.digest, []byte(c.opts.TempURLKey))
+	fmt.Fprintf(mac, "%s\n%d\n%s", method, expires, u.Path)
+
+	var sig string
+	if mac.Size() == sha512.Size {
+		// hex SHA512 is not accepted, use prefixed base64
+		sig = "sha512:" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	} else {
+		sig = hex.EncodeToString(mac.Sum(nil))
+	}
+	query := url.Values{}
+	query.Set("temp_url_sig", sig)
+	query.Set("temp_url_expires", strconv.FormatInt(expires, 10))
+	u.RawQuery = query.Encode()
+	return u
+}
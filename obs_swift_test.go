@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwiftStatObject(t *testing.T) {
+	var (
+		srv   *httptest.Server
+		token = "tok1"
+	)
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/auth/v1.0" {
+			require.Equal(t, "user", r.Header.Get("X-Auth-User"))
+			require.Equal(t, "key", r.Header.Get("X-Auth-Key"))
+			w.Header().Set("X-Storage-Url", srv.URL+"/v1/AUTH_test")
+			w.Header().Set("X-Auth-Token", token)
+			return
+		}
+		if r.Header.Get("X-Auth-Token") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v1/AUTH_test/container/a/b.jpg" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	client, err := newObsSwiftClient(context.Background(), obsSwiftOptions{
+		AuthURL:    srv.URL + "/auth/v1.0",
+		User:       "user",
+		Key:        "key",
+		TempURLKey: "secret",
+	})
+	require.NoError(t, err)
+
+	_, err = client.StatObject(context.Background(), "container", "a/b.jpg")
+	require.NoError(t, err)
+
+	// token expired, re-authenticate
+	token = "tok2"
+	_, err = client.StatObject(context.Background(), "container", "a/b.jpg")
+	require.NoError(t, err)
+
+	_, err = client.StatObject(context.Background(), "container", "missing")
+	require.Error(t, err)
+}
+
+func TestSwiftTempURL(t *testing.T) {
+	for _, digest := range []string{"sha1", "sha256", "sha512"} {
+		client, err := newObsSwiftClient(context.Background(), obsSwiftOptions{
+			StorageURL:    "https://swift.example.com/v1/AUTH_account",
+			TempURLKey:    "mykey",
+			TempURLDigest: digest,
+		})
+		require.NoError(t, err)
+
+		u := client.TempURL(http.MethodGet, "container", "object", 1323479485)
+		require.Equal(t, "/v1/AUTH_account/container/object", u.Path)
+		require.Equal(t, "1323479485", u.Query().Get("temp_url_expires"))
+		// documented HMAC body: METHOD\nEXPIRES\nPATH
+		body := []byte("GET\n1323479485\n/v1/AUTH_account/container/object")
+		var want string
+		switch digest {
+		case "sha1":
+			mac := hmac.New(sha1.New, []byte("mykey"))
+			mac.Write(body)
+			want = hex.EncodeToString(mac.Sum(nil))
+		case "sha256":
+			mac := hmac.New(sha256.New, []byte("mykey"))
+			mac.Write(body)
+			want = hex.EncodeToString(mac.Sum(nil))
+		case "sha512":
+			mac := hmac.New(sha512.New, []byte("mykey"))
+			mac.Write(body)
+			want = "sha512:" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+		}
+		require.Equal(t, want, u.Query().Get("temp_url_sig"), digest)
+	}
+
+	_, err := newObsSwiftClient(context.Background(), obsSwiftOptions{
+		TempURLKey:    "mykey",
+		TempURLDigest: "md5",
+	})
+	require.Error(t, err)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+type apiPostPolicyRequest struct {
+	// route prefix whose policy generates the key, ignored with Key
+	Prefix string `json:"prefix,omitempty"`
+	// client chosen key, must match the key template
+	Key      string `json:"key,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	// exact content type, empty allows what the upload policy allows
+	ContentType string `json:"content_type,omitempty"`
+}
+
+type apiPostPolicyResponse struct {
+	URL       string            `json:"url"`
+	Key       string            `json:"key"`
+	Fields    map[string]string `json:"fields"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// postPolicy signs a browser form upload policy. The form key is
+// generated or checked like upload does and the policy allows that key
+// only, one form per file, so a form can't overwrite other objects.
+func (h *signingHandler) postPolicy(ctx *fasthttp.RequestCtx, callCtx context.Context) {
+	if !ctx.IsPost() {
+		h.apiError(ctx, http.StatusMethodNotAllowed, ErrKind_MethodNotAllowed, "")
+		return
+	}
+	var req apiPostPolicyRequest
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_InvalidRequest, err)
+		return
+	}
+
+	r, policy, ok := h.uploadRouteOf(ctx, req.Prefix, &req.Key)
+	if !ok {
+		return
+	}
+	contentType, contentTypePrefix, err := postPolicyContentType(policy, req.ContentType)
+	if err != nil {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_UploadPolicy, err)
+		return
+	}
+	extContentType := contentType
+	if contentTypePrefix {
+		extContentType = ""
+	}
+	key, ok := h.uploadKey(ctx, r, policy, req.Key, req.Filename, extContentType)
+	if !ok {
+		return
+	}
+	uploader, ok := h.uploaderOf(ctx, r)
+	if !ok {
+		return
+	}
+
+	preq := postPolicyRequest{
+		Bucket:            h.opts.BucketName,
+		Key:               key,
+		ContentType:       contentType,
+		ContentTypePrefix: contentTypePrefix,
+		MaxSize:           policy.PutMaxSize(),
+		SuccessRedirect:   policy.SuccessRedirect,
+		Expiry:            time.Duration(policy.Expiry),
+	}
+	if r != nil {
+		preq.Credentials = r.Credentials
+	}
+	signed, err := uploader.SignPostPolicy(callCtx, preq)
+	if err != nil {
+		h.apiError(ctx, http.StatusInternalServerError, ErrKind_SignURL, err)
+		return
+	}
+
+	h.logger.Infow("post policy",
+		"bucket", preq.Bucket,
+		"objectName", key,
+		"contentType", contentType)
+	h.apiJSON(ctx, http.StatusOK, apiPostPolicyResponse{
+		URL:       signed.URL,
+		Key:       key,
+		Fields:    signed.Fields,
+		ExpiresAt: signed.ExpireAt,
+	})
+}
+
+// postPolicyContentType returns the content type condition of a POST
+// policy, a policy condition can't list several types so the client
+// has to pick one unless the upload policy allows a single type or
+// prefix.
+func postPolicyContentType(policy *uploadPolicy, contentType string) (_ string, prefix bool, err error) {
+	if contentType != "" {
+		if !policy.AllowContentType(contentType) {
+			return "", false, errors.Errorf("content type %q not allowed", contentType)
+		}
+		// parameters are dropped, the policy JSON isn't escaped
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		return mediaType, false, nil
+	}
+	switch len(policy.ContentTypes) {
+	case 0:
+		return "", true, nil
+	case 1:
+		allowed := strings.ToLower(policy.ContentTypes[0])
+		if strings.HasSuffix(allowed, "/*") {
+			return strings.TrimSuffix(allowed, "*"), true, nil
+		}
+		return allowed, false, nil
+	}
+	return "", false, errors.New("content_type is required, the upload policy allows several")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	ErrKind_DownloadObject = "OBS_DOWNLOAD_OBJECT"
+)
+
+// objectDownloader is a backend that streams objects, proxy mode serves
+// them instead of redirecting to a signed URL.
+type objectDownloader interface {
+	objectBackend
+	// DownloadObject reads length bytes of the object from offset.
+	DownloadObject(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error)
+}
+
+// responseOverrideHeaders are the headers of proxied objects set by
+// response overrides.
+var responseOverrideHeaders = map[string]string{
+	"response-cache-control":       "Cache-Control",
+	"response-content-disposition": "Content-Disposition",
+	"response-content-encoding":    "Content-Encoding",
+	"response-content-language":    "Content-Language",
+	"response-content-type":        "Content-Type",
+	"response-expires":             "Expires",
+}
+
+// initProxy checks proxy mode, which the server enables before Init. The
+// default backend has to stream objects, and proxied objects are the
+// latest version only.
+func (h *signingHandler) initProxy() error {
+	if _, ok := h.backendOf(nil).(objectDownloader); !ok {
+		return errors.Errorf("backend %q can't stream objects", h.backendOf(nil).Name())
+	}
+	if h.versionOf(nil).Enabled() {
+		return errors.New("proxied objects can't be versioned")
+	}
+	for _, r := range h.routes.routes {
+		if h.proxyOf(r) != nil && h.versionOf(r).Enabled() {
+			return errors.Errorf("route %q: proxied objects can't be versioned", r.Prefix)
+		}
+	}
+	return nil
+}
+
+// proxyOf returns the backend streaming objects of the route in proxy
+// mode, nil if they're redirected. Routes with a signer of their own are
+// redirected.
+func (h *signingHandler) proxyOf(r *route) objectDownloader {
+	if !h.proxy || (r != nil && r.Signer != "") {
+		return nil
+	}
+	downloader, _ := h.backendOf(r).(objectDownloader)
+	return downloader
+}
+
+// proxyObject streams the object, a single `Range` is honored. Signed
+// response overrides become the response headers.
+func (h *signingHandler) proxyObject(ctx *fasthttp.RequestCtx, downloader objectDownloader, bucket, key string, info *objectInfo, overrides url.Values) {
+	header := &ctx.Response.Header
+	header.Set("Accept-Ranges", "bytes")
+	if info.ContentType != "" {
+		header.SetContentType(info.ContentType)
+	}
+	if info.ETag != "" {
+		header.Set("ETag", `"`+strings.Trim(info.ETag, `"`)+`"`)
+	}
+	if !info.LastModified.IsZero() {
+		header.Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	}
+	for k, name := range responseOverrideHeaders {
+		if v := overrides.Get(k); v != "" {
+			header.Set(name, v)
+		}
+	}
+
+	offset, length := int64(0), info.Size
+	statusCode := http.StatusOK
+	// multiple ranges are served whole, which RFC 9110 allows
+	if byteRange := ctx.Request.Header.Peek("Range"); len(byteRange) > 0 && !bytes.Contains(byteRange, []byte(",")) {
+		start, end, err := fasthttp.ParseByteRange(byteRange, int(info.Size))
+		if err != nil {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			ctx.SetStatusCode(http.StatusRequestedRangeNotSatisfiable)
+			h.reportError(ctx, ErrKind_InvalidRequest, "range not satisfiable")
+			return
+		}
+		offset, length = int64(start), int64(end-start+1)
+		statusCode = http.StatusPartialContent
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, info.Size))
+	}
+
+	if bytes.Equal(ctx.Method(), MethodHead) {
+		ctx.SetStatusCode(statusCode)
+		header.Set("Content-Length", strconv.FormatInt(length, 10))
+		return
+	}
+	// the body is streamed after the handler returns, the request context
+	// is done on server shutdown only
+	body, err := downloader.DownloadObject(context.Background(), bucket, key, offset, length)
+	if err != nil {
+		header.Del("Content-Range")
+		ctx.SetStatusCode(http.StatusBadGateway)
+		h.reportError(ctx, ErrKind_DownloadObject, err)
+		return
+	}
+	ctx.SetStatusCode(statusCode)
+	// fasthttp closes body once written
+	ctx.SetBodyStream(body, int(length))
+}
+
+// chunkOpener opens length bytes of an object from offset.
+type chunkOpener func(ctx context.Context, offset, length int64) (io.ReadCloser, error)
+
+// newParallelDownload reads length bytes from offset in chunks of
+// chunkSize, up to parallelism chunks are downloaded at once and
+// buffered in memory. One connection streams without buffering.
+func newParallelDownload(ctx context.Context, open chunkOpener, offset, length, chunkSize int64, parallelism int) (io.ReadCloser, error) {
+	if parallelism <= 1 || chunkSize <= 0 || length <= chunkSize {
+		return open(ctx, offset, length)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	d := &parallelDownload{
+		cancel: cancel,
+		// the chunk being read is the last one in flight
+		chunks: make(chan chan downloadChunk, parallelism-1),
+	}
+	go func() {
+		defer close(d.chunks)
+		for pos, end := offset, offset+length; pos < end; pos += chunkSize {
+			n := chunkSize
+			if end-pos < n {
+				n = end - pos
+			}
+			result := make(chan downloadChunk, 1)
+			select {
+			case d.chunks <- result:
+			case <-ctx.Done():
+				return
+			}
+			go func(pos, n int64) {
+				data, err := readChunk(ctx, open, pos, n)
+				result <- downloadChunk{data: data, err: err}
+			}(pos, n)
+		}
+	}()
+	return d, nil
+}
+
+type downloadChunk struct {
+	data []byte
+	err  error
+}
+
+// parallelDownload reads the chunks of a download in order.
+type parallelDownload struct {
+	cancel context.CancelFunc
+	chunks chan chan downloadChunk
+	buf    []byte
+	err    error
+}
+
+func (d *parallelDownload) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		result, ok := <-d.chunks
+		if !ok {
+			d.err = io.EOF
+			continue
+		}
+		chunk := <-result
+		d.buf, d.err = chunk.data, chunk.err
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// Close cancels the chunks in flight.
+func (d *parallelDownload) Close() error {
+	d.cancel()
+	return nil
+}
+
+func readChunk(ctx context.Context, open chunkOpener, offset, length int64) (_ []byte, err error) {
+	var rc io.ReadCloser
+	if rc, err = open(ctx, offset, length); err != nil {
+		return
+	}
+	defer rc.Close()
+	data := make([]byte, length)
+	if _, err = io.ReadFull(rc, data); err != nil {
+		return nil, errors.Wrapf(err, "read chunk at %d", offset)
+	}
+	return data, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+// testDownloader serves objects from memory, in chunks of 3 bytes.
+type testDownloader struct {
+	objects map[string]string
+}
+
+func (d *testDownloader) Init(ctx context.Context, opts serverOptions, clients *clientPool) error {
+	return nil
+}
+
+func (d *testDownloader) Name() string {
+	return "memory"
+}
+
+func (d *testDownloader) StatObject(ctx context.Context, bucket, key string) (*objectInfo, error) {
+	body, ok := d.objects[key]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return &objectInfo{
+		Key:          key,
+		Size:         int64(len(body)),
+		ContentType:  "text/plain",
+		ETag:         "etag",
+		LastModified: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}, nil
+}
+
+func (d *testDownloader) DownloadObject(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error) {
+	body := d.objects[key]
+	return newParallelDownload(ctx, func(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(body[offset : offset+length])), nil
+	}, offset, length, 3, 2)
+}
+
+// testSigner signs memory objects, without response overrides like the
+// Storj signer.
+type testSigner struct{}
+
+func (s *testSigner) Init(ctx context.Context, opts serverOptions, clients *clientPool) error {
+	return nil
+}
+
+func (s *testSigner) Name() string {
+	return "memory"
+}
+
+func (s *testSigner) SignURL(ctx context.Context, req signRequest) (*signedURL, error) {
+	return &signedURL{URL: "https://memory.example.com/" + req.Key}, nil
+}
+
+// testProxyServer proxies the objects of its downloader.
+type testProxyServer struct {
+	signingHandler
+}
+
+func (s *testProxyServer) Init(ctx context.Context, opts serverOptions) error {
+	s.proxy = true
+	return s.signingHandler.Init(ctx, opts, s.Name(), "memory", "memory")
+}
+
+func (s *testProxyServer) Name() string {
+	return "memory"
+}
+
+func (s *testProxyServer) GetHandler() fasthttp.RequestHandler {
+	return s.handle
+}
+
+// registerTestProxy registers downloader and testSigner as `memory`.
+func registerTestProxy(t *testing.T, downloader *testDownloader) {
+	mappedBackends["memory"] = func() objectBackend { return downloader }
+	mappedSigners["memory"] = func() URLSigner { return &testSigner{} }
+	t.Cleanup(func() {
+		delete(mappedBackends, "memory")
+		delete(mappedSigners, "memory")
+	})
+}
+
+func TestSigningHandlerProxy(t *testing.T) {
+	registerTestProxy(t, &testDownloader{objects: map[string]string{
+		"a.txt":        "hello proxied world",
+		"signed/b.txt": "redirected",
+		"files/c.txt":  "attached",
+	}})
+	opts := testS3ServerOptions(t, "127.0.0.1:1", `{"routes":[
+		{"prefix":"signed/","signer":"s3v4"},
+		{"prefix":"files/","response":{"download":true,"cache_control":"private","content_type":"text/csv"}}
+	]}`)
+	opts.Opts.ResponseParams = "download,filename"
+	c := newTestServer(t, &testProxyServer{}, opts)
+
+	doRange := func(method, uri, byteRange string) *fasthttp.Response {
+		req := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(req)
+		req.Header.SetMethod(method)
+		req.SetRequestURI(uri)
+		if byteRange != "" {
+			req.Header.Set("Range", byteRange)
+		}
+		resp := &fasthttp.Response{}
+		require.NoError(t, c.Do(req, resp))
+		return resp
+	}
+
+	resp := doRange(http.MethodGet, "http://signer/a.txt", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	require.Equal(t, "hello proxied world", string(resp.Body()))
+	require.Equal(t, "text/plain", string(resp.Header.ContentType()))
+	require.Equal(t, `"etag"`, string(resp.Header.Peek("ETag")))
+	require.Equal(t, "bytes", string(resp.Header.Peek("Accept-Ranges")))
+	require.Equal(t, "Tue, 02 Jan 2024 03:04:05 GMT", string(resp.Header.Peek("Last-Modified")))
+
+	resp = doRange(http.MethodGet, "http://signer/a.txt", "bytes=6-12")
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode())
+	require.Equal(t, "proxied", string(resp.Body()))
+	require.Equal(t, "bytes 6-12/19", string(resp.Header.Peek("Content-Range")))
+
+	resp = doRange(http.MethodGet, "http://signer/a.txt", "bytes=-5")
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode())
+	require.Equal(t, "world", string(resp.Body()))
+
+	// multiple ranges are served whole
+	resp = doRange(http.MethodGet, "http://signer/a.txt", "bytes=0-1,4-5")
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	require.Equal(t, "hello proxied world", string(resp.Body()))
+
+	resp = doRange(http.MethodGet, "http://signer/a.txt", "bytes=19-")
+	require.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode())
+	require.Equal(t, "bytes */19", string(resp.Header.Peek("Content-Range")))
+
+	resp = doRange(http.MethodHead, "http://signer/a.txt", "bytes=0-4")
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode())
+	require.Equal(t, 5, resp.Header.ContentLength())
+	require.Empty(t, resp.Body())
+
+	resp = doRange(http.MethodGet, "http://signer/missing.txt", "")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode())
+
+	// overrides become headers, the signer can't sign them
+	resp = doRange(http.MethodGet, "http://signer/a.txt?download=1&filename=x.txt", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	require.Equal(t, "attachment; filename=x.txt", string(resp.Header.Peek("Content-Disposition")))
+	require.Equal(t, "text/plain", string(resp.Header.ContentType()))
+	resp = doRange(http.MethodGet, "http://signer/files/c.txt", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	require.Equal(t, "attached", string(resp.Body()))
+	require.Equal(t, "attachment; filename=c.txt", string(resp.Header.Peek("Content-Disposition")))
+	require.Equal(t, "private", string(resp.Header.Peek("Cache-Control")))
+	require.Equal(t, "text/csv", string(resp.Header.ContentType()))
+
+	// routes with a signer of their own are redirected
+	resp = doRange(http.MethodGet, "http://signer/signed/b.txt", "")
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+	require.Contains(t, string(resp.Header.Peek("Location")), "/bucket/signed/b.txt")
+
+	// the backend has to stream objects
+	h := &signingHandler{
+		defaultBackend: backendStorjName,
+		backends:       map[string]objectBackend{backendStorjName: &backendAzure{}},
+		routes:         &routeTable{},
+		proxy:          true,
+	}
+	require.Error(t, h.initProxy())
+
+	// proxied objects are the latest version
+	h.backends[backendStorjName] = &testDownloader{}
+	require.NoError(t, h.initProxy())
+	h.opts.VersionQuery = true
+	require.Error(t, h.initProxy())
+	h.opts.VersionQuery = false
+	h.routes = &routeTable{routes: []*route{{Prefix: "v/", Version: &versionRule{Query: true}}}}
+	require.EqualError(t, h.initProxy(), `route "v/": proxied objects can't be versioned`)
+	h.routes.routes[0].Signer = "s3v4"
+	require.NoError(t, h.initProxy())
+}
+
+func TestParallelDownload(t *testing.T) {
+	body := []byte("0123456789abcdefghij")
+	var (
+		mu       sync.Mutex
+		opened   [][2]int64
+		inFlight int32
+		maxAtOne int32
+	)
+	open := func(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		mu.Lock()
+		opened = append(opened, [2]int64{offset, length})
+		if n > maxAtOne {
+			maxAtOne = n
+		}
+		mu.Unlock()
+		// later chunks finish first
+		time.Sleep(time.Duration(20-offset) * time.Millisecond)
+		return io.NopCloser(bytes.NewReader(body[offset : offset+length])), nil
+	}
+
+	rc, err := newParallelDownload(context.Background(), open, 2, 15, 4, 3)
+	require.NoError(t, err)
+	b, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, string(body[2:17]), string(b))
+	require.ElementsMatch(t, [][2]int64{{2, 4}, {6, 4}, {10, 4}, {14, 3}}, opened)
+	require.LessOrEqual(t, maxAtOne, int32(3))
+
+	// a single connection streams
+	opened = nil
+	rc, err = newParallelDownload(context.Background(), open, 0, 20, 4, 1)
+	require.NoError(t, err)
+	require.Equal(t, [][2]int64{{0, 20}}, opened)
+
+	// errors of a chunk end the download
+	failing := func(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+		if offset == 4 {
+			return nil, errors.New("boom")
+		}
+		return open(ctx, offset, length)
+	}
+	rc, err = newParallelDownload(context.Background(), failing, 0, 20, 4, 2)
+	require.NoError(t, err)
+	b, err = io.ReadAll(rc)
+	require.EqualError(t, err, "boom")
+	require.Equal(t, string(body[:4]), string(b))
+	require.NoError(t, rc.Close())
+
+	// short chunks are errors
+	short := func(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body[offset : offset+1])), nil
+	}
+	rc, err = newParallelDownload(context.Background(), short, 0, 20, 4, 2)
+	require.NoError(t, err)
+	_, err = io.ReadAll(rc)
+	require.Error(t, err)
+	require.NoError(t, rc.Close())
+}
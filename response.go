@@ -0,0 +1,194 @@
+package main
+
+import (
+	"mime"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	ErrKind_ResponseOverride = "OBS_RESPONSE_OVERRIDE"
+)
+
+// query parameters translated to signed response overrides
+const (
+	responseParamDownload = "download"
+	responseParamFilename = "filename"
+	responseParamType     = "type"
+)
+
+const maxResponseFilenameLength = 255
+
+var errResponseOverridesUnsupported = errors.New("signer doesn't support response overrides")
+
+// responseRule is a route's response header overrides, allowed query
+// overrides take precedence.
+type responseRule struct {
+	// `Content-Disposition: attachment`
+	Download     bool   `json:"download,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+	CacheControl string `json:"cache_control,omitempty"`
+}
+
+func (rr *responseRule) validate() (err error) {
+	if rr.ContentType != "" {
+		if _, _, err = mime.ParseMediaType(rr.ContentType); err != nil {
+			return errors.Wrap(err, "content type")
+		}
+	}
+	if !validHeaderValue(rr.CacheControl) {
+		return errors.Errorf("invalid cache control %q", rr.CacheControl)
+	}
+	return
+}
+
+// responseOverrides translates allowed query parameters and route
+// rules into signed `response-*` overrides.
+type responseOverrides struct {
+	params map[string]bool
+	// allowed `type` values, `type/*` wildcards
+	types []string
+}
+
+func newResponseOverrides(params, types []string) (_ *responseOverrides, err error) {
+	o := &responseOverrides{params: map[string]bool{}, types: types}
+	for _, p := range params {
+		switch p = strings.ToLower(p); p {
+		case responseParamDownload, responseParamFilename, responseParamType:
+			o.params[p] = true
+		default:
+			return nil, errors.Errorf("unknown response parameter %q", p)
+		}
+	}
+	if o.params[responseParamType] && len(types) == 0 {
+		return nil, errors.Errorf("%q parameter needs allowed types", responseParamType)
+	}
+	for _, t := range types {
+		if _, _, err = mime.ParseMediaType(strings.TrimSuffix(t, "*") + "x"); err != nil {
+			return nil, errors.Errorf("invalid response type %q", t)
+		}
+	}
+	return o, nil
+}
+
+// Of returns the response overrides of a request for key, the query
+// parameters that aren't allowed are rejected.
+func (o *responseOverrides) Of(args *fasthttp.Args, rule *responseRule, key string) (_ url.Values, err error) {
+	var download bool
+	var filename, contentType, cacheControl string
+	if rule != nil {
+		download, contentType, cacheControl = rule.Download, rule.ContentType, rule.CacheControl
+	}
+
+	args.VisitAll(func(k, v []byte) {
+		if err != nil {
+			return
+		}
+		name := string(k)
+		switch name {
+		case responseParamDownload, responseParamFilename, responseParamType:
+			if !o.params[name] {
+				err = errors.Errorf("parameter %q not allowed", name)
+				return
+			}
+		default:
+			// raw overrides would bypass the allowlist
+			if strings.HasPrefix(strings.ToLower(name), "response-") {
+				err = errors.Errorf("parameter %q not allowed", name)
+			}
+			return
+		}
+		value := string(v)
+		switch name {
+		case responseParamDownload:
+			var b bool
+			if b, err = strconv.ParseBool(value); err != nil {
+				err = errors.Errorf("invalid %s %q", name, value)
+				return
+			}
+			download = download || b
+		case responseParamFilename:
+			filename = value
+		case responseParamType:
+			if !matchContentType(o.types, value) {
+				err = errors.Errorf("type %q not allowed", value)
+				return
+			}
+			contentType = value
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	values := url.Values{}
+	if download || filename != "" {
+		disposition := "inline"
+		if download {
+			disposition = "attachment"
+			if filename == "" {
+				filename = path.Base(key)
+			}
+		}
+		if disposition, err = contentDisposition(disposition, filename); err != nil {
+			return
+		}
+		values.Set("response-content-disposition", disposition)
+	}
+	if contentType != "" {
+		values.Set("response-content-type", contentType)
+	}
+	if cacheControl != "" {
+		values.Set("response-cache-control", cacheControl)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	return values, nil
+}
+
+// contentDisposition formats a Content-Disposition header value,
+// non-ASCII filenames are RFC 2231 encoded.
+func contentDisposition(disposition, filename string) (string, error) {
+	if len(filename) > maxResponseFilenameLength || strings.ContainsAny(filename, `/\`) || !validHeaderValue(filename) {
+		return "", errors.Errorf("invalid filename %q", filename)
+	}
+	v := mime.FormatMediaType(disposition, map[string]string{"filename": filename})
+	if v == "" {
+		return "", errors.Errorf("invalid filename %q", filename)
+	}
+	return v, nil
+}
+
+// validHeaderValue reports whether s has no control characters.
+func validHeaderValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// responseOverrideSigner is a URLSigner that signs response overrides
+// into its URLs, other signers can't honor them.
+type responseOverrideSigner interface {
+	URLSigner
+	signsResponseOverrides()
+}
+
+// checkResponseOverrides checks signer honors overrides.
+func checkResponseOverrides(signer URLSigner, overrides url.Values) error {
+	if len(overrides) == 0 {
+		return nil
+	}
+	if _, ok := signer.(responseOverrideSigner); !ok {
+		return errors.Wrapf(errResponseOverridesUnsupported, "signer %q", signer.Name())
+	}
+	return nil
+}
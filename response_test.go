@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+func TestResponseOverrides(t *testing.T) {
+	o, err := newResponseOverrides([]string{"download", "filename", "type"}, []string{"image/*", "text/plain"})
+	require.NoError(t, err)
+	of := func(query string, rule *responseRule) (url.Values, error) {
+		var args fasthttp.Args
+		args.Parse(query)
+		return o.Of(&args, rule, "a/photo.jpg")
+	}
+
+	v, err := of("", nil)
+	require.NoError(t, err)
+	require.Nil(t, v)
+	v, err = of("x=1&download=1", nil)
+	require.NoError(t, err)
+	require.Equal(t, url.Values{"response-content-disposition": {`attachment; filename=photo.jpg`}}, v)
+	v, err = of("filename=my%20photo.jpg", nil)
+	require.NoError(t, err)
+	require.Equal(t, `inline; filename="my photo.jpg"`, v.Get("response-content-disposition"))
+	v, err = of("download=true&filename=caf%C3%A9.jpg&type=image/png", nil)
+	require.NoError(t, err)
+	require.Equal(t, `attachment; filename*=utf-8''caf%C3%A9.jpg`, v.Get("response-content-disposition"))
+	require.Equal(t, "image/png", v.Get("response-content-type"))
+
+	// route rule, query overrides take precedence
+	rule := &responseRule{Download: true, ContentType: "application/octet-stream", CacheControl: "public, max-age=60"}
+	v, err = of("download=0&type=text/plain", rule)
+	require.NoError(t, err)
+	require.Equal(t, url.Values{
+		"response-content-disposition": {`attachment; filename=photo.jpg`},
+		"response-content-type":        {"text/plain"},
+		"response-cache-control":       {"public, max-age=60"},
+	}, v)
+
+	for _, query := range []string{
+		"download=maybe",
+		"type=text/html",
+		"filename=../x",
+		"filename=a%0Ab",
+		"filename=" + strings.Repeat("a", 256),
+		"response-content-type=text/html",
+		"Response-Cache-Control=no-store",
+	} {
+		_, err = of(query, nil)
+		require.Error(t, err, query)
+	}
+
+	o, err = newResponseOverrides([]string{"download"}, nil)
+	require.NoError(t, err)
+	for _, query := range []string{"filename=a.jpg", "type=image/png"} {
+		_, err = of(query, nil)
+		require.Error(t, err, query)
+	}
+
+	_, err = newResponseOverrides([]string{"disposition"}, nil)
+	require.Error(t, err)
+	_, err = newResponseOverrides([]string{"type"}, nil)
+	require.Error(t, err)
+}
+
+func TestSigningHandlerResponseOverrides(t *testing.T) {
+	opts := testFSServerOptions(t, map[string]string{"a.txt": "a", "files/b.txt": "b"}, `{"routes":[
+		{"prefix":"files/","response":{"download":true,"cache_control":"private"}}
+	]}`)
+	opts.Opts.ResponseParams = "download,filename"
+	c := newTestServer(t, &serverFS{}, opts)
+
+	resp := doTestRequest(t, c, http.MethodGet, "http://signer/a.txt?download=1&filename=report.txt")
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+	location := string(resp.Header.Peek("Location"))
+	require.Contains(t, location, "response-content-disposition=")
+	resp = doTestRequest(t, c, http.MethodGet, location)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	require.Equal(t, "attachment; filename=report.txt", string(resp.Header.Peek("Content-Disposition")))
+
+	// tampered override
+	resp = doTestRequest(t, c, http.MethodGet, strings.Replace(location, "attachment", "inline", 1))
+	require.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	// route rule
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer/files/b.txt")
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+	resp = doTestRequest(t, c, http.MethodGet, string(resp.Header.Peek("Location")))
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	require.Equal(t, "attachment; filename=b.txt", string(resp.Header.Peek("Content-Disposition")))
+	require.Equal(t, "private", string(resp.Header.Peek("Cache-Control")))
+
+	for _, uri := range []string{
+		"http://signer/a.txt?type=text/html",
+		"http://signer/a.txt?response-content-type=text/html",
+		"http://signer/a.txt?filename=a%2Fb",
+	} {
+		resp = doTestRequest(t, c, http.MethodGet, uri)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode(), uri)
+	}
+
+	// signers that can't sign overrides fail at init
+	keyFile, _ := newTestRSAKeyFile(t)
+	opts.Opts.RoutesFile = writeTestRoutes(t, `{"routes":[
+		{"prefix":"files/","signer":"cloudfront","response":{"download":true}}
+	]}`)
+	opts.Logger = zap.NewNop()
+	opts.CloudFrontOpts = &obsCloudFrontOptions{KeyPairID: "K2JCJMDEHXQW5F", PrivateKeyFile: keyFile}
+	require.Error(t, (&serverFS{}).Init(context.Background(), opts))
+}
+
+func TestSignerS3ResponseOverrides(t *testing.T) {
+	sopts := testS3ServerOptions(t, "s3.example.com", "")
+	sopts.Opts.URLExpiry = time.Hour
+	overrides := url.Values{"response-content-disposition": {"attachment"}}
+
+	for _, signer := range []URLSigner{&signerS3V2{}, &signerS3V4{}} {
+		require.NoError(t, signer.Init(context.Background(), sopts, newClientPool(sopts)))
+		signed, err := signer.SignURL(context.Background(), signRequest{
+			Method: http.MethodGet, Bucket: "bucket", Key: "a.txt", Expiry: time.Hour,
+		})
+		require.NoError(t, err)
+		withOverrides, err := signer.SignURL(context.Background(), signRequest{
+			Method: http.MethodGet, Bucket: "bucket", Key: "a.txt", Expiry: time.Hour,
+			ResponseOverrides: overrides,
+		})
+		require.NoError(t, err)
+
+		u, err := url.Parse(withOverrides.URL)
+		require.NoError(t, err)
+		require.Equal(t, "attachment", u.Query().Get("response-content-disposition"), signer.Name())
+		sig := func(rawURL string) string {
+			u, _ := url.Parse(rawURL)
+			return u.Query().Get("Signature") + u.Query().Get("X-Amz-Signature")
+		}
+		require.NotEqual(t, sig(signed.URL), sig(withOverrides.URL), signer.Name())
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// route overrides server behavior for object keys under Prefix.
+type route struct {
+	// object key prefix, empty matches every key
+	Prefix string `json:"prefix"`
+	// stat backend, empty uses the server default
+	Backend string `json:"backend,omitempty"`
+	// URL signer, empty uses the server default
+	Signer string `json:"signer,omitempty"`
+	// S3 credential set, empty uses the default credentials
+	Credentials string `json:"credentials,omitempty"`
+	// upload policy, nil uses the server default
+	Upload *uploadPolicy `json:"upload,omitempty"`
+	// signed response header overrides
+	Response *responseRule `json:"response,omitempty"`
+	// static website, nil uses the server website mode
+	Website *websiteRule `json:"website,omitempty"`
+	// directory listing of keys ending with `/`, nil disables
+	Listing *listingRule `json:"listing,omitempty"`
+	// object versions, nil uses the server versions
+	Version *versionRule `json:"version,omitempty"`
+	// immutable keys, their redirects are cached while the URL is valid
+	Immutable *immutableRule `json:"immutable,omitempty"`
+	// CORS of browser clients, nil sends no CORS headers
+	CORS *corsRule `json:"cors,omitempty"`
+}
+
+type routesConfig struct {
+	Routes []*route `json:"routes"`
+}
+
+// routeTable matches object keys against routes by the longest prefix.
+type routeTable struct {
+	routes []*route
+}
+
+func loadRoutes(file string) (rt *routeTable, err error) {
+	rt = &routeTable{}
+	if file == "" {
+		return
+	}
+	var b []byte
+	if b, err = os.ReadFile(file); err != nil {
+		err = errors.Wrap(err, "read routes file")
+		return
+	}
+	var cfg routesConfig
+	if err = json.Unmarshal(b, &cfg); err != nil {
+		err = errors.Wrap(err, "parse routes file")
+		return
+	}
+	for i, r := range cfg.Routes {
+		if r == nil {
+			err = errors.Errorf("route #%d is empty", i)
+			return
+		}
+		r.Prefix = strings.TrimLeft(r.Prefix, "/")
+		if r.Response != nil {
+			if err = r.Response.validate(); err != nil {
+				err = errors.Wrapf(err, "route %q response", r.Prefix)
+				return
+			}
+		}
+		if r.Immutable != nil {
+			if err = r.Immutable.compile(); err != nil {
+				err = errors.Wrapf(err, "route %q immutable", r.Prefix)
+				return
+			}
+		}
+		if r.CORS != nil {
+			if err = r.CORS.validate(); err != nil {
+				err = errors.Wrapf(err, "route %q cors", r.Prefix)
+				return
+			}
+		}
+	}
+	rt.routes = cfg.Routes
+	// longest prefix first
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		return len(rt.routes[i].Prefix) > len(rt.routes[j].Prefix)
+	})
+	return
+}
+
+// Match returns the route of the object key, nil if there's none.
+func (rt *routeTable) Match(key string) *route {
+	if rt == nil {
+		return nil
+	}
+	for _, r := range rt.routes {
+		if strings.HasPrefix(key, r.Prefix) {
+			return r
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoutes(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "routes.json")
+	require.NoError(t, os.WriteFile(fp, []byte(`{"routes":[
+		{"prefix":""},
+		{"prefix":"/cdn/","signer":"cloudfront"},
+		{"prefix":"cdn/private/"}
+	]}`), 0o644))
+
+	rt, err := loadRoutes(fp)
+	require.NoError(t, err)
+	require.Equal(t, "cloudfront", rt.Match("cdn/a.jpg").Signer)
+	require.Equal(t, "cdn/private/", rt.Match("cdn/private/a.jpg").Prefix)
+	require.Equal(t, "", rt.Match("other/a.jpg").Prefix)
+
+	rt, err = loadRoutes("")
+	require.NoError(t, err)
+	require.Nil(t, rt.Match("a.jpg"))
+}
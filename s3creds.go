@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+	"github.com/pkg/errors"
+)
+
+// s3 credential providers, in default chain order
+const (
+	s3CredsStatic      = "static"
+	s3CredsEnv         = "env"
+	s3CredsFile        = "file"
+	s3CredsWebIdentity = "web-identity"
+	s3CredsMetadata    = "metadata"
+)
+
+const defaultS3CredsChain = "static,env,file,web-identity,metadata"
+
+// refresh expiring credentials this long before they expire, so URLs
+// signed right before the refresh are still usable for a while.
+const s3CredsRefreshWindow = 5 * time.Minute
+
+// anonymous results of the chain are retried after this long, a
+// provider may have been down while it was retrieved.
+const s3CredsAnonymousTTL = time.Minute
+
+var errS3CredsNotFound = errors.New("s3 credentials not found")
+
+// s3Creds is a set of S3 credentials, zero Expires never expires.
+type s3Creds struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+func (v s3Creds) anonymous() bool {
+	return v.AccessKeyID == "" || v.SecretAccessKey == ""
+}
+
+// s3CredsProvider retrieves credentials from a source, it returns
+// errS3CredsNotFound when the source isn't configured.
+type s3CredsProvider interface {
+	Name() string
+	Retrieve(ctx context.Context) (s3Creds, error)
+}
+
+// s3CredsSource gives the credentials to sign with.
+type s3CredsSource interface {
+	Get(ctx context.Context) (s3Creds, error)
+}
+
+// s3Credentials caches credentials of a provider and refreshes them
+// before they expire.
+type s3Credentials struct {
+	provider s3CredsProvider
+	now      func() time.Time
+
+	mu          sync.Mutex
+	value       s3Creds
+	retrieved   bool
+	retrievedAt time.Time
+}
+
+func newS3Credentials(provider s3CredsProvider) *s3Credentials {
+	return &s3Credentials{provider: provider, now: time.Now}
+}
+
+func (c *s3Credentials) Get(ctx context.Context) (v s3Creds, err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if c.retrieved && c.fresh(now) {
+		return c.value, nil
+	}
+	if v, err = c.provider.Retrieve(ctx); err != nil {
+		// keep signing with unexpired credentials while the source is down
+		if c.retrieved && now.Before(c.value.Expires) {
+			return c.value, nil
+		}
+		err = errors.Wrapf(err, "s3 credentials %s", c.provider.Name())
+		return
+	}
+	c.value, c.retrieved, c.retrievedAt = v, true, now
+	return
+}
+
+// fresh reports whether the cached credentials are still used at now.
+func (c *s3Credentials) fresh(now time.Time) bool {
+	if c.value.anonymous() {
+		return now.Before(c.retrievedAt.Add(s3CredsAnonymousTTL))
+	}
+	return c.value.Expires.IsZero() || now.Before(c.value.Expires.Add(-s3CredsRefreshWindow))
+}
+
+// s3MinioProvider adapts a credentials source for the minio client,
+// which signs its own requests with V2 as it always did.
+type s3MinioProvider struct {
+	creds s3CredsSource
+}
+
+func (p *s3MinioProvider) Retrieve() (credentials.Value, error) {
+	v, err := p.creds.Get(context.Background())
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	if v.anonymous() {
+		return credentials.Value{SignerType: credentials.SignatureAnonymous}, nil
+	}
+	return credentials.Value{
+		AccessKeyID:     v.AccessKeyID,
+		SecretAccessKey: v.SecretAccessKey,
+		SessionToken:    v.SessionToken,
+		SignerType:      credentials.SignatureV2,
+	}, nil
+}
+
+// IsExpired always asks s3Credentials, which does the caching.
+func (p *s3MinioProvider) IsExpired() bool {
+	return true
+}
+
+func newObsS3Credentials(opts obsS3Options) (_ *s3Credentials, err error) {
+	var chain s3CredsChain
+	for _, name := range splitList(opts.Credentials) {
+		var p s3CredsProvider
+		switch name {
+		case s3CredsStatic:
+			p = &s3StaticCreds{value: s3Creds{
+				AccessKeyID:     opts.AccessKey,
+				SecretAccessKey: opts.SecretKey,
+				SessionToken:    opts.SessionToken,
+			}}
+		case s3CredsEnv:
+			p = &s3EnvCreds{}
+		case s3CredsFile:
+			p = &s3FileCreds{file: opts.CredentialsFile, profile: opts.Profile}
+		case s3CredsWebIdentity:
+			p = &s3WebIdentityCreds{
+				tokenFile:   opts.WebIdentityTokenFile,
+				roleARN:     opts.RoleARN,
+				sessionName: opts.RoleSessionName,
+				sts:         newSTSClient(opts),
+			}
+		case s3CredsMetadata:
+			p = newS3MetadataCreds(opts.MetadataURL)
+		default:
+			err = errors.Errorf("unknown s3 credentials provider %q", name)
+			return
+		}
+		chain = append(chain, p)
+	}
+
+	var provider s3CredsProvider = chain
+	if opts.AssumeRoleARN != "" {
+		provider = &s3AssumeRoleCreds{
+			source:      newS3Credentials(chain),
+			roleARN:     opts.AssumeRoleARN,
+			sessionName: opts.RoleSessionName,
+			duration:    opts.AssumeRoleDuration,
+			sts:         newSTSClient(opts),
+		}
+	}
+	return newS3Credentials(provider), nil
+}
+
+// s3CredsChain returns credentials of the first configured provider,
+// anonymous credentials if none is.
+type s3CredsChain []s3CredsProvider
+
+func (c s3CredsChain) Name() string {
+	return "chain"
+}
+
+func (c s3CredsChain) Retrieve(ctx context.Context) (v s3Creds, err error) {
+	for _, p := range c {
+		if v, err = p.Retrieve(ctx); err == nil {
+			return
+		}
+		if errors.Cause(err) != errS3CredsNotFound {
+			err = errors.Wrap(err, p.Name())
+			return
+		}
+	}
+	return s3Creds{}, nil
+}
+
+type s3StaticCreds struct {
+	value s3Creds
+}
+
+func (p *s3StaticCreds) Name() string {
+	return s3CredsStatic
+}
+
+func (p *s3StaticCreds) Retrieve(ctx context.Context) (s3Creds, error) {
+	if p.value.anonymous() {
+		return s3Creds{}, errS3CredsNotFound
+	}
+	return p.value, nil
+}
+
+// s3EnvCreds reads the same variables as the AWS CLI.
+type s3EnvCreds struct{}
+
+func (p *s3EnvCreds) Name() string {
+	return s3CredsEnv
+}
+
+func (p *s3EnvCreds) Retrieve(ctx context.Context) (v s3Creds, err error) {
+	getenv := func(keys ...string) string {
+		for _, k := range keys {
+			if s := os.Getenv(k); s != "" {
+				return s
+			}
+		}
+		return ""
+	}
+	v = s3Creds{
+		AccessKeyID:     getenv("AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY"),
+		SecretAccessKey: getenv("AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY"),
+		SessionToken:    getenv("AWS_SESSION_TOKEN"),
+	}
+	if v.anonymous() {
+		return s3Creds{}, errS3CredsNotFound
+	}
+	return
+}
+
+// s3FileCreds reads a profile of the shared credentials file.
+type s3FileCreds struct {
+	file    string
+	profile string
+}
+
+func (p *s3FileCreds) Name() string {
+	return s3CredsFile
+}
+
+func (p *s3FileCreds) Retrieve(ctx context.Context) (v s3Creds, err error) {
+	file := p.file
+	if file == "" {
+		var home string
+		if home, err = os.UserHomeDir(); err != nil {
+			return s3Creds{}, errS3CredsNotFound
+		}
+		file = filepath.Join(home, ".aws", "credentials")
+	}
+	if _, err = os.Stat(file); err != nil {
+		if os.IsNotExist(err) {
+			return s3Creds{}, errS3CredsNotFound
+		}
+		return
+	}
+
+	var mv credentials.Value
+	if mv, err = (&credentials.FileAWSCredentials{Filename: file, Profile: p.profile}).Retrieve(); err != nil {
+		return
+	}
+	v = s3Creds{
+		AccessKeyID:     mv.AccessKeyID,
+		SecretAccessKey: mv.SecretAccessKey,
+		SessionToken:    mv.SessionToken,
+	}
+	if v.anonymous() {
+		err = errors.Errorf("profile %q of %s has no keys", p.profile, file)
+	}
+	return
+}
+
+// s3WebIdentityCreds exchanges a web identity token file, as mounted
+// by EKS IRSA, for role credentials.
+type s3WebIdentityCreds struct {
+	tokenFile   string
+	roleARN     string
+	sessionName string
+	sts         *stsClient
+}
+
+func (p *s3WebIdentityCreds) Name() string {
+	return s3CredsWebIdentity
+}
+
+func (p *s3WebIdentityCreds) Retrieve(ctx context.Context) (v s3Creds, err error) {
+	if p.tokenFile == "" || p.roleARN == "" {
+		return s3Creds{}, errS3CredsNotFound
+	}
+	// the token is rotated on disk, read it every time
+	var token []byte
+	if token, err = os.ReadFile(p.tokenFile); err != nil {
+		err = errors.Wrap(err, "read web identity token")
+		return
+	}
+	return p.sts.Call(ctx, url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"RoleArn":          {p.roleARN},
+		"RoleSessionName":  {stsSessionName(p.sessionName)},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}, nil)
+}
+
+// s3AssumeRoleCreds assumes a role with credentials of the source.
+type s3AssumeRoleCreds struct {
+	source      *s3Credentials
+	roleARN     string
+	sessionName string
+	duration    time.Duration
+	sts         *stsClient
+}
+
+func (p *s3AssumeRoleCreds) Name() string {
+	return "assume-role"
+}
+
+func (p *s3AssumeRoleCreds) Retrieve(ctx context.Context) (v s3Creds, err error) {
+	var source s3Creds
+	if source, err = p.source.Get(ctx); err != nil {
+		return
+	}
+	if source.anonymous() {
+		err = errors.New("no source credentials to assume role with")
+		return
+	}
+	form := url.Values{
+		"Action":          {"AssumeRole"},
+		"RoleArn":         {p.roleARN},
+		"RoleSessionName": {stsSessionName(p.sessionName)},
+	}
+	if p.duration > 0 {
+		form.Set("DurationSeconds", strconv.FormatInt(int64(p.duration/time.Second), 10))
+	}
+	return p.sts.Call(ctx, form, &source)
+}
+
+func stsSessionName(name string) string {
+	if name == "" {
+		return "obs-access-signer"
+	}
+	return name
+}
+
+// stsClient calls the AWS STS query API.
+type stsClient struct {
+	endpoint string
+	region   string
+	client   *http.Client
+	now      func() time.Time
+}
+
+func newSTSClient(opts obsS3Options) *stsClient {
+	region := opts.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &stsClient{
+		endpoint: opts.STSEndpoint,
+		region:   region,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		now:      time.Now,
+	}
+}
+
+type stsCredentials struct {
+	AccessKeyID     string    `xml:"AccessKeyId"`
+	SecretAccessKey string    `xml:"SecretAccessKey"`
+	SessionToken    string    `xml:"SessionToken"`
+	Expiration      time.Time `xml:"Expiration"`
+}
+
+type stsResult struct {
+	Credentials stsCredentials `xml:"Credentials"`
+}
+
+type stsResponse struct {
+	AssumeRole        *stsResult `xml:"AssumeRoleResult"`
+	AssumeWebIdentity *stsResult `xml:"AssumeRoleWithWebIdentityResult"`
+}
+
+type stsErrorResponse struct {
+	Error struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+}
+
+// Call posts the form, it is signed when signer credentials are given.
+func (c *stsClient) Call(ctx context.Context, form url.Values, signer *s3Creds) (v s3Creds, err error) {
+	form.Set("Version", "2011-06-15")
+	body := []byte(form.Encode())
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body)); err != nil {
+		err = errors.Wrap(err, "sts request")
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if signer != nil {
+		signV4Request(req, body, "sts", c.region, *signer, c.now())
+	}
+
+	var resp *http.Response
+	if resp, err = c.client.Do(req); err != nil {
+		err = errors.Wrap(err, "sts")
+		return
+	}
+	defer resp.Body.Close()
+	var b []byte
+	if b, err = io.ReadAll(resp.Body); err != nil {
+		err = errors.Wrap(err, "sts read response")
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		var er stsErrorResponse
+		if xml.Unmarshal(b, &er) == nil && er.Error.Code != "" {
+			err = errors.Errorf("sts %s: %s", er.Error.Code, er.Error.Message)
+			return
+		}
+		err = errors.Errorf("sts: %s", resp.Status)
+		return
+	}
+
+	var sr stsResponse
+	if err = xml.Unmarshal(b, &sr); err != nil {
+		err = errors.Wrap(err, "sts decode response")
+		return
+	}
+	result := sr.AssumeRole
+	if result == nil {
+		result = sr.AssumeWebIdentity
+	}
+	if result == nil {
+		err = errors.New("sts: no credentials in response")
+		return
+	}
+	return s3Creds{
+		AccessKeyID:     result.Credentials.AccessKeyID,
+		SecretAccessKey: result.Credentials.SecretAccessKey,
+		SessionToken:    result.Credentials.SessionToken,
+		Expires:         result.Credentials.Expiration,
+	}, nil
+}
+
+// s3MetadataCreds reads role credentials from the ECS container
+// endpoint when configured by the agent, else from EC2 IMDS.
+type s3MetadataCreds struct {
+	endpoint string // EC2 IMDS base URL
+	ecsURL   string
+	ecsToken string
+	client   *http.Client
+}
+
+func newS3MetadataCreds(endpoint string) *s3MetadataCreds {
+	p := &s3MetadataCreds{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		ecsToken: os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"),
+		// metadata endpoints are link local, don't stall when absent
+		client: &http.Client{Timeout: 2 * time.Second},
+	}
+	if s := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); s != "" {
+		p.ecsURL = s
+	} else if s := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); s != "" {
+		p.ecsURL = "http://169.254.170.2" + s
+	}
+	return p
+}
+
+func (p *s3MetadataCreds) Name() string {
+	return s3CredsMetadata
+}
+
+// metadataCredentials is the credentials document of ECS and EC2.
+type metadataCredentials struct {
+	Code            string    `json:"Code"`
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func (p *s3MetadataCreds) Retrieve(ctx context.Context) (v s3Creds, err error) {
+	var mc metadataCredentials
+	if p.ecsURL != "" {
+		header := http.Header{}
+		if p.ecsToken != "" {
+			header.Set("Authorization", p.ecsToken)
+		}
+		var b []byte
+		if b, err = p.get(ctx, p.ecsURL, header); err != nil {
+			err = errors.Wrap(err, "ecs credentials")
+			return
+		}
+		if err = json.Unmarshal(b, &mc); err != nil {
+			err = errors.Wrap(err, "ecs credentials decode")
+			return
+		}
+	} else if mc, err = p.retrieveEC2(ctx); err != nil {
+		return
+	}
+
+	if mc.Code != "" && mc.Code != "Success" {
+		err = errors.Errorf("metadata credentials: %s", mc.Code)
+		return
+	}
+	return s3Creds{
+		AccessKeyID:     mc.AccessKeyID,
+		SecretAccessKey: mc.SecretAccessKey,
+		SessionToken:    mc.Token,
+		Expires:         mc.Expiration,
+	}, nil
+}
+
+func (p *s3MetadataCreds) retrieveEC2(ctx context.Context) (mc metadataCredentials, err error) {
+	header := http.Header{}
+	// IMDSv2 session token, fall back to IMDSv1 when it's refused
+	var token string
+	if token, err = p.imdsToken(ctx); err != nil {
+		err = p.unreachable(ctx, err, "ec2 metadata token")
+		return
+	}
+	if token != "" {
+		header.Set("X-aws-ec2-metadata-token", token)
+	}
+
+	base := p.endpoint + "/latest/meta-data/iam/security-credentials/"
+	var b []byte
+	if b, err = p.get(ctx, base, header); err != nil {
+		err = p.unreachable(ctx, err, "ec2 role")
+		return
+	}
+	role := strings.TrimSpace(strings.SplitN(string(b), "\n", 2)[0])
+	if role == "" {
+		err = errors.Wrap(errS3CredsNotFound, "no ec2 instance role")
+		return
+	}
+	if b, err = p.get(ctx, base+url.PathEscape(role), header); err != nil {
+		err = errors.Wrap(err, "ec2 role credentials")
+		return
+	}
+	if err = json.Unmarshal(b, &mc); err != nil {
+		err = errors.Wrap(err, "ec2 role credentials decode")
+		return
+	}
+	return
+}
+
+// unreachable wraps err of an IMDS request, a metadata service that
+// can't be reached means there's no instance role, so the chain
+// signs anonymously and caches that instead of failing every request.
+func (p *s3MetadataCreds) unreachable(ctx context.Context, err error, msg string) error {
+	if _, ok := err.(*url.Error); ok && ctx.Err() == nil {
+		return errors.Wrapf(errS3CredsNotFound, "%s: %v", msg, err)
+	}
+	return errors.Wrap(err, msg)
+}
+
+func (p *s3MetadataCreds) imdsToken(ctx context.Context) (token string, err error) {
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPut, p.endpoint+"/latest/api/token", nil); err != nil {
+		return
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	var resp *http.Response
+	if resp, err = p.client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil
+	}
+	var b []byte
+	if b, err = io.ReadAll(resp.Body); err != nil {
+		return
+	}
+	return string(b), nil
+}
+
+func (p *s3MetadataCreds) get(ctx context.Context, u string, header http.Header) (b []byte, err error) {
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil); err != nil {
+		return
+	}
+	req.Header = header
+	var resp *http.Response
+	if resp, err = p.client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// e.g. no instance role
+		err = errors.Wrapf(errS3CredsNotFound, "metadata %s", u)
+		return
+	default:
+		err = errors.Errorf("metadata: %s", resp.Status)
+		return
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// signV4Request signs the request with an AWS V4 Authorization header.
+func signV4Request(req *http.Request, body []byte, service, region string, v s3Creds, now time.Time) {
+	now = now.UTC()
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", now.Format(s3V4DateFormat))
+	if v.SessionToken != "" {
+		req.Header.Set(s3SecurityTokenV4, v.SessionToken)
+	}
+
+	headers := map[string]string{}
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "content-type" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = req.Header.Get(k)
+		}
+	}
+	canonicalHeaders, signedHeaders := s3V4CanonicalHeaders(req.URL.Host, headers)
+
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3utils.EncodePath(path),
+		s3V4CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := s3V4Scope(now, region, service)
+	signature := s3V4Signature(v.SecretAccessKey, now, region, service, s3V4StringToSign(now, scope, canonicalRequest))
+	req.Header.Set("Authorization", s3V4Algorithm+
+		" Credential="+v.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignV4RequestAWSExample(t *testing.T) {
+	// https://docs.aws.amazon.com/general/latest/gr/sigv4-create-canonical-request.html
+	req, err := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signV4Request(req, nil, "iam", "us-east-1", s3Creds{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	require.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, "+
+		"SignedHeaders=content-type;host;x-amz-date, "+
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7", req.Header.Get("Authorization"))
+}
+
+func TestS3CredsChain(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_ACCESS_KEY", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_SECRET_KEY", "")
+	opts := defaultObsS3Opts
+	opts.Credentials = "static,env,file"
+	opts.CredentialsFile = filepath.Join(t.TempDir(), "missing")
+
+	// nothing configured is anonymous
+	creds, err := newObsS3Credentials(opts)
+	require.NoError(t, err)
+	v, err := creds.Get(context.Background())
+	require.NoError(t, err)
+	require.True(t, v.anonymous())
+
+	// env
+	t.Setenv("AWS_ACCESS_KEY_ID", "env-access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+	creds, err = newObsS3Credentials(opts)
+	require.NoError(t, err)
+	v, err = creds.Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "env-access", v.AccessKeyID)
+
+	// static comes first
+	opts.AccessKey, opts.SecretKey = "static-access", "static-secret"
+	creds, err = newObsS3Credentials(opts)
+	require.NoError(t, err)
+	v, err = creds.Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "static-access", v.AccessKeyID)
+
+	opts.Credentials = "static,bogus"
+	_, err = newObsS3Credentials(opts)
+	require.Error(t, err)
+}
+
+func TestS3CredsFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "credentials")
+	require.NoError(t, os.WriteFile(file, []byte(`[default]
+aws_access_key_id = default-access
+aws_secret_access_key = default-secret
+
+[other]
+aws_access_key_id = other-access
+aws_secret_access_key = other-secret
+aws_session_token = other-token
+`), 0o600))
+
+	v, err := (&s3FileCreds{file: file, profile: "other"}).Retrieve(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, s3Creds{AccessKeyID: "other-access", SecretAccessKey: "other-secret", SessionToken: "other-token"}, v)
+
+	_, err = (&s3FileCreds{file: file, profile: "missing"}).Retrieve(context.Background())
+	require.Error(t, err)
+	require.NotEqual(t, errS3CredsNotFound, errors.Cause(err))
+}
+
+type testS3CredsProvider struct {
+	calls int
+	value s3Creds
+	err   error
+}
+
+func (p *testS3CredsProvider) Name() string { return "test" }
+func (p *testS3CredsProvider) Retrieve(ctx context.Context) (s3Creds, error) {
+	p.calls++
+	return p.value, p.err
+}
+
+func TestS3CredentialsRefresh(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := &testS3CredsProvider{value: s3Creds{AccessKeyID: "a", SecretAccessKey: "s", Expires: now.Add(time.Hour)}}
+	creds := newS3Credentials(p)
+	creds.now = func() time.Time { return now }
+
+	_, err := creds.Get(context.Background())
+	require.NoError(t, err)
+	_, err = creds.Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, p.calls)
+
+	// within the refresh window
+	now = now.Add(time.Hour - s3CredsRefreshWindow + time.Second)
+	_, err = creds.Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, p.calls)
+
+	// refresh failures keep unexpired credentials
+	p.err = errors.New("sts down")
+	v, err := creds.Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "a", v.AccessKeyID)
+
+	now = now.Add(time.Hour)
+	_, err = creds.Get(context.Background())
+	require.Error(t, err)
+}
+
+func TestS3CredentialsAnonymousRetry(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := &testS3CredsProvider{}
+	creds := newS3Credentials(p)
+	creds.now = func() time.Time { return now }
+
+	v, err := creds.Get(context.Background())
+	require.NoError(t, err)
+	require.True(t, v.anonymous())
+	_, err = creds.Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, p.calls)
+
+	// retried once the anonymous result is stale
+	p.value = s3Creds{AccessKeyID: "a", SecretAccessKey: "s"}
+	now = now.Add(s3CredsAnonymousTTL)
+	v, err = creds.Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "a", v.AccessKeyID)
+	require.Equal(t, 2, p.calls)
+}
+
+func TestS3MetadataCredsEC2(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			fmt.Fprint(w, "imds-token")
+		case r.Header.Get("X-aws-ec2-metadata-token") != "imds-token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "my-role\n")
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/my-role":
+			fmt.Fprintf(w, `{"Code":"Success","AccessKeyId":"ec2-access","SecretAccessKey":"ec2-secret","Token":"ec2-token","Expiration":%q}`,
+				expiration.Format(time.RFC3339))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	v, err := newS3MetadataCreds(srv.URL).Retrieve(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, s3Creds{
+		AccessKeyID:     "ec2-access",
+		SecretAccessKey: "ec2-secret",
+		SessionToken:    "ec2-token",
+		Expires:         expiration,
+	}, v)
+}
+
+func TestS3MetadataCredsUnavailable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	// outside EC2 there's no metadata service to reach
+	_, err := newS3MetadataCreds(srv.URL).Retrieve(context.Background())
+	require.Equal(t, errS3CredsNotFound, errors.Cause(err))
+
+	// a canceled request isn't telling there's no instance role
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = newS3MetadataCreds(srv.URL).Retrieve(ctx)
+	require.Error(t, err)
+	require.NotEqual(t, errS3CredsNotFound, errors.Cause(err))
+
+	noRole := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			fmt.Fprint(w, "imds-token")
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer noRole.Close()
+	_, err = newS3MetadataCreds(noRole.URL).Retrieve(context.Background())
+	require.Equal(t, errS3CredsNotFound, errors.Cause(err))
+}
+
+func TestS3MetadataCredsUnreachableCached(t *testing.T) {
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	// drops every connection like a filtered link local address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	var dials int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&dials, 1)
+			c.Close()
+		}
+	}()
+
+	creds, err := newObsS3Credentials(obsS3Options{
+		Credentials: s3CredsMetadata,
+		MetadataURL: "http://" + l.Addr().String(),
+	})
+	require.NoError(t, err)
+	p, err := newS3Presigner("s3.amazonaws.com", true, "", "", creds)
+	require.NoError(t, err)
+
+	now := time.Now()
+	u, _, err := p.PresignV4(context.Background(), http.MethodGet, "bucket", "file.jpg", nil, now.Add(time.Hour), now)
+	require.NoError(t, err)
+	require.Empty(t, u.Query().Get("X-Amz-Signature"))
+	require.NotZero(t, atomic.LoadInt32(&dials))
+
+	// the anonymous result is cached, later requests don't dial again
+	dialed := atomic.LoadInt32(&dials)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		u, _, err = p.PresignV4(context.Background(), http.MethodGet, "bucket", "file.jpg", nil, now.Add(time.Hour), now)
+		require.NoError(t, err)
+		require.Empty(t, u.Query().Get("X-Amz-Signature"))
+	}
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, dialed, atomic.LoadInt32(&dials))
+}
+
+func newTestSTSServer(t *testing.T, check func(r *http.Request)) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		check(r)
+		action := r.PostForm.Get("Action")
+		fmt.Fprintf(w, `<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <%[1]sResult>
+    <Credentials>
+      <AccessKeyId>sts-access</AccessKeyId>
+      <SecretAccessKey>sts-secret</SecretAccessKey>
+      <SessionToken>sts-token</SessionToken>
+      <Expiration>2030-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </%[1]sResult>
+</%[1]sResponse>`, action)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestS3WebIdentityCreds(t *testing.T) {
+	srv := newTestSTSServer(t, func(r *http.Request) {
+		require.Equal(t, "AssumeRoleWithWebIdentity", r.PostForm.Get("Action"))
+		require.Equal(t, "arn:aws:iam::123456789012:role/signer", r.PostForm.Get("RoleArn"))
+		require.Equal(t, "jwt-token", r.PostForm.Get("WebIdentityToken"))
+		require.Empty(t, r.Header.Get("Authorization"))
+	})
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("jwt-token\n"), 0o600))
+	opts := defaultObsS3Opts
+	opts.STSEndpoint = srv.URL
+	v, err := (&s3WebIdentityCreds{
+		tokenFile: tokenFile,
+		roleARN:   "arn:aws:iam::123456789012:role/signer",
+		sts:       newSTSClient(opts),
+	}).Retrieve(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, s3Creds{
+		AccessKeyID:     "sts-access",
+		SecretAccessKey: "sts-secret",
+		SessionToken:    "sts-token",
+		Expires:         time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+	}, v)
+}
+
+func TestS3AssumeRoleCreds(t *testing.T) {
+	srv := newTestSTSServer(t, func(r *http.Request) {
+		require.Equal(t, "AssumeRole", r.PostForm.Get("Action"))
+		require.Equal(t, "900", r.PostForm.Get("DurationSeconds"))
+		require.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=source-access/"))
+		require.Contains(t, r.Header.Get("Authorization"), "/sts/aws4_request")
+		require.Equal(t, "source-token", r.Header.Get("X-Amz-Security-Token"))
+	})
+
+	opts := defaultObsS3Opts
+	opts.Credentials = s3CredsStatic
+	opts.AccessKey, opts.SecretKey, opts.SessionToken = "source-access", "source-secret", "source-token"
+	opts.AssumeRoleARN = "arn:aws:iam::123456789012:role/signer"
+	opts.AssumeRoleDuration = 15 * time.Minute
+	opts.STSEndpoint = srv.URL
+	creds, err := newObsS3Credentials(opts)
+	require.NoError(t, err)
+	v, err := creds.Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "sts-access", v.AccessKeyID)
+}
+
+func TestS3PresignTemporaryCredentials(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	value := testS3Value
+	value.SessionToken = "session-token"
+	value.Expires = now.Add(30 * time.Minute)
+	creds := newS3Credentials(&s3StaticCreds{value: value})
+	creds.now = func() time.Time { return now }
+
+	p, err := newS3Presigner("s3.amazonaws.com", true, "", "", creds)
+	require.NoError(t, err)
+
+	// URLs don't outlive the session
+	u, expireAt, err := p.PresignV4(context.Background(), http.MethodGet, "bucket", "file.jpg", nil, now.Add(time.Hour), now)
+	require.NoError(t, err)
+	require.Equal(t, value.Expires, expireAt)
+	require.Equal(t, "1800", u.Query().Get("X-Amz-Expires"))
+	require.Equal(t, "session-token", u.Query().Get("X-Amz-Security-Token"))
+
+	u, expireAt, err = p.PresignV2(context.Background(), http.MethodGet, "bucket", "file.jpg", nil, time.Time{})
+	require.NoError(t, err)
+	require.Equal(t, value.Expires, expireAt)
+	require.Equal(t, fmt.Sprint(value.Expires.Unix()), u.Query().Get("Expires"))
+	require.Equal(t, "session-token", u.Query().Get("x-amz-security-token"))
+}
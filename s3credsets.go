@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// credential key status within a set, rotation goes
+// pending -> active -> retiring -> removed from the file.
+const (
+	s3KeyPending  = "pending"  // deployed, not signing yet
+	s3KeyActive   = "active"   // signs URLs, one per set
+	s3KeyRetiring = "retiring" // health checked only
+)
+
+type s3CredentialKey struct {
+	AccessKey    string `json:"access_key"`
+	SecretKey    string `json:"secret_key"`
+	SessionToken string `json:"session_token,omitempty"`
+	// empty is active
+	Status string `json:"status,omitempty"`
+}
+
+func (k *s3CredentialKey) creds() s3Creds {
+	return s3Creds{
+		AccessKeyID:     k.AccessKey,
+		SecretAccessKey: k.SecretKey,
+		SessionToken:    k.SessionToken,
+	}
+}
+
+type s3CredentialSet struct {
+	Keys []*s3CredentialKey `json:"keys"`
+
+	active *s3CredentialKey
+}
+
+type s3CredentialSetsConfig struct {
+	Sets map[string]*s3CredentialSet `json:"sets"`
+}
+
+func loadS3CredentialSets(file string) (cfg *s3CredentialSetsConfig, err error) {
+	var b []byte
+	if b, err = os.ReadFile(file); err != nil {
+		err = errors.Wrap(err, "read credential sets file")
+		return
+	}
+	cfg = &s3CredentialSetsConfig{}
+	if err = json.Unmarshal(b, cfg); err != nil {
+		err = errors.Wrap(err, "parse credential sets file")
+		return
+	}
+	for name, set := range cfg.Sets {
+		if set == nil || len(set.Keys) == 0 {
+			err = errors.Errorf("credential set %q has no keys", name)
+			return
+		}
+		for i, k := range set.Keys {
+			if k == nil || k.AccessKey == "" || k.SecretKey == "" {
+				err = errors.Errorf("credential set %q key #%d has no access or secret key", name, i)
+				return
+			}
+			switch k.Status {
+			case "":
+				k.Status = s3KeyActive
+			case s3KeyActive, s3KeyPending, s3KeyRetiring:
+			default:
+				err = errors.Errorf("credential set %q key %s has unknown status %q", name, k.AccessKey, k.Status)
+				return
+			}
+			if k.Status != s3KeyActive {
+				continue
+			}
+			if set.active != nil {
+				err = errors.Errorf("credential set %q has more than one active key", name)
+				return
+			}
+			set.active = k
+		}
+		if set.active == nil {
+			err = errors.Errorf("credential set %q has no active key", name)
+			return
+		}
+	}
+	return
+}
+
+// s3CredentialSets holds named credential sets of a file, reloaded when
+// the file changes.
+type s3CredentialSets struct {
+	file   string
+	logger *zap.SugaredLogger
+
+	mu      sync.RWMutex
+	cfg     *s3CredentialSetsConfig
+	modTime time.Time
+	// sets named by routes, a reload can't drop them
+	required map[string]bool
+}
+
+func newObsS3CredentialSets(ctx context.Context, opts obsS3Options, logger *zap.Logger) (s *s3CredentialSets, err error) {
+	if opts.CredentialSetsFile == "" {
+		err = errors.New("no credential sets file configured")
+		return
+	}
+	s = &s3CredentialSets{
+		file:     opts.CredentialSetsFile,
+		logger:   logger.Named("s3-credential-sets").Sugar(),
+		required: map[string]bool{},
+	}
+	if _, err = s.Reload(); err != nil {
+		return
+	}
+	if opts.CredentialSetsReload > 0 {
+		go s.watch(ctx, opts.CredentialSetsReload)
+	}
+	return
+}
+
+// Reload reloads the file if it changed since the last load, a broken
+// file keeps the previous sets.
+func (s *s3CredentialSets) Reload() (reloaded bool, err error) {
+	var fi os.FileInfo
+	if fi, err = os.Stat(s.file); err != nil {
+		err = errors.Wrap(err, "stat credential sets file")
+		return
+	}
+	s.mu.RLock()
+	unchanged := s.cfg != nil && fi.ModTime().Equal(s.modTime)
+	s.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	var cfg *s3CredentialSetsConfig
+	if cfg, err = loadS3CredentialSets(s.file); err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.required {
+		if _, exist := cfg.Sets[name]; !exist {
+			err = errors.Errorf("credential set %q is used by routes", name)
+			return
+		}
+	}
+	s.cfg, s.modTime = cfg, fi.ModTime()
+	return true, nil
+}
+
+func (s *s3CredentialSets) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reloaded, err := s.Reload()
+		if err != nil {
+			s.logger.Errorw("reload credential sets, keeping previous sets",
+				"file", s.file,
+				"err", err)
+			continue
+		}
+		if reloaded {
+			s.logger.Infow("reloaded credential sets",
+				"file", s.file)
+		}
+	}
+}
+
+// Require fails if the set doesn't exist, else reloads can't drop it.
+func (s *s3CredentialSets) Require(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exist := s.cfg.Sets[name]; !exist {
+		return errors.Errorf("unknown credential set %q", name)
+	}
+	s.required[name] = true
+	return nil
+}
+
+// Source returns the credentials source of the active key of a set,
+// it follows reloads.
+func (s *s3CredentialSets) Source(name string) s3CredsSource {
+	return &s3CredentialSetSource{sets: s, name: name}
+}
+
+type s3CredentialSetSource struct {
+	sets *s3CredentialSets
+	name string
+}
+
+func (src *s3CredentialSetSource) Get(ctx context.Context) (s3Creds, error) {
+	src.sets.mu.RLock()
+	defer src.sets.mu.RUnlock()
+	set, exist := src.sets.cfg.Sets[src.name]
+	if !exist {
+		return s3Creds{}, errors.Errorf("unknown credential set %q", src.name)
+	}
+	return set.active.creds(), nil
+}
+
+// Check checks every key of every set, retiring keys included. A set is
+// `failed` when its active key fails, healthy is false when any set is.
+// Failing keys are logged only, the report is public.
+func (s *s3CredentialSets) Check(ctx context.Context, check func(ctx context.Context, v s3Creds) error) (report map[string]string, healthy bool) {
+	s.mu.RLock()
+	cfg := s.cfg
+	s.mu.RUnlock()
+
+	names := make([]string, 0, len(cfg.Sets))
+	for name := range cfg.Sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report = map[string]string{}
+	healthy = true
+	for _, name := range names {
+		report[name] = "ok"
+		for _, k := range cfg.Sets[name].Keys {
+			err := check(ctx, k.creds())
+			if err == nil {
+				continue
+			}
+			s.logger.Warnw("credential key check",
+				"set", name,
+				"accessKey", k.AccessKey,
+				"status", k.Status,
+				"err", err)
+			if k.Status == s3KeyActive {
+				report[name] = "failed"
+				healthy = false
+			}
+		}
+	}
+	return
+}
+
+// newS3KeyChecker checks keys with a presigned HEAD of the bucket.
+func newS3KeyChecker(opts obsS3Options, bucket string) (_ func(ctx context.Context, v s3Creds) error, err error) {
+	var ps *s3Presigner
+	if ps, err = newS3Presigner(opts.Endpoint, opts.Secure, opts.Region, opts.BucketLookup, nil); err != nil {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(ctx context.Context, v s3Creds) (err error) {
+		now := time.Now()
+		var u *url.URL
+		if u, _, err = ps.withCredentials(&s3StaticSource{value: v}).PresignV4(ctx, http.MethodHead, bucket, "", nil, now.Add(time.Minute), now); err != nil {
+			return
+		}
+		var req *http.Request
+		if req, err = http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil); err != nil {
+			return
+		}
+		var resp *http.Response
+		if resp, err = client.Do(req); err != nil {
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("head bucket: %s", resp.Status)
+		}
+		return
+	}, nil
+}
+
+// s3StaticSource is a fixed credentials source.
+type s3StaticSource struct {
+	value s3Creds
+}
+
+func (src *s3StaticSource) Get(ctx context.Context) (s3Creds, error) {
+	return src.value, nil
+}
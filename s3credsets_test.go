@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func writeTestCredentialSets(t *testing.T, file, content string) {
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+	// reload compares modification times, make every write visible
+	mtime := time.Now().Add(time.Duration(len(content)) * time.Second)
+	require.NoError(t, os.Chtimes(file, mtime, mtime))
+}
+
+func TestLoadS3CredentialSets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sets.json")
+	for _, c := range []struct {
+		content string
+		ok      bool
+	}{
+		{`{"sets":{"a":{"keys":[{"access_key":"A","secret_key":"S"}]}}}`, true},
+		{`{"sets":{"a":{"keys":[{"access_key":"A","secret_key":"S","status":"retiring"},{"access_key":"B","secret_key":"S"}]}}}`, true},
+		{`{"sets":{"a":{"keys":[{"access_key":"A","secret_key":"S"},{"access_key":"B","secret_key":"S"}]}}}`, false},
+		{`{"sets":{"a":{"keys":[{"access_key":"A","secret_key":"S","status":"pending"}]}}}`, false},
+		{`{"sets":{"a":{"keys":[{"access_key":"A","secret_key":"S","status":"bogus"}]}}}`, false},
+		{`{"sets":{"a":{"keys":[{"access_key":"A"}]}}}`, false},
+		{`{"sets":{"a":{"keys":[]}}}`, false},
+	} {
+		require.NoError(t, os.WriteFile(file, []byte(c.content), 0o600))
+		_, err := loadS3CredentialSets(file)
+		require.Equal(t, c.ok, err == nil, c.content)
+	}
+}
+
+func TestS3CredentialSetsRotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sets.json")
+	writeTestCredentialSets(t, file, `{"sets":{"main":{"keys":[
+		{"access_key":"OLD","secret_key":"old-secret"}
+	]}}}`)
+
+	opts := defaultObsS3Opts
+	opts.CredentialSetsFile = file
+	opts.CredentialSetsReload = 0
+	sets, err := newObsS3CredentialSets(context.Background(), opts, zap.NewNop())
+	require.NoError(t, err)
+	src := sets.Source("main")
+
+	v, err := src.Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "OLD", v.AccessKeyID)
+
+	// overlap, the new key is deployed first
+	writeTestCredentialSets(t, file, `{"sets":{"main":{"keys":[
+		{"access_key":"OLD","secret_key":"old-secret"},
+		{"access_key":"NEW","secret_key":"new-secret","status":"pending"}
+	]}}}`)
+	reloaded, err := sets.Reload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+	v, err = src.Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "OLD", v.AccessKeyID)
+
+	// then activated
+	writeTestCredentialSets(t, file, `{"sets":{"main":{"keys":[
+		{"access_key":"OLD","secret_key":"old-secret","status":"retiring"},
+		{"access_key":"NEW","secret_key":"new-secret","status":"active"}
+	]}}}`)
+	_, err = sets.Reload()
+	require.NoError(t, err)
+	v, err = src.Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "NEW", v.AccessKeyID)
+
+	// unchanged file isn't reloaded
+	reloaded, err = sets.Reload()
+	require.NoError(t, err)
+	require.False(t, reloaded)
+
+	// broken file keeps the previous sets
+	writeTestCredentialSets(t, file, `{"sets":{"main":{"keys":[{"access_key":"NEW","secret_key":"s"},{"access_key":"X","secret_key":"s"}]}}}`)
+	_, err = sets.Reload()
+	require.Error(t, err)
+	v, err = src.Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "NEW", v.AccessKeyID)
+
+	_, err = sets.Source("missing").Get(context.Background())
+	require.Error(t, err)
+}
+
+func TestS3CredentialSetsCheck(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sets.json")
+	writeTestCredentialSets(t, file, `{"sets":{"main":{"keys":[
+		{"access_key":"OLD","secret_key":"s","status":"retiring"},
+		{"access_key":"NEW","secret_key":"s"}
+	]}}}`)
+	opts := defaultObsS3Opts
+	opts.CredentialSetsFile = file
+	opts.CredentialSetsReload = 0
+	sets, err := newObsS3CredentialSets(context.Background(), opts, zap.NewNop())
+	require.NoError(t, err)
+
+	failing := map[string]bool{}
+	check := func(ctx context.Context, v s3Creds) error {
+		if failing[v.AccessKeyID] {
+			return errors.New("access denied")
+		}
+		return nil
+	}
+
+	// a revoked retiring key doesn't fail the set
+	failing["OLD"] = true
+	report, healthy := sets.Check(context.Background(), check)
+	require.True(t, healthy)
+	require.Equal(t, map[string]string{"main": "ok"}, report)
+
+	failing["NEW"] = true
+	report, healthy = sets.Check(context.Background(), check)
+	require.False(t, healthy)
+	require.Equal(t, map[string]string{"main": "failed"}, report)
+}
+
+func TestS3CredentialSetsRequire(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sets.json")
+	writeTestCredentialSets(t, file, `{"sets":{"main":{"keys":[{"access_key":"A","secret_key":"s"}]},"other":{"keys":[{"access_key":"B","secret_key":"s"}]}}}`)
+	opts := defaultObsS3Opts
+	opts.CredentialSetsFile = file
+	opts.CredentialSetsReload = 0
+	sets, err := newObsS3CredentialSets(context.Background(), opts, zap.NewNop())
+	require.NoError(t, err)
+	require.Error(t, sets.Require("missing"))
+	require.NoError(t, sets.Require("main"))
+
+	// sets named by routes can't be dropped
+	writeTestCredentialSets(t, file, `{"sets":{"other":{"keys":[{"access_key":"B","secret_key":"s"}]}}}`)
+	_, err = sets.Reload()
+	require.Error(t, err)
+	v, err := sets.Source("main").Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "A", v.AccessKeyID)
+
+	writeTestCredentialSets(t, file, `{"sets":{"main":{"keys":[{"access_key":"C","secret_key":"s"}]}}}`)
+	reloaded, err := sets.Reload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+}
+
+func TestSigningHandlerCredentialSets(t *testing.T) {
+	// fake S3 accepting only the NEW key
+	s3srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Query().Get("X-Amz-Credential"), "NEW/") {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer s3srv.Close()
+	s3URL, _ := url.Parse(s3srv.URL)
+
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "private"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "private", "a.txt"), []byte("a"), 0o644))
+
+	setsFile := filepath.Join(t.TempDir(), "sets.json")
+	writeTestCredentialSets(t, setsFile, `{"sets":{"private":{"keys":[
+		{"access_key":"OLD","secret_key":"s","status":"retiring"},
+		{"access_key":"NEW","secret_key":"s"}
+	]}}}`)
+	routesFile := filepath.Join(t.TempDir(), "routes.json")
+	require.NoError(t, os.WriteFile(routesFile, []byte(`{"routes":[
+		{"prefix":"private/","signer":"s3v4","credentials":"private"}
+	]}`), 0o644))
+
+	opts := defaultObsOpts
+	opts.BucketName = "bucket"
+	opts.URLExpiry = time.Hour
+	opts.HostRedirect = "s3.example.com"
+	opts.RoutesFile = routesFile
+	opts.HealthPath = "/_health"
+	s3opts := defaultObsS3Opts
+	s3opts.Endpoint = s3URL.Host
+	s3opts.BucketLookup = s3BucketLookupPath
+	s3opts.Credentials = s3CredsStatic
+	s3opts.CredentialSetsFile = setsFile
+	s3opts.CredentialSetsReload = 0
+	c := newTestServer(t, &serverFS{}, serverOptions{
+		Opts:   &opts,
+		S3Opts: &s3opts,
+		FSOpts: &obsFSOptions{Root: root, Secret: "test"},
+	})
+
+	resp := doTestRequest(t, c, http.MethodGet, "http://signer/private/a.txt")
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+	location, err := url.Parse(string(resp.Header.Peek("Location")))
+	require.NoError(t, err)
+	require.Equal(t, "s3.example.com", location.Host)
+	require.True(t, strings.HasPrefix(location.Query().Get("X-Amz-Credential"), "NEW/"))
+
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer/_health")
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	var report healthReport
+	require.NoError(t, json.Unmarshal(resp.Body(), &report))
+	require.Equal(t, "ok", report.Status)
+	require.Equal(t, map[string]string{"private": "ok"}, report.CredentialSets)
+	require.NotContains(t, string(resp.Body()), "OLD")
+
+	// unknown credential set fails at init
+	require.NoError(t, os.WriteFile(routesFile, []byte(`{"routes":[{"prefix":"x/","signer":"s3v4","credentials":"missing"}]}`), 0o644))
+	require.Error(t, (&serverFS{}).Init(context.Background(), serverOptions{
+		Logger: zap.NewNop(),
+		Opts:   &opts,
+		S3Opts: &s3opts,
+		FSOpts: &obsFSOptions{Root: root},
+	}))
+}
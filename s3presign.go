@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+	"github.com/pkg/errors"
+)
+
+// bucket lookup styles, same semantic as minio.BucketLookupType
+const (
+	s3BucketLookupAuto = "auto"
+	s3BucketLookupDNS  = "dns"
+	s3BucketLookupPath = "path"
+)
+
+const (
+	s3V4Algorithm       = "AWS4-HMAC-SHA256"
+	s3V4UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3V4DateFormat      = "20060102T150405Z"
+	s3V4ScopeDateFormat = "20060102"
+	s3SecurityTokenV2   = "x-amz-security-token"
+	s3SecurityTokenV4   = "X-Amz-Security-Token"
+)
+
+// sub-resources included in the V2 canonicalized resource, sorted.
+var s3V2SubResources = []string{
+	"acl",
+	"cors",
+	"delete",
+	"encryption",
+	"legal-hold",
+	"lifecycle",
+	"location",
+	"logging",
+	"notification",
+	"partNumber",
+	"policy",
+	"replication",
+	"requestPayment",
+	"response-cache-control",
+	"response-content-disposition",
+	"response-content-encoding",
+	"response-content-language",
+	"response-content-type",
+	"response-expires",
+	"retention",
+	"select",
+	"select-type",
+	"tagging",
+	"torrent",
+	"uploadId",
+	"uploads",
+	"versionId",
+	"versioning",
+	"versions",
+	"website",
+}
+
+// s3Presigner presigns S3 object URLs for an endpoint.
+type s3Presigner struct {
+	endpoint url.URL // scheme and host only
+	region   string
+	lookup   string
+	creds    s3CredsSource
+}
+
+func newS3Presigner(endpoint string, secure bool, region, lookup string, creds s3CredsSource) (_ *s3Presigner, err error) {
+	if endpoint == "" {
+		err = errors.New("empty s3 endpoint")
+		return
+	}
+	switch lookup {
+	case "":
+		lookup = s3BucketLookupAuto
+	case s3BucketLookupAuto, s3BucketLookupDNS, s3BucketLookupPath:
+	default:
+		err = errors.Errorf("unknown bucket lookup %q", lookup)
+		return
+	}
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+	return &s3Presigner{
+		endpoint: url.URL{Scheme: scheme, Host: stripDefaultPort(scheme, endpoint)},
+		region:   region,
+		lookup:   lookup,
+		creds:    creds,
+	}, nil
+}
+
+// withCredentials returns a copy of the presigner signing with creds.
+func (p *s3Presigner) withCredentials(creds s3CredsSource) *s3Presigner {
+	cp := *p
+	cp.creds = creds
+	return &cp
+}
+
+// stripDefaultPort drops :80 from http and :443 from https hosts,
+// clients don't send them in the Host header.
+func stripDefaultPort(scheme, host string) string {
+	switch {
+	case scheme == "http" && strings.HasSuffix(host, ":80"):
+		return strings.TrimSuffix(host, ":80")
+	case scheme == "https" && strings.HasSuffix(host, ":443"):
+		return strings.TrimSuffix(host, ":443")
+	}
+	return host
+}
+
+func (p *s3Presigner) isVirtualHostStyle(bucket string) bool {
+	switch p.lookup {
+	case s3BucketLookupDNS:
+		return true
+	case s3BucketLookupPath:
+		return false
+	}
+	return s3utils.IsVirtualHostSupported(p.endpoint, bucket)
+}
+
+// targetURL returns the unsigned object URL.
+func (p *s3Presigner) targetURL(bucket, key string, virtualHost bool) *url.URL {
+	u := p.endpoint
+	path := "/" + bucket + "/" + key
+	if virtualHost {
+		u.Host = bucket + "." + u.Host
+		path = "/" + key
+	}
+	u.Path = path
+	u.RawPath = s3utils.EncodePath(path)
+	return &u
+}
+
+// PresignV2 presigns a V2 URL which expires at expireAt, never if zero,
+// query carries extra parameters like response overrides. It returns
+// when the URL actually expires, which is earlier than expireAt when
+// the credentials expire before.
+func (p *s3Presigner) PresignV2(ctx context.Context, method, bucket, key string, query url.Values, expireAt time.Time) (_ *url.URL, _ time.Time, err error) {
+	var v s3Creds
+	if v, err = p.creds.Get(ctx); err != nil {
+		return
+	}
+	expireAt = clampS3ExpireAt(expireAt, v)
+	expires := int64(^uint64(0) / 2)
+	if !expireAt.IsZero() {
+		expires = expireAt.Unix()
+	}
+	u := p.targetURL(bucket, key, p.isVirtualHostStyle(bucket))
+	presignS3V2(u, method, bucket, key, query, v, expires)
+	return u, expireAt, nil
+}
+
+// PresignV4 presigns a V4 URL which expires at expireAt, it has to be
+// within 7 days from now.
+func (p *s3Presigner) PresignV4(ctx context.Context, method, bucket, key string, query url.Values, expireAt, now time.Time) (_ *url.URL, _ time.Time, err error) {
+	return p.PresignV4Headers(ctx, method, bucket, key, query, nil, expireAt, now)
+}
+
+// PresignV4Headers is PresignV4 with extra signed headers, which the
+// client has to send as they are.
+func (p *s3Presigner) PresignV4Headers(ctx context.Context, method, bucket, key string, query url.Values, headers map[string]string, expireAt, now time.Time) (_ *url.URL, _ time.Time, err error) {
+	var v s3Creds
+	if v, err = p.creds.Get(ctx); err != nil {
+		return
+	}
+	expireAt = clampS3ExpireAt(expireAt, v)
+	region := p.region
+	if region == "" {
+		region = "us-east-1"
+	}
+	u := p.targetURL(bucket, key, p.isVirtualHostStyle(bucket))
+	presignS3V4(u, method, region, query, headers, v, expireAt.Sub(now), now)
+	return u, expireAt, nil
+}
+
+// PresignPostPolicy signs the V4 browser POST policy pp, adding the
+// signature fields to fields, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-HTTPPOSTConstructPolicy.html
+//
+// pp can't be read back, fields has to hold the form fields of its
+// conditions already.
+func (p *s3Presigner) PresignPostPolicy(ctx context.Context, bucket string, pp *minio.PostPolicy, fields map[string]string, expireAt, now time.Time) (_ *url.URL, _ time.Time, err error) {
+	var v s3Creds
+	if v, err = p.creds.Get(ctx); err != nil {
+		return
+	}
+	if v.anonymous() {
+		err = errors.New("POST policies need credentials")
+		return
+	}
+	expireAt = clampS3ExpireAt(expireAt, v).UTC()
+	region := p.region
+	if region == "" {
+		region = "us-east-1"
+	}
+	now = now.UTC()
+	credential := v.AccessKeyID + "/" + s3V4Scope(now, region, "s3")
+	date := now.Format(s3V4DateFormat)
+
+	if err = pp.SetExpires(expireAt); err != nil {
+		return
+	}
+	if err = pp.SetBucket(bucket); err != nil {
+		return
+	}
+	for _, cond := range [][2]string{
+		{"X-Amz-Algorithm", s3V4Algorithm},
+		{"X-Amz-Credential", credential},
+		{"X-Amz-Date", date},
+	} {
+		if err = pp.SetCondition("eq", cond[0], cond[1]); err != nil {
+			return
+		}
+		fields[cond[0]] = cond[1]
+	}
+	if v.SessionToken != "" {
+		// sets `x-amz-security-token`
+		if err = pp.SetUserData("security-token", v.SessionToken); err != nil {
+			return
+		}
+		fields[s3SecurityTokenV2] = v.SessionToken
+	}
+
+	policy := base64.StdEncoding.EncodeToString([]byte(pp.String()))
+	fields["bucket"] = bucket
+	fields["policy"] = policy
+	fields["X-Amz-Signature"] = s3V4Signature(v.SecretAccessKey, now, region, "s3", policy)
+	return p.targetURL(bucket, "", p.isVirtualHostStyle(bucket)), expireAt, nil
+}
+
+// clampS3ExpireAt limits expireAt to the expiry of temporary credentials,
+// S3 rejects URLs signed by expired sessions anyway.
+func clampS3ExpireAt(expireAt time.Time, v s3Creds) time.Time {
+	if v.Expires.IsZero() || v.anonymous() {
+		return expireAt
+	}
+	if expireAt.IsZero() || v.Expires.Before(expireAt) {
+		return v.Expires.UTC()
+	}
+	return expireAt
+}
+
+// presignS3V2 sets the V2 query string authentication on u, see
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/RESTAuthentication.html#RESTAuthenticationQueryStringAuth
+func presignS3V2(u *url.URL, method, bucket, key string, query url.Values, v s3Creds, expires int64) {
+	q := url.Values{}
+	for k, vv := range query {
+		q[k] = vv
+	}
+	if v.anonymous() {
+		u.RawQuery = s3utils.QueryEncode(q)
+		return
+	}
+	exp := strconv.FormatInt(expires, 10)
+
+	var sb strings.Builder
+	sb.WriteString(method + "\n")
+	sb.WriteString("\n") // Content-MD5
+	sb.WriteString("\n") // Content-Type
+	sb.WriteString(exp + "\n")
+	if v.SessionToken != "" {
+		sb.WriteString(s3SecurityTokenV2 + ":" + v.SessionToken + "\n")
+	}
+	// the resource always contains the bucket, regardless of the URL style
+	sb.WriteString(s3utils.EncodePath("/" + bucket + "/" + key))
+	n := 0
+	for _, res := range s3V2SubResources {
+		vv, ok := q[res]
+		if !ok || len(vv) == 0 {
+			continue
+		}
+		if n++; n == 1 {
+			sb.WriteByte('?')
+		} else {
+			sb.WriteByte('&')
+		}
+		sb.WriteString(res)
+		if vv[0] != "" {
+			sb.WriteString("=" + vv[0])
+		}
+	}
+
+	mac := hmac.New(sha1.New, []byte(v.SecretAccessKey))
+	mac.Write([]byte(sb.String()))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	q.Set("AWSAccessKeyId", v.AccessKeyID)
+	q.Set("Expires", exp)
+	if v.SessionToken != "" {
+		q.Set(s3SecurityTokenV2, v.SessionToken)
+	}
+	u.RawQuery = s3utils.QueryEncode(q) + "&Signature=" + s3utils.EncodePath(signature)
+}
+
+// presignS3V4 sets the V4 query string authentication on u, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func presignS3V4(u *url.URL, method, region string, query url.Values, headers map[string]string, v s3Creds, expiry time.Duration, now time.Time) {
+	q := url.Values{}
+	for k, vv := range query {
+		q[k] = vv
+	}
+	if v.anonymous() {
+		u.RawQuery = s3utils.QueryEncode(q)
+		return
+	}
+
+	now = now.UTC()
+	canonicalHeaders, signedHeaders := s3V4CanonicalHeaders(u.Host, headers)
+	scope := s3V4Scope(now, region, "s3")
+	q.Set("X-Amz-Algorithm", s3V4Algorithm)
+	q.Set("X-Amz-Credential", v.AccessKeyID+"/"+scope)
+	q.Set("X-Amz-Date", now.Format(s3V4DateFormat))
+	q.Set("X-Amz-Expires", strconv.FormatInt(int64(expiry/time.Second), 10))
+	q.Set("X-Amz-SignedHeaders", signedHeaders)
+	if v.SessionToken != "" {
+		q.Set(s3SecurityTokenV4, v.SessionToken)
+	}
+	canonicalQuery := s3V4CanonicalQuery(q)
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		s3utils.EncodePath(u.Path),
+		canonicalQuery,
+		canonicalHeaders,
+		signedHeaders,
+		s3V4UnsignedPayload,
+	}, "\n")
+	signature := s3V4Signature(v.SecretAccessKey, now, region, "s3", s3V4StringToSign(now, scope, canonicalRequest))
+	u.RawQuery = canonicalQuery + "&X-Amz-Signature=" + signature
+}
+
+// s3V4CanonicalHeaders returns canonical headers and signed header names
+// of host and headers.
+func s3V4CanonicalHeaders(host string, headers map[string]string) (canonical, signed string) {
+	all := map[string]string{"host": host}
+	for k, v := range headers {
+		all[strings.ToLower(k)] = strings.TrimSpace(v)
+	}
+	names := make([]string, 0, len(all))
+	for k := range all {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, k := range names {
+		sb.WriteString(k + ":" + all[k] + "\n")
+	}
+	return sb.String(), strings.Join(names, ";")
+}
+
+func s3V4Scope(t time.Time, region, service string) string {
+	return strings.Join([]string{t.Format(s3V4ScopeDateFormat), region, service, "aws4_request"}, "/")
+}
+
+func s3V4StringToSign(t time.Time, scope, canonicalRequest string) string {
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	return strings.Join([]string{
+		s3V4Algorithm,
+		t.Format(s3V4DateFormat),
+		scope,
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+}
+
+func s3V4Signature(secret string, t time.Time, region, service, stringToSign string) string {
+	key := hmacSHA256([]byte("AWS4"+secret), t.Format(s3V4ScopeDateFormat))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// s3V4CanonicalQuery encodes the query sorted by key then value, with
+// spaces as %20.
+func s3V4CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		vv := append([]string(nil), q[k]...)
+		sort.Strings(vv)
+		for _, v := range vv {
+			if sb.Len() > 0 {
+				sb.WriteByte('&')
+			}
+			sb.WriteString(s3V4Escape(k) + "=" + s3V4Escape(v))
+		}
+	}
+	return sb.String()
+}
+
+func s3V4Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
@@ -11,11 +14,14 @@ import (
 var (
 	ErrKind_ResourceNotFound = "OBS_RESOURCE_NOT_FOUND"
 	ErrKind_MethodNotAllowed = "OBS_METHOD_NOT_ALLOWED"
+	ErrKind_InvalidObjectKey = "OBS_INVALID_OBJECT_KEY"
 )
 
 var (
 	MethodGet  = []byte(http.MethodGet)
 	MethodHead = []byte(http.MethodHead)
+	// CORS preflights
+	MethodOptions = []byte(http.MethodOptions)
 )
 
 type serverOptions struct {
@@ -25,6 +31,13 @@ type serverOptions struct {
 	Opts       *obsOptions
 	S3Opts     *obsS3Options
 	UplinkOpts *obsStorjOptions
+	GCSOpts    *obsGCSOptions
+	AzureOpts  *obsAzureOptions
+	SwiftOpts  *obsSwiftOptions
+	FSOpts     *obsFSOptions
+
+	CloudFrontOpts *obsCloudFrontOptions
+	APIOpts        *obsAPIOptions
 }
 
 func (s *serverOptions) GetOpts() obsOptions {
@@ -48,6 +61,48 @@ func (s *serverOptions) GetUplinkOpts() obsStorjOptions {
 	return *s.UplinkOpts
 }
 
+func (s *serverOptions) GetGCSOpts() obsGCSOptions {
+	if s.GCSOpts == nil {
+		return defaultObsGCSOpts
+	}
+	return *s.GCSOpts
+}
+
+func (s *serverOptions) GetAzureOpts() obsAzureOptions {
+	if s.AzureOpts == nil {
+		return defaultObsAzureOpts
+	}
+	return *s.AzureOpts
+}
+
+func (s *serverOptions) GetSwiftOpts() obsSwiftOptions {
+	if s.SwiftOpts == nil {
+		return defaultObsSwiftOpts
+	}
+	return *s.SwiftOpts
+}
+
+func (s *serverOptions) GetFSOpts() obsFSOptions {
+	if s.FSOpts == nil {
+		return defaultObsFSOpts
+	}
+	return *s.FSOpts
+}
+
+func (s *serverOptions) GetCloudFrontOpts() obsCloudFrontOptions {
+	if s.CloudFrontOpts == nil {
+		return defaultObsCloudFrontOpts
+	}
+	return *s.CloudFrontOpts
+}
+
+func (s *serverOptions) GetAPIOpts() obsAPIOptions {
+	if s.APIOpts == nil {
+		return defaultObsAPIOpts
+	}
+	return *s.APIOpts
+}
+
 func reportError(self interface {
 	getLogger() *zap.SugaredLogger
 }, ctx *fasthttp.RequestCtx, errType string, err any) {
@@ -67,6 +122,47 @@ func reportError(self interface {
 	}
 }
 
+// resolveObjectName resolves the object key from the request path.
+func resolveObjectName(ctx *fasthttp.RequestCtx, opts obsOptions) (string, error) {
+	// normalize the original path, `ctx.Path()` is already decoded
+	// and resolved by fasthttp without honoring our key policy.
+	objectName, err := normalizeObjectKey(unsafeByteSliceToString(ctx.URI().PathOriginal()), opts.KeyPolicy, 0)
+	if err != nil {
+		return "", err
+	}
+	if opts.RemoveBucketName {
+		if _, objectNameWithoutBucketName, found := strings.Cut(objectName, "/"); found {
+			// no need to check `isVirtualHostStyle` since this is our own implementation of handling request URI
+			objectName = objectNameWithoutBucketName
+		}
+	}
+	// the limit applies to the key, not the bucket segment
+	if opts.MaxKeyLength > 0 && len(objectName) > opts.MaxKeyLength {
+		return "", errKeyTooLong
+	}
+	return objectName, nil
+}
+
+// redirect redirects to the signed location, zero expireAt means the
+// location never expires.
+func redirect(ctx *fasthttp.RequestCtx, opts obsOptions, location string, expireAt time.Time) {
+	var statusCode = opts.RedirectCode
+	if !expireAt.IsZero() {
+		// we can't allow a permanent redirect here since we already have
+		// expiry set, the redirected url needs to be updated.
+		if statusCode == http.StatusMovedPermanently || (statusCode < 300 || statusCode > 399) {
+			statusCode = http.StatusTemporaryRedirect
+		}
+		// set redirect cache lifetime
+		if statusCode == http.StatusTemporaryRedirect {
+			expireSeconds := int64(time.Until(expireAt) / time.Second)
+			ctx.Response.Header.Set("Cache-Control", fmt.Sprintf("max-age=%d", expireSeconds))
+			ctx.Response.Header.Set("Expires", expireAt.UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT"))
+		}
+	}
+	ctx.Redirect(location, statusCode)
+}
+
 type Server interface {
 	Init(ctx context.Context, opts serverOptions) (err error)
 	Name() string
@@ -75,7 +171,13 @@ type Server interface {
 
 func RunServer(ctx context.Context, s Server, opts serverOptions) {
 	sug := opts.Logger.Sugar()
-	s.Init(ctx, opts)
+	if err := s.Init(ctx, opts); err != nil {
+		// don't serve with a partially initialized server, ex. a key filter
+		// that failed to parse would otherwise allow every key.
+		sug.Fatalw("init server",
+			"server_mode", s.Name(),
+			"err", err)
+	}
 	sug.Infow("running server",
 		"addr", opts.Addr)
 	handler := s.GetHandler()
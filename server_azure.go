@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+type serverAzure struct {
+	signingHandler
+}
+
+func (s *serverAzure) Init(ctx context.Context, opts serverOptions) (err error) {
+	return s.signingHandler.Init(ctx, opts, s.Name(), backendAzureName, signerAzureName)
+}
+
+func (s *serverAzure) Name() string {
+	return "azure"
+}
+
+func (s *serverAzure) GetHandler() fasthttp.RequestHandler {
+	return s.handle
+}
+
+const (
+	backendAzureName = "azure"
+	signerAzureName  = "azure"
+)
+
+type backendAzure struct {
+	ac *azureBlobClient
+}
+
+func (b *backendAzure) Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error) {
+	if b.ac, err = clients.Azure(); err != nil {
+		err = errors.Wrap(err, "obs azure client")
+		return
+	}
+	return
+}
+
+func (b *backendAzure) Name() string {
+	return backendAzureName
+}
+
+func (b *backendAzure) StatObject(ctx context.Context, bucket, key string) (*objectInfo, error) {
+	header, err := b.ac.StatBlob(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return objectInfoFromHeader(key, header), nil
+}
+
+// signerAzure generates read-only service SAS.
+type signerAzure struct {
+	opts obsOptions
+	ac   *azureBlobClient
+}
+
+func (s *signerAzure) Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error) {
+	s.opts = opts.GetOpts()
+	if s.ac, err = clients.Azure(); err != nil {
+		err = errors.Wrap(err, "obs azure client")
+		return
+	}
+	return
+}
+
+func (s *signerAzure) Name() string {
+	return signerAzureName
+}
+
+func (s *signerAzure) SignURL(ctx context.Context, sreq signRequest) (_ *signedURL, err error) {
+	expireAt := sreq.expireAt(time.Now())
+	u := s.ac.SignedURL(sreq.Bucket, sreq.Key, expireAt)
+
+	// host is not part of the SAS signature
+	overrideRedirectURL(u, s.opts)
+	return &signedURL{
+		URL:      u.String(),
+		ExpireAt: expireAt,
+	}, nil
+}
+
+// objectInfoFromHeader reads object metadata of a HEAD response.
+func objectInfoFromHeader(key string, header http.Header) *objectInfo {
+	info := &objectInfo{
+		Key:         key,
+		ContentType: header.Get("Content-Type"),
+		ETag:        header.Get("ETag"),
+	}
+	info.Size, _ = strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	info.LastModified, _ = http.ParseTime(header.Get("Last-Modified"))
+	return info
+}
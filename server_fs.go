@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+type serverFS struct {
+	signingHandler
+
+	fc        *fsClient
+	fsHandler fasthttp.RequestHandler
+}
+
+func (s *serverFS) Init(ctx context.Context, opts serverOptions) (err error) {
+	if err = s.signingHandler.Init(ctx, opts, s.Name(), backendFSName, signerFSName); err != nil {
+		return
+	}
+
+	if s.fc, err = s.clients.FS(); err != nil {
+		err = errors.Wrap(err, "obs fs client")
+		return
+	}
+	if opts.GetFSOpts().Secret == "" {
+		s.logger.Warn("no fs secret configured, signed URLs are invalidated on restart")
+	}
+
+	fs := &fasthttp.FS{
+		Root:            s.fc.root,
+		AcceptByteRange: true,
+		// don't leave compressed cache files next to the objects
+		Compress:           false,
+		GenerateIndexPages: false,
+	}
+	s.fsHandler = fs.NewRequestHandler()
+	return
+}
+
+func (s *serverFS) Name() string {
+	return "fs"
+}
+
+var (
+	ErrKind_FSInvalidSignature = "FS_INVALID_SIGNATURE"
+)
+
+func (s *serverFS) handle(ctx *fasthttp.RequestCtx) {
+	if rawPath := unsafeByteSliceToString(ctx.URI().PathOriginal()); strings.HasPrefix(rawPath, fsObjectPrefix) {
+		s.serveObject(ctx, rawPath[len(fsObjectPrefix)-1:])
+		return
+	}
+	s.signingHandler.handle(ctx)
+}
+
+// serveObject serves the object file of a signed URL.
+func (s *serverFS) serveObject(ctx *fasthttp.RequestCtx, rawPath string) {
+	if !ctx.IsGet() && !ctx.IsHead() && !ctx.IsOptions() {
+		ctx.SetStatusCode(http.StatusMethodNotAllowed)
+		s.reportError(ctx, ErrKind_MethodNotAllowed, "")
+		return
+	}
+
+	objectName, err := normalizeObjectKey(rawPath, s.opts.KeyPolicy, s.opts.MaxKeyLength)
+	if err != nil {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		s.reportError(ctx, ErrKind_InvalidObjectKey, err)
+		return
+	}
+	// preflights aren't signed
+	if s.cors(ctx, s.routes.Match(objectName)) {
+		return
+	}
+	if ctx.IsOptions() {
+		ctx.SetStatusCode(http.StatusMethodNotAllowed)
+		s.reportError(ctx, ErrKind_MethodNotAllowed, "")
+		return
+	}
+
+	args := ctx.QueryArgs()
+	overrides := url.Values{}
+	args.VisitAll(func(k, v []byte) {
+		if responseOverrideParams[string(k)] {
+			overrides.Set(string(k), string(v))
+		}
+	})
+	if err = s.fc.Verify(objectName,
+		unsafeByteSliceToString(args.Peek("expires")),
+		unsafeByteSliceToString(args.Peek("signature")),
+		overrides,
+		time.Now()); err != nil {
+		ctx.SetStatusCode(http.StatusForbidden)
+		s.reportError(ctx, ErrKind_FSInvalidSignature, err)
+		return
+	}
+
+	if !s.filter.Allow(objectName) {
+		ctx.SetStatusCode(http.StatusNotFound)
+		s.reportError(ctx, ErrKind_ResourceNotFound, "object not found")
+		return
+	}
+	if _, err = s.fc.StatObject(objectName); err != nil {
+		ctx.SetStatusCode(http.StatusNotFound)
+		s.reportError(ctx, ErrKind_ResourceNotFound, "object not found")
+		return
+	}
+
+	// rewrite to the file path under root, fasthttp decodes the path again.
+	ctx.URI().SetPath((&url.URL{Path: "/" + objectName}).EscapedPath())
+	s.fsHandler(ctx)
+
+	// signed overrides become the response headers, like S3 does
+	if statusCode := ctx.Response.StatusCode(); statusCode >= 200 && statusCode < 300 {
+		for k := range overrides {
+			ctx.Response.Header.Set(strings.TrimPrefix(k, "response-"), overrides.Get(k))
+		}
+	}
+}
+
+func (s *serverFS) GetHandler() fasthttp.RequestHandler {
+	return s.handle
+}
+
+const (
+	backendFSName = "fs"
+	signerFSName  = "fs"
+)
+
+type backendFS struct {
+	fc *fsClient
+}
+
+func (b *backendFS) Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error) {
+	if b.fc, err = clients.FS(); err != nil {
+		err = errors.Wrap(err, "obs fs client")
+		return
+	}
+	return
+}
+
+func (b *backendFS) Name() string {
+	return backendFSName
+}
+
+func (b *backendFS) StatObject(ctx context.Context, bucket, key string) (*objectInfo, error) {
+	fi, err := b.fc.StatObject(key)
+	if err != nil {
+		// don't leak local paths
+		return nil, errors.New("object not found")
+	}
+	return &objectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+func (b *backendFS) ReadObject(ctx context.Context, bucket, key string, maxSize int64) (_ []byte, _ *objectInfo, err error) {
+	var info *objectInfo
+	if info, err = b.StatObject(ctx, bucket, key); err != nil {
+		return
+	}
+	if info.Size > maxSize {
+		return nil, nil, errors.Errorf("object is larger than %d bytes", maxSize)
+	}
+	var body []byte
+	if body, err = os.ReadFile(b.fc.filePath(key)); err != nil {
+		// don't leak local paths
+		return nil, nil, errors.New("object not found")
+	}
+	info.ContentType = mime.TypeByExtension(path.Ext(key))
+	return body, info, nil
+}
+
+func (b *backendFS) ListObjects(ctx context.Context, bucket, prefix, token string, maxKeys int) (_ *objectList, err error) {
+	var entries []os.DirEntry
+	if entries, err = os.ReadDir(b.fc.filePath(prefix)); err != nil {
+		if os.IsNotExist(err) {
+			return &objectList{}, nil
+		}
+		// don't leak local paths
+		return nil, errors.New("list directory failed")
+	}
+	type entry struct {
+		key string
+		fi  os.FileInfo
+	}
+	var keys []entry
+	for _, de := range entries {
+		fi, err := os.Stat(b.fc.filePath(prefix + de.Name()))
+		switch {
+		case err != nil:
+			continue
+		case fi.IsDir():
+			keys = append(keys, entry{key: prefix + de.Name() + "/"})
+		case fi.Mode().IsRegular():
+			keys = append(keys, entry{key: prefix + de.Name(), fi: fi})
+		}
+	}
+	// S3 order
+	sort.Slice(keys, func(i, j int) bool { return keys[i].key < keys[j].key })
+
+	list := &objectList{}
+	var n int
+	var last string
+	for _, e := range keys {
+		if e.key <= token {
+			continue
+		}
+		if n == maxKeys {
+			list.NextToken = last
+			break
+		}
+		n++
+		last = e.key
+		if e.fi == nil {
+			list.Prefixes = append(list.Prefixes, e.key)
+			continue
+		}
+		list.Objects = append(list.Objects, objectInfo{
+			Key:          e.key,
+			Size:         e.fi.Size(),
+			ContentType:  mime.TypeByExtension(path.Ext(e.key)),
+			LastModified: e.fi.ModTime(),
+		})
+	}
+	return list, nil
+}
+
+// signerFS signs URLs served by the fs server itself.
+type signerFS struct {
+	opts obsOptions
+	fc   *fsClient
+}
+
+func (s *signerFS) Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error) {
+	s.opts = opts.GetOpts()
+	if s.fc, err = clients.FS(); err != nil {
+		err = errors.Wrap(err, "obs fs client")
+		return
+	}
+	return
+}
+
+func (s *signerFS) Name() string {
+	return signerFSName
+}
+
+func (s *signerFS) signsResponseOverrides() {}
+
+func (s *signerFS) SignURL(ctx context.Context, sreq signRequest) (_ *signedURL, err error) {
+	expires, expireAt := sreq.expires(time.Now())
+	u := s.fc.SignedURL(sreq.Key, expires, sreq.ResponseOverrides)
+
+	// relative location is resolved against the request host
+	if s.opts.HostRedirect != "" {
+		overrideRedirectURL(u, s.opts)
+	}
+	return &signedURL{
+		URL:      u.String(),
+		ExpireAt: expireAt,
+	}, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+	"go.uber.org/zap"
+)
+
+// newTestServer serves s in memory, returns a client dialing it.
+func newTestServer(t *testing.T, s Server, opts serverOptions) *fasthttp.Client {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	require.NoError(t, s.Init(context.Background(), opts))
+
+	ln := fasthttputil.NewInmemoryListener()
+	go fasthttp.Serve(ln, s.GetHandler())
+	t.Cleanup(func() { ln.Close() })
+	return &fasthttp.Client{
+		Dial: func(addr string) (net.Conn, error) { return ln.Dial() },
+	}
+}
+
+// writeTestRoutes writes a routes file of the test.
+func writeTestRoutes(t *testing.T, routes string) string {
+	routesFile := filepath.Join(t.TempDir(), "routes.json")
+	require.NoError(t, os.WriteFile(routesFile, []byte(routes), 0o644))
+	return routesFile
+}
+
+// testFSServerOptions serves files, name to content, from a temporary
+// root with URLs valid for an hour. routes is the routes file content,
+// empty for none.
+func testFSServerOptions(t *testing.T, files map[string]string, routes string) serverOptions {
+	root := t.TempDir()
+	for name, body := range files {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(body), 0o644))
+	}
+	opts := defaultObsOpts
+	opts.URLExpiry = time.Hour
+	if routes != "" {
+		opts.RoutesFile = writeTestRoutes(t, routes)
+	}
+	return serverOptions{
+		Opts:   &opts,
+		FSOpts: &obsFSOptions{Root: root, Secret: "test"},
+	}
+}
+
+// newTestS3Endpoint serves handler as a fake S3, returns its host.
+func newTestS3Endpoint(t *testing.T, handler http.HandlerFunc) string {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	return u.Host
+}
+
+// testS3ServerOptions signs URLs of `bucket` at endpoint with the static
+// test credentials, path style. routes is the routes file content, empty
+// for none.
+func testS3ServerOptions(t *testing.T, endpoint, routes string) serverOptions {
+	opts := defaultObsOpts
+	opts.BucketName = "bucket"
+	if routes != "" {
+		opts.RoutesFile = writeTestRoutes(t, routes)
+	}
+	s3opts := defaultObsS3Opts
+	s3opts.Endpoint = endpoint
+	s3opts.Region = "us-east-1"
+	s3opts.BucketLookup = s3BucketLookupPath
+	s3opts.Credentials = s3CredsStatic
+	s3opts.AccessKey, s3opts.SecretKey = testS3Value.AccessKeyID, testS3Value.SecretAccessKey
+	return serverOptions{Opts: &opts, S3Opts: &s3opts}
+}
+
+func doTestRequest(t *testing.T, c *fasthttp.Client, method, uri string) *fasthttp.Response {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	resp := &fasthttp.Response{}
+	require.NoError(t, c.Do(req, resp))
+	return resp
+}
+
+func TestServerFS(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "a"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a", "b c.txt"), []byte("hello"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "secret.txt"), []byte("nope"), 0o644))
+
+	opts := defaultObsOpts
+	opts.URLExpiry = time.Hour
+	opts.KeyPatterns = "!secret.txt"
+	s := &serverFS{}
+	c := newTestServer(t, s, serverOptions{
+		Opts:   &opts,
+		FSOpts: &obsFSOptions{Root: root, Secret: "test"},
+	})
+
+	// redirect then download
+	resp := doTestRequest(t, c, http.MethodGet, "http://signer/a/b%20c.txt")
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+	location := string(resp.Header.Peek("Location"))
+	require.Contains(t, location, "/_obj/a/b%20c.txt?")
+
+	resp = doTestRequest(t, c, http.MethodGet, location)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	require.Equal(t, "hello", string(resp.Body()))
+
+	// tampered signature
+	resp = doTestRequest(t, c, http.MethodGet, location+"0")
+	require.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	// signature of another key
+	_, query, _ := strings.Cut(location, "?")
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer/_obj/secret.txt?"+query)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	// expired
+	expired := (&fsClient{secret: []byte("test")}).SignedURL("a/b c.txt", time.Now().Add(-time.Minute).Unix(), nil)
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer"+expired.String())
+	require.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	// blocked, missing, traversal
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer/secret.txt")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode())
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer/a/missing.txt")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode())
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer/a/")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode())
+
+	// client normalizes the path, hand the raw path to the handler
+	var req fasthttp.Request
+	req.SetRequestURI("http://signer/_obj/..%2f..%2fetc/passwd")
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, nil, nil)
+	s.GetHandler()(&ctx)
+	require.Equal(t, http.StatusBadRequest, ctx.Response.StatusCode())
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+type serverGCS struct {
+	signingHandler
+}
+
+func (s *serverGCS) Init(ctx context.Context, opts serverOptions) (err error) {
+	return s.signingHandler.Init(ctx, opts, s.Name(), backendGCSName, signerGCSName)
+}
+
+func (s *serverGCS) Name() string {
+	return "gcs"
+}
+
+func (s *serverGCS) GetHandler() fasthttp.RequestHandler {
+	return s.handle
+}
+
+const (
+	backendGCSName = "gcs"
+	signerGCSName  = "gcs"
+)
+
+type backendGCS struct {
+	gc *gcsClient
+}
+
+func (b *backendGCS) Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error) {
+	if b.gc, err = clients.GCS(); err != nil {
+		err = errors.Wrap(err, "obs gcs client")
+		return
+	}
+	return
+}
+
+func (b *backendGCS) Name() string {
+	return backendGCSName
+}
+
+func (b *backendGCS) StatObject(ctx context.Context, bucket, key string) (*objectInfo, error) {
+	attrs, err := b.gc.StatObject(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return attrs.objectInfo(), nil
+}
+
+// signerGCS generates V4 signed URLs, which last 7 days at most.
+type signerGCS struct {
+	opts obsOptions
+	gc   *gcsClient
+}
+
+func (s *signerGCS) Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error) {
+	s.opts = opts.GetOpts()
+	if s.gc, err = clients.GCS(); err != nil {
+		err = errors.Wrap(err, "obs gcs client")
+		return
+	}
+	return
+}
+
+func (s *signerGCS) Name() string {
+	return signerGCSName
+}
+
+func (s *signerGCS) SignURL(ctx context.Context, sreq signRequest) (_ *signedURL, err error) {
+	// V4 signed URL can't outlive 7 days, clamp "no expiry" to the max.
+	expiry := sreq.Expiry
+	if expiry == maxURLExpiry || expiry <= 0 || expiry > maxGCSURLExpiry {
+		expiry = maxGCSURLExpiry
+	}
+
+	scheme := "http"
+	if s.opts.RedirectSecure {
+		scheme = "https"
+	}
+	// host is part of the signature, sign for the redirected host directly.
+	host := s.gc.endpoint.Host
+	if hostRedirect := s.opts.HostRedirect; hostRedirect != "" {
+		host = hostRedirect
+	}
+
+	now := time.Now()
+	var u string
+	if u, err = s.gc.SignedURL(sreq.Method, scheme, host, sreq.Bucket, sreq.Key, expiry, now); err != nil {
+		return
+	}
+	return &signedURL{
+		URL:      u,
+		ExpireAt: now.UTC().Add(expiry),
+	}, nil
+}
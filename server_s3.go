@@ -1,166 +1,530 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/s3utils"
-	"github.com/minio/minio-go/v7/pkg/signer"
 	"github.com/pkg/errors"
 	"github.com/valyala/fasthttp"
-	"go.uber.org/zap"
 )
 
 type serverS3 struct {
-	opts   obsOptions
-	s3opts obsS3Options
+	signingHandler
+}
 
-	logger *zap.SugaredLogger
+func (s *serverS3) Init(ctx context.Context, opts serverOptions) (err error) {
+	return s.signingHandler.Init(ctx, opts, s.Name(), backendS3Name, signerS3V2Name)
+}
 
-	s3c *minio.Client
+func (s *serverS3) Name() string {
+	return "s3"
 }
 
-func (s *serverS3) Init(ctx context.Context, opts serverOptions) (err error) {
-	s.opts = opts.GetOpts()
-	s.s3opts = opts.GetS3Opts()
+func (s *serverS3) GetHandler() fasthttp.RequestHandler {
+	return s.handle
+}
+
+const (
+	backendS3Name  = "s3"
+	signerS3V2Name = "s3v2"
+	signerS3V4Name = "s3v4"
+)
+
+// S3 V4 presigned URL lifetime limit
+const maxS3V4URLExpiry = 7 * 24 * time.Hour
 
-	s.logger = opts.Logger.Named(s.Name()).Sugar()
+type backendS3 struct {
+	s3c *minio.Client
+}
 
-	if s.s3c, err = newObsS3Client(s.s3opts); err != nil {
+func (b *backendS3) Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error) {
+	if b.s3c, err = clients.S3(); err != nil {
 		err = errors.Wrap(err, "obs s3 client")
 		return
 	}
-
 	return
 }
 
-func (s *serverS3) Name() string {
-	return "s3"
+func (b *backendS3) Name() string {
+	return backendS3Name
 }
 
-func (s *serverS3) getLogger() *zap.SugaredLogger { return s.logger }
-func (s *serverS3) reportError(ctx *fasthttp.RequestCtx, errType string, err any) {
-	reportError(s, ctx, errType, err)
+func (b *backendS3) StatObject(ctx context.Context, bucket, key string) (*objectInfo, error) {
+	return b.StatObjectVersion(ctx, bucket, key, "")
 }
 
-var (
-	ErrKind_S3ComposeRequest = "S3_COMPOSE_REQUEST"
-	ErrKind_S3CredsProvider  = "S3_CREDS_PROVIDER"
-)
+func (b *backendS3) StatObjectVersion(ctx context.Context, bucket, key, versionID string) (*objectInfo, error) {
+	info, err := b.s3c.StatObject(ctx, bucket, key, minio.GetObjectOptions{VersionID: versionID})
+	if err != nil {
+		return nil, err
+	}
+	return &objectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+		VersionID:    info.VersionID,
+
+		WebsiteRedirect: info.Metadata.Get("X-Amz-Website-Redirect-Location"),
+	}, nil
+}
 
-func (s *serverS3) handle(ctx *fasthttp.RequestCtx) {
-	isMethodGet := bytes.Equal(ctx.Method(), MethodGet)
-	isMethodHead := bytes.Equal(ctx.Method(), MethodHead)
-	if !isMethodGet && !isMethodHead {
-		ctx.SetStatusCode(http.StatusMethodNotAllowed)
-		s.reportError(ctx, ErrKind_MethodNotAllowed, "")
+func (b *backendS3) ReadObject(ctx context.Context, bucket, key string, maxSize int64) (_ []byte, _ *objectInfo, err error) {
+	var obj *minio.Object
+	if obj, err = b.s3c.GetObject(ctx, bucket, key, minio.GetObjectOptions{}); err != nil {
+		return
+	}
+	defer obj.Close()
+	var info minio.ObjectInfo
+	if info, err = obj.Stat(); err != nil {
+		return
+	}
+	if info.Size > maxSize {
+		return nil, nil, errors.Errorf("object is larger than %d bytes", maxSize)
+	}
+	var body []byte
+	if body, err = io.ReadAll(io.LimitReader(obj, maxSize)); err != nil {
 		return
 	}
+	return body, &objectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+	}, nil
+}
+
+func (b *backendS3) ListObjects(ctx context.Context, bucket, prefix, token string, maxKeys int) (_ *objectList, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var infos []minio.ObjectInfo
+	for info := range b.s3c.ListObjects(ctx, bucket, minio.ListObjectsOptions{
+		Prefix:     prefix,
+		StartAfter: token,
+		MaxKeys:    maxKeys + 1,
+	}) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		if info.Key == prefix || info.Key == token {
+			// folder marker, or keys under a prefix token rolled up
+			// into it again
+			continue
+		}
+		infos = append(infos, info)
+		if len(infos) > maxKeys {
+			break
+		}
+	}
+	// a page lists its objects before its common prefixes
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
 
-	if isMethodHead {
-		// Doc: https://www.rfc-editor.org/rfc/rfc9110.html#section-9.3.2-1
-		ctx.Response.Header.Set("Content-Length", "0")
+	list := &objectList{}
+	if len(infos) > maxKeys {
+		infos = infos[:maxKeys]
+		list.NextToken = infos[maxKeys-1].Key
+	}
+	for _, info := range infos {
+		if strings.HasSuffix(info.Key, "/") {
+			list.Prefixes = append(list.Prefixes, info.Key)
+			continue
+		}
+		list.Objects = append(list.Objects, objectInfo{
+			Key:          info.Key,
+			Size:         info.Size,
+			ContentType:  info.ContentType,
+			ETag:         info.ETag,
+			LastModified: info.LastModified,
+		})
 	}
+	return list, nil
+}
 
-	bucketName := s.opts.BucketName
-	isVirtualHostStyle := isVirtualHostStyleRequest(s.s3c, *s.s3c.EndpointURL(), bucketName)
+// signerS3V2 presigns S3 V2 URLs, without expiry the URL lasts ~250years.
+type signerS3V2 struct {
+	opts obsOptions
+	ps   *s3Presigner
+	sets *s3CredentialSets
+}
 
-	path := ctx.Path()
-	_path := bytes.TrimLeft(path, "/")
-	if s.opts.RemoveBucketName {
-		if _, _pathWithoutBucketName, found := bytes.Cut(_path, []byte(`/`)); found {
-			// no need to check `isVirtualHostStyle` since this is our own implementation of handling request URI
-			_path = _pathWithoutBucketName
+func (s *signerS3V2) Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error) {
+	s.opts = opts.GetOpts()
+	s3opts := opts.GetS3Opts()
+	var creds *s3Credentials
+	if creds, err = clients.S3Credentials(); err != nil {
+		return
+	}
+	if s.ps, err = newS3Presigner(s3opts.Endpoint, s3opts.Secure, s3opts.Region, s3opts.BucketLookup, creds); err != nil {
+		err = errors.Wrap(err, "s3 presigner")
+		return
+	}
+	if s3opts.CredentialSetsFile != "" {
+		if s.sets, err = clients.S3CredentialSets(ctx); err != nil {
+			err = errors.Wrap(err, "s3 credential sets")
+			return
 		}
 	}
-	objectName := unsafeByteSliceToString(_path)
+	return
+}
 
-	s.logger.Debugw("handle",
-		"bucket", bucketName,
-		"objectName", objectName)
+func (s *signerS3V2) Name() string {
+	return signerS3V2Name
+}
 
-	// check if we had access to the object
-	if meta, err := s.s3c.StatObject(ctx, bucketName, objectName, minio.GetObjectOptions{}); err != nil {
-		ctx.SetStatusCode(http.StatusNotFound)
-		s.reportError(ctx, ErrKind_ResourceNotFound, err)
+func (s *signerS3V2) signsResponseOverrides() {}
+func (s *signerS3V2) signsVersions()          {}
+
+func (s *signerS3V2) SignURL(ctx context.Context, sreq signRequest) (_ *signedURL, err error) {
+	// V2 has no lifetime limit, the URL expires at an absolute time.
+	var ps *s3Presigner
+	if ps, err = presignerOf(s.ps, s.sets, sreq.Credentials); err != nil {
+		return
+	}
+	var u *url.URL
+	var expireAt time.Time
+	if u, expireAt, err = ps.PresignV2(ctx, sreq.Method, sreq.Bucket, sreq.Key, sreq.query(), sreq.expireAt(time.Now())); err != nil {
+		err = errors.Wrap(err, "presign")
 		return
-	} else {
-		_ = meta
 	}
 
-	// compose initial request
-	expireSeconds := int64(s.opts.URLExpiry / time.Second)
-	req, err := newRequest(s.s3c, ctx, http.MethodGet, requestMetadata{
-		presignURL:  true,
-		bucketName:  bucketName,
-		objectName:  objectName,
-		expires:     expireSeconds, // to trigger presigned generator
-		queryValues: url.Values{},
-	})
-	if err != nil {
-		ctx.SetStatusCode(http.StatusInternalServerError)
-		s.reportError(ctx, ErrKind_S3ComposeRequest, err)
+	// host isn't part of a V2 signature
+	overrideRedirectURL(u, s.opts)
+	return &signedURL{
+		URL:      u.String(),
+		ExpireAt: expireAt,
+	}, nil
+}
+
+// signerS3V4 presigns S3 V4 URLs, which last 7 days at most.
+type signerS3V4 struct {
+	opts obsOptions
+	// signs for the redirected host since the host is part of the
+	// signature.
+	ps   *s3Presigner
+	sets *s3CredentialSets
+}
+
+func (s *signerS3V4) Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error) {
+	s.opts = opts.GetOpts()
+	s3opts := opts.GetS3Opts()
+
+	endpoint := s3opts.Endpoint
+	if s.opts.HostRedirect != "" {
+		endpoint = s.opts.HostRedirect
+	}
+	var creds *s3Credentials
+	if creds, err = clients.S3Credentials(); err != nil {
+		return
+	}
+	if s.ps, err = newS3Presigner(endpoint, s.opts.RedirectSecure, s3opts.Region, s3opts.BucketLookup, creds); err != nil {
+		err = errors.Wrap(err, "s3 presigner")
 		return
 	}
+	if s3opts.CredentialSetsFile != "" {
+		if s.sets, err = clients.S3CredentialSets(ctx); err != nil {
+			err = errors.Wrap(err, "s3 credential sets")
+			return
+		}
+	}
+	return
+}
 
-	// grab creds from provider
-	value, err := getCredsProvider(s.s3c).Get()
-	if err != nil {
-		ctx.SetStatusCode(http.StatusInternalServerError)
-		s.reportError(ctx, ErrKind_S3CredsProvider, err)
+func (s *signerS3V4) Name() string {
+	return signerS3V4Name
+}
+
+func (s *signerS3V4) signsResponseOverrides() {}
+func (s *signerS3V4) signsVersions()          {}
+
+func (s *signerS3V4) SignURL(ctx context.Context, sreq signRequest) (_ *signedURL, err error) {
+	expiry := sreq.Expiry
+	if expiry == maxURLExpiry || expiry <= 0 || expiry > maxS3V4URLExpiry {
+		expiry = maxS3V4URLExpiry
+	}
+	var ps *s3Presigner
+	if ps, err = presignerOf(s.ps, s.sets, sreq.Credentials); err != nil {
 		return
 	}
+	now := time.Now()
+	var u *url.URL
+	var expireAt time.Time
+	if u, expireAt, err = ps.PresignV4(ctx, sreq.Method, sreq.Bucket, sreq.Key, sreq.query(), now.UTC().Add(expiry), now); err != nil {
+		err = errors.Wrap(err, "presign")
+		return
+	}
+	return &signedURL{
+		URL:      u.String(),
+		ExpireAt: expireAt,
+	}, nil
+}
 
-	var statusCode = s.opts.RedirectCode
+// presignerOf returns ps signing with the named credential set, empty
+// name is the default credentials.
+func presignerOf(ps *s3Presigner, sets *s3CredentialSets, credentials string) (*s3Presigner, error) {
+	if credentials == "" {
+		return ps, nil
+	}
+	if sets == nil {
+		return nil, errors.Errorf("credential set %q without credential sets file", credentials)
+	}
+	return ps.withCredentials(sets.Source(credentials)), nil
+}
 
-	// custom "expiry"
-	var exp string
-	if expiry := s.opts.URLExpiry; expiry == maxURLExpiry || expiry <= 0 {
-		// clear given params, set max signed value for expire, and re-presign.
-		exp = strconv.FormatInt(int64(^uint64(0)/2), 10) // ~250years
-	} else {
-		// we can't allow a permanent redirect here since we already have
-		// expiry set, the redirected url needs to be updated.
-		if statusCode == http.StatusMovedPermanently || (statusCode < 300 || statusCode > 399) {
-			statusCode = http.StatusTemporaryRedirect
-		}
+// uploaderS3 presigns V4 PUT uploads, signing content type and length
+// so the client can't upload anything else. Multipart uploads are
+// initiated and completed by the server, parts are presigned.
+type uploaderS3 struct {
+	signerS3V4
+	core minio.Core
+
+	s3opts obsS3Options
+	mu     sync.Mutex
+	// clients of credential sets
+	cores map[string]minio.Core
+}
+
+func (u *uploaderS3) Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error) {
+	if err = u.signerS3V4.Init(ctx, opts, clients); err != nil {
+		return
+	}
+	if u.core.Client, err = clients.S3(); err != nil {
+		err = errors.Wrap(err, "obs s3 client")
+		return
+	}
+	u.s3opts = opts.GetS3Opts()
+	u.cores = map[string]minio.Core{}
+	return
+}
 
-		expireAt := time.Now().UTC().Add(s.opts.URLExpiry)
-		exp = strconv.FormatInt(int64(expireAt.Unix()), 10)
-		// set redirect cache lifetime
-		if statusCode == http.StatusTemporaryRedirect {
-			ctx.Response.Header.Set("Cache-Control", fmt.Sprintf("max-age=%d", expireSeconds))
-			ctx.Response.Header.Set("Expires", expireAt.Format("Mon, 02 Jan 2006 15:04:05 GMT"))
+// coreOf returns the client of a credential set, multipart uploads are
+// initiated, completed and aborted under the identity their parts are
+// signed with.
+func (u *uploaderS3) coreOf(credentials string) (_ minio.Core, err error) {
+	if credentials == "" {
+		return u.core, nil
+	}
+	if u.sets == nil {
+		err = errors.Errorf("credential set %q without credential sets file", credentials)
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	core, exist := u.cores[credentials]
+	if !exist {
+		if core.Client, err = newObsS3Client(u.s3opts, u.sets.Source(credentials)); err != nil {
+			err = errors.Wrapf(err, "obs s3 client of credential set %q", credentials)
+			return
 		}
+		u.cores[credentials] = core
+	}
+	return core, nil
+}
+
+func (u *uploaderS3) Name() string {
+	return backendS3Name
+}
+
+func (u *uploaderS3) SignUpload(ctx context.Context, ureq uploadRequest) (_ *signedUpload, err error) {
+	var ps *s3Presigner
+	if ps, err = presignerOf(u.ps, u.sets, ureq.Credentials); err != nil {
+		return
+	}
+	return presignS3Upload(ctx, ps, ureq)
+}
+
+// presignS3Upload presigns a V4 PUT of ureq, which lasts 7 days at most.
+func presignS3Upload(ctx context.Context, ps *s3Presigner, ureq uploadRequest) (_ *signedUpload, err error) {
+	expiry := ureq.Expiry
+	if expiry <= 0 || expiry > maxS3V4URLExpiry {
+		expiry = maxS3V4URLExpiry
+	}
+	headers := uploadHeaders(ureq)
+	now := time.Now()
+	var u *url.URL
+	var expireAt time.Time
+	if u, expireAt, err = ps.PresignV4Headers(ctx, http.MethodPut, ureq.Bucket, ureq.Key, nil, headers, now.UTC().Add(expiry), now); err != nil {
+		err = errors.Wrap(err, "presign")
+		return
 	}
-	req.Header.Set("Expires", exp)
-	req.URL.RawQuery = ""
-	req = signer.PreSignV2(*req, value.AccessKeyID, value.SecretAccessKey, 0, isVirtualHostStyle)
+	return &signedUpload{
+		Method:   http.MethodPut,
+		URL:      u.String(),
+		Headers:  headers,
+		ExpireAt: expireAt,
+	}, nil
+}
 
-	// re-encode query string with Expires hack.
-	query := req.URL.Query()
-	query.Set("Expires", exp)
-	req.URL.RawQuery = s3utils.QueryEncode(query)
+func (u *uploaderS3) SignPostPolicy(ctx context.Context, preq postPolicyRequest) (_ *signedPostPolicy, err error) {
+	var ps *s3Presigner
+	if ps, err = presignerOf(u.ps, u.sets, preq.Credentials); err != nil {
+		return
+	}
+	return presignS3PostPolicy(ctx, ps, preq)
+}
 
-	if s.opts.RedirectSecure {
-		req.URL.Scheme = "https"
+// presignS3PostPolicy signs a V4 POST policy of preq, which lasts 7
+// days at most.
+func presignS3PostPolicy(ctx context.Context, ps *s3Presigner, preq postPolicyRequest) (_ *signedPostPolicy, err error) {
+	expiry := preq.Expiry
+	if expiry <= 0 || expiry > maxS3V4URLExpiry {
+		expiry = maxS3V4URLExpiry
+	}
+	pp := minio.NewPostPolicy()
+	fields := map[string]string{"key": preq.Key}
+	if err = pp.SetKey(preq.Key); err != nil {
+		return
+	}
+	if preq.ContentTypePrefix {
+		err = pp.SetContentTypeStartsWith(preq.ContentType)
 	} else {
-		req.URL.Scheme = "http"
+		err = pp.SetContentType(preq.ContentType)
+	}
+	if err != nil {
+		return
+	}
+	fields["Content-Type"] = preq.ContentType
+	if err = pp.SetContentLengthRange(1, preq.MaxSize); err != nil {
+		return
+	}
+	if preq.SuccessRedirect != "" {
+		if err = pp.SetSuccessActionRedirect(preq.SuccessRedirect); err != nil {
+			return
+		}
+		fields["success_action_redirect"] = preq.SuccessRedirect
 	}
 
-	if hostRedirect := s.opts.HostRedirect; hostRedirect != "" {
-		req.URL.Host = hostRedirect
+	now := time.Now()
+	var u *url.URL
+	var expireAt time.Time
+	if u, expireAt, err = ps.PresignPostPolicy(ctx, preq.Bucket, pp, fields, now.UTC().Add(expiry), now); err != nil {
+		err = errors.Wrap(err, "presign post policy")
+		return
 	}
+	return &signedPostPolicy{
+		URL:      u.String(),
+		Fields:   fields,
+		ExpireAt: expireAt,
+	}, nil
+}
 
-	ctx.Redirect(req.URL.String(), statusCode)
+func (u *uploaderS3) NewMultipartUpload(ctx context.Context, ureq uploadRequest) (_ string, err error) {
+	var core minio.Core
+	if core, err = u.coreOf(ureq.Credentials); err != nil {
+		return
+	}
+	return core.NewMultipartUpload(ctx, ureq.Bucket, ureq.Key, minio.PutObjectOptions{
+		ContentType: ureq.ContentType,
+	})
 }
 
-func (s *serverS3) GetHandler() fasthttp.RequestHandler {
-	return s.handle
+func (u *uploaderS3) SignUploadPart(ctx context.Context, ureq uploadRequest, uploadID string, partNumber int) (_ *signedUpload, err error) {
+	expiry := ureq.Expiry
+	if expiry <= 0 || expiry > maxS3V4URLExpiry {
+		expiry = maxS3V4URLExpiry
+	}
+	var ps *s3Presigner
+	if ps, err = presignerOf(u.ps, u.sets, ureq.Credentials); err != nil {
+		return
+	}
+	query := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadID},
+	}
+	now := time.Now()
+	var pu *url.URL
+	var expireAt time.Time
+	if pu, expireAt, err = ps.PresignV4(ctx, http.MethodPut, ureq.Bucket, ureq.Key, query, now.UTC().Add(expiry), now); err != nil {
+		err = errors.Wrap(err, "presign")
+		return
+	}
+	return &signedUpload{
+		Method:   http.MethodPut,
+		URL:      pu.String(),
+		ExpireAt: expireAt,
+	}, nil
+}
+
+func (u *uploaderS3) CompleteMultipartUpload(ctx context.Context, ureq uploadRequest, uploadID string, parts []uploadPart, maxSize int64) (etag string, err error) {
+	var core minio.Core
+	if core, err = u.coreOf(ureq.Credentials); err != nil {
+		return
+	}
+	// only the completed parts count, check the uploaded ones
+	sizes := map[int]int64{}
+	for marker := 0; ; {
+		var res minio.ListObjectPartsResult
+		if res, err = core.ListObjectParts(ctx, ureq.Bucket, ureq.Key, uploadID, marker, 1000); err != nil {
+			err = errors.Wrap(err, "list parts")
+			return
+		}
+		for _, part := range res.ObjectParts {
+			sizes[part.PartNumber] = part.Size
+		}
+		if !res.IsTruncated {
+			break
+		}
+		marker = res.NextPartNumberMarker
+	}
+	var size int64
+	completeParts := make([]minio.CompletePart, 0, len(parts))
+	for _, part := range parts {
+		size += sizes[part.PartNumber]
+		completeParts = append(completeParts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+	}
+	if size > maxSize {
+		err = errors.Wrapf(errUploadTooLarge, "%d bytes", size)
+		return
+	}
+	if etag, err = core.CompleteMultipartUpload(ctx, ureq.Bucket, ureq.Key, uploadID, completeParts, minio.PutObjectOptions{}); err != nil {
+		err = errors.Wrap(err, "complete")
+		return
+	}
+	return
+}
+
+func (u *uploaderS3) AbortMultipartUpload(ctx context.Context, ureq uploadRequest, uploadID string) (err error) {
+	var core minio.Core
+	if core, err = u.coreOf(ureq.Credentials); err != nil {
+		return
+	}
+	return core.AbortMultipartUpload(ctx, ureq.Bucket, ureq.Key, uploadID)
+}
+
+func (u *uploaderS3) AbortStaleUploads(ctx context.Context, bucket, prefix, credentials string, initiatedBefore time.Time) (n int, err error) {
+	var core minio.Core
+	if core, err = u.coreOf(credentials); err != nil {
+		return
+	}
+	var keyMarker, uploadIDMarker string
+	for {
+		var res minio.ListMultipartUploadsResult
+		if res, err = core.ListMultipartUploads(ctx, bucket, prefix, keyMarker, uploadIDMarker, "", 1000); err != nil {
+			err = errors.Wrap(err, "list multipart uploads")
+			return
+		}
+		for _, upload := range res.Uploads {
+			if !upload.Initiated.Before(initiatedBefore) {
+				continue
+			}
+			if err = core.AbortMultipartUpload(ctx, bucket, upload.Key, upload.UploadID); err != nil {
+				err = errors.Wrapf(err, "abort %q", upload.Key)
+				return
+			}
+			n++
+		}
+		if !res.IsTruncated {
+			return
+		}
+		keyMarker, uploadIDMarker = res.NextKeyMarker, res.NextUploadIDMarker
+	}
 }
@@ -1,117 +1,238 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"fmt"
-	"net/http"
+	"io"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/valyala/fasthttp"
-	"go.uber.org/zap"
+	"storj.io/uplink"
 	"storj.io/uplink/edge"
 )
 
 type serverStorj struct {
-	opts   obsOptions
-	logger *zap.SugaredLogger
-
-	sc *storjAggegrateClient
+	signingHandler
 }
 
 func (s *serverStorj) Init(ctx context.Context, opts serverOptions) (err error) {
-	s.opts = opts.GetOpts()
-	s.logger = opts.Logger.Named(s.Name()).Sugar()
-	{
-		if s.sc, err = newObsStorjClient(ctx, opts.GetUplinkOpts()); err != nil {
-			err = errors.Wrap(err, "obs uplink client")
-			return
-		}
-	}
-	return
+	// route checks depend on proxy mode
+	s.proxy = opts.GetUplinkOpts().Proxy
+	return s.signingHandler.Init(ctx, opts, s.Name(), backendStorjName, signerStorjName)
 }
 
 func (s *serverStorj) Name() string {
 	return "storj"
 }
 
-func (s *serverStorj) getLogger() *zap.SugaredLogger { return s.logger }
-func (s *serverStorj) reportError(ctx *fasthttp.RequestCtx, errType string, err any) {
-	reportError(s, ctx, errType, err)
+func (s *serverStorj) GetHandler() fasthttp.RequestHandler {
+	return s.handle
 }
 
-var (
-	ErrKind_StorjComposeShareURL = "STORJ_COMPOSE_SHARE_URL"
+const (
+	backendStorjName = "storj"
+	signerStorjName  = "storj"
 )
 
-func (s *serverStorj) handle(ctx *fasthttp.RequestCtx) {
-	isMethodGet := bytes.Equal(ctx.Method(), MethodGet)
-	isMethodHead := bytes.Equal(ctx.Method(), MethodHead)
-	if !(isMethodGet || isMethodHead) {
-		ctx.SetStatusCode(http.StatusMethodNotAllowed)
-		s.reportError(ctx, ErrKind_MethodNotAllowed, "")
+type backendStorj struct {
+	sc *storjAggegrateClient
+	// proxied downloads
+	parallelism int
+	chunkSize   int64
+}
+
+func (b *backendStorj) Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error) {
+	if b.sc, err = clients.Storj(ctx); err != nil {
+		err = errors.Wrap(err, "obs uplink client")
 		return
 	}
+	uplinkOpts := opts.GetUplinkOpts()
+	b.parallelism, b.chunkSize = uplinkOpts.ProxyParallelism, uplinkOpts.ProxyChunkSize
+	if uplinkOpts.Proxy && b.sc.getProject() == nil {
+		err = errors.New("proxy needs an access grant or api key")
+	}
+	return
+}
+
+func (b *backendStorj) Name() string {
+	return backendStorjName
+}
 
-	if isMethodHead {
-		// Doc: https://www.rfc-editor.org/rfc/rfc9110.html#section-9.3.2-1
-		ctx.Response.Header.Set("Content-Length", "0")
+func (b *backendStorj) StatObject(ctx context.Context, bucket, key string) (*objectInfo, error) {
+	// use project
+	project := b.sc.getProject()
+	if project == nil {
+		// custom accessKeyID only, there's nothing to check against.
+		return &objectInfo{Key: key}, nil
 	}
+	obj, err := project.StatObject(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return &objectInfo{
+		Key:          obj.Key,
+		Size:         obj.System.ContentLength,
+		ContentType:  obj.Custom["content-type"],
+		LastModified: obj.System.Created,
+	}, nil
+}
 
-	bucketName := s.opts.BucketName
-	path := ctx.Path()
-	_path := bytes.TrimLeft(path, "/")
-	if s.opts.RemoveBucketName {
-		if _, _pathWithoutBucketName, found := bytes.Cut(_path, []byte(`/`)); found {
-			// no need to check `isVirtualHostStyle` since this is our own implementation of handling request URI
-			_path = _pathWithoutBucketName
+func (b *backendStorj) ListObjects(ctx context.Context, bucket, prefix, token string, maxKeys int) (_ *objectList, err error) {
+	project := b.sc.getProject()
+	if project == nil {
+		return nil, errors.New("listing needs an access grant")
+	}
+	it := project.ListObjects(ctx, bucket, &uplink.ListObjectsOptions{
+		Prefix: prefix,
+		Cursor: strings.TrimPrefix(token, prefix),
+		System: true,
+	})
+	list := &objectList{}
+	var n int
+	var last string
+	for it.Next() {
+		obj := it.Item()
+		if n == maxKeys {
+			list.NextToken = last
+			break
+		}
+		n++
+		last = obj.Key
+		if obj.IsPrefix {
+			list.Prefixes = append(list.Prefixes, obj.Key)
+			continue
 		}
+		list.Objects = append(list.Objects, objectInfo{
+			Key:          obj.Key,
+			Size:         obj.System.ContentLength,
+			LastModified: obj.System.Created,
+		})
 	}
-	objectName := unsafeByteSliceToString(_path)
-
-	s.logger.Debugw("handle",
-		"bucket", bucketName,
-		"objectName", objectName)
+	if err = it.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
 
-	// use project
-	if project := s.sc.getProject(); project != nil {
-		// check if we had access to the object
-		if meta, err := project.StatObject(ctx, bucketName, objectName); err != nil {
-			ctx.SetStatusCode(http.StatusNotFound)
-			s.reportError(ctx, ErrKind_ResourceNotFound, err)
-			return
-		} else {
-			_ = meta
+// DownloadObject streams the object from the storage nodes, chunks are
+// downloaded in parallel.
+func (b *backendStorj) DownloadObject(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error) {
+	project := b.sc.getProject()
+	if project == nil {
+		return nil, errors.New("download needs an access grant")
+	}
+	return newParallelDownload(ctx, func(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		download, err := project.DownloadObject(ctx, bucket, key, &uplink.DownloadOptions{
+			Offset: offset,
+			Length: length,
+		})
+		if err != nil {
+			cancel()
+			return nil, err
 		}
+		return &storjDownload{Download: download, cancel: cancel}, nil
+	}, offset, length, b.chunkSize, b.parallelism)
+}
+
+// storjDownload cancels the download context once closed.
+type storjDownload struct {
+	*uplink.Download
+	cancel context.CancelFunc
+}
+
+func (d *storjDownload) Close() error {
+	defer d.cancel()
+	return d.Download.Close()
+}
+
+// signerStorj joins linkshare URLs, those don't expire by themselves,
+// expiry is only used as cache hint.
+type signerStorj struct {
+	sc *storjAggegrateClient
+}
+
+func (s *signerStorj) Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error) {
+	if s.sc, err = clients.Storj(ctx); err != nil {
+		err = errors.Wrap(err, "obs uplink client")
+		return
 	}
+	return
+}
+
+func (s *signerStorj) Name() string {
+	return signerStorjName
+}
 
-	shareURL, err := s.sc.JoinShareURL(bucketName, objectName, &edge.ShareURLOptions{
+func (s *signerStorj) SignURL(ctx context.Context, sreq signRequest) (_ *signedURL, err error) {
+	var shareURL string
+	var notAfter time.Time
+	if shareURL, notAfter, err = s.sc.JoinShareURL(ctx, sreq.Bucket, sreq.Key, &edge.ShareURLOptions{
 		Raw: true,
-	})
-	if err != nil {
-		ctx.SetStatusCode(http.StatusInternalServerError)
-		s.reportError(ctx, ErrKind_StorjComposeShareURL, err)
+	}); err != nil {
+		err = errors.Wrap(err, "compose share url")
+		return
 	}
+	// the URL stops working along with the registered share
+	expireAt := sreq.expireAt(time.Now())
+	if !notAfter.IsZero() && (expireAt.IsZero() || notAfter.Before(expireAt)) {
+		expireAt = notAfter
+	}
+	return &signedURL{
+		URL:      shareURL,
+		ExpireAt: expireAt,
+	}, nil
+}
 
-	var statusCode = s.opts.RedirectCode
+// uploaderStorj presigns uploads to the S3 compatible gateway with the
+// registered edge credentials.
+type uploaderStorj struct {
+	sc *storjAggegrateClient
+}
 
-	if statusCode < 300 || statusCode >= 399 {
-		// fallback of invalid redirect code
-		statusCode = http.StatusTemporaryRedirect
+func (u *uploaderStorj) Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error) {
+	if u.sc, err = clients.Storj(ctx); err != nil {
+		err = errors.Wrap(err, "obs uplink client")
+		return
 	}
+	return
+}
+
+func (u *uploaderStorj) Name() string {
+	return backendStorjName
+}
 
-	expireAt := time.Now().UTC().Add(s.opts.URLExpiry)
-	expireSeconds := int64(s.opts.URLExpiry / time.Second)
-	// set redirect cache lifetime
-	if statusCode == http.StatusTemporaryRedirect {
-		ctx.Response.Header.Set("Cache-Control", fmt.Sprintf("max-age=%d", expireSeconds))
-		ctx.Response.Header.Set("Expires", expireAt.Format("Mon, 02 Jan 2006 15:04:05 GMT"))
+func (u *uploaderStorj) SignUpload(ctx context.Context, ureq uploadRequest) (_ *signedUpload, err error) {
+	var ps *s3Presigner
+	if ps, err = u.presigner(ctx); err != nil {
+		return
 	}
+	return presignS3Upload(ctx, ps, ureq)
+}
 
-	ctx.Redirect(shareURL, s.opts.RedirectCode)
+func (u *uploaderStorj) SignPostPolicy(ctx context.Context, preq postPolicyRequest) (_ *signedPostPolicy, err error) {
+	var ps *s3Presigner
+	if ps, err = u.presigner(ctx); err != nil {
+		return
+	}
+	return presignS3PostPolicy(ctx, ps, preq)
 }
 
-func (s *serverStorj) GetHandler() fasthttp.RequestHandler {
-	return s.handle
+// presigner returns a presigner of the gateway for the edge credentials.
+func (u *uploaderStorj) presigner(ctx context.Context) (_ *s3Presigner, err error) {
+	var creds *edge.Credentials
+	if creds, err = u.sc.UploadCredentials(ctx); err != nil {
+		return
+	}
+	var endpoint *url.URL
+	if endpoint, err = url.Parse(creds.Endpoint); err != nil {
+		err = errors.Wrap(err, "gateway endpoint")
+		return
+	}
+	return newS3Presigner(endpoint.Host, endpoint.Scheme == "https", "", s3BucketLookupPath, &s3StaticSource{value: s3Creds{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretKey,
+	}})
 }
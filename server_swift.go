@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+type serverSwift struct {
+	signingHandler
+}
+
+func (s *serverSwift) Init(ctx context.Context, opts serverOptions) (err error) {
+	return s.signingHandler.Init(ctx, opts, s.Name(), backendSwiftName, signerSwiftName)
+}
+
+func (s *serverSwift) Name() string {
+	return "swift"
+}
+
+func (s *serverSwift) GetHandler() fasthttp.RequestHandler {
+	return s.handle
+}
+
+const (
+	backendSwiftName = "swift"
+	signerSwiftName  = "swift"
+)
+
+type backendSwift struct {
+	sw *swiftClient
+}
+
+func (b *backendSwift) Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error) {
+	if b.sw, err = clients.Swift(ctx); err != nil {
+		err = errors.Wrap(err, "obs swift client")
+		return
+	}
+	return
+}
+
+func (b *backendSwift) Name() string {
+	return backendSwiftName
+}
+
+func (b *backendSwift) StatObject(ctx context.Context, bucket, key string) (*objectInfo, error) {
+	header, err := b.sw.StatObject(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return objectInfoFromHeader(key, header), nil
+}
+
+// signerSwift generates TempURLs.
+type signerSwift struct {
+	opts obsOptions
+	sw   *swiftClient
+}
+
+func (s *signerSwift) Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error) {
+	s.opts = opts.GetOpts()
+	if s.sw, err = clients.Swift(ctx); err != nil {
+		err = errors.Wrap(err, "obs swift client")
+		return
+	}
+	return
+}
+
+func (s *signerSwift) Name() string {
+	return signerSwiftName
+}
+
+func (s *signerSwift) SignURL(ctx context.Context, sreq signRequest) (_ *signedURL, err error) {
+	expires, expireAt := sreq.expires(time.Now())
+	u := s.sw.TempURL(sreq.Method, sreq.Bucket, sreq.Key, expires)
+
+	// host is not part of the TempURL signature
+	overrideRedirectURL(u, s.opts)
+	return &signedURL{
+		URL:      u.String(),
+		ExpireAt: expireAt,
+	}, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	maxSignObjects = 1000
+	// objects stat and signed at once per batch
+	signConcurrency = 8
+)
+
+// responseOverrideParams are the response header overrides a signed
+// URL may carry.
+var responseOverrideParams = map[string]bool{
+	"response-cache-control":       true,
+	"response-content-disposition": true,
+	"response-content-encoding":    true,
+	"response-content-language":    true,
+	"response-content-type":        true,
+	"response-expires":             true,
+}
+
+type apiSignRequest struct {
+	Objects []apiSignObject `json:"objects"`
+}
+
+type apiSignObject struct {
+	// empty is the served bucket, the only one allowed
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key"`
+	// explicit object version, empty or `latest` is the latest
+	VersionID string `json:"version_id,omitempty"`
+	// zero is the server URL expiry, which caps it
+	Expiry jsonDuration `json:"expiry,omitempty"`
+	// GET or HEAD, empty is GET
+	Method string `json:"method,omitempty"`
+	// ex. {"response-content-disposition":"attachment"}
+	ResponseOverrides map[string]string `json:"response_overrides,omitempty"`
+}
+
+type apiSignResponse struct {
+	Objects []apiSignedObject `json:"objects"`
+}
+
+// apiSignedObject is the result of an apiSignObject in the same
+// position, failures are reported per object.
+type apiSignedObject struct {
+	Bucket       string        `json:"bucket"`
+	Key          string        `json:"key"`
+	Exists       bool          `json:"exists"`
+	Size         int64         `json:"size,omitempty"`
+	ContentType  string        `json:"content_type,omitempty"`
+	ETag         string        `json:"etag,omitempty"`
+	LastModified *time.Time    `json:"last_modified,omitempty"`
+	VersionID    string        `json:"version_id,omitempty"`
+	URL          string        `json:"url,omitempty"`
+	ExpiresAt    *time.Time    `json:"expires_at,omitempty"`
+	Cookies      []string      `json:"cookies,omitempty"`
+	Error        *apiErrorBody `json:"error,omitempty"`
+}
+
+// sign signs a batch of object URLs the way the redirect handler does,
+// objects failing a check or missing get an error instead of a URL.
+func (h *signingHandler) sign(ctx *fasthttp.RequestCtx, callCtx context.Context) {
+	if !ctx.IsPost() {
+		h.apiError(ctx, http.StatusMethodNotAllowed, ErrKind_MethodNotAllowed, "")
+		return
+	}
+	var req apiSignRequest
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_InvalidRequest, err)
+		return
+	}
+	if len(req.Objects) == 0 || len(req.Objects) > maxSignObjects {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_InvalidRequest, fmt.Sprintf("objects must have 1 to %d entries", maxSignObjects))
+		return
+	}
+
+	res := apiSignResponse{Objects: make([]apiSignedObject, len(req.Objects))}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, signConcurrency)
+	for i := range req.Objects {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			res.Objects[i] = h.signObject(callCtx, req.Objects[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var failed int
+	for _, o := range res.Objects {
+		if o.Error != nil {
+			failed++
+		}
+	}
+	h.logger.Infow("sign",
+		"bucket", h.opts.BucketName,
+		"objects", len(res.Objects),
+		"failed", failed)
+	h.apiJSON(ctx, http.StatusOK, res)
+}
+
+// signObject checks and signs a single object of a batch.
+func (h *signingHandler) signObject(ctx context.Context, obj apiSignObject) (res apiSignedObject) {
+	res.Bucket, res.Key = obj.Bucket, obj.Key
+	fail := func(code, message string) apiSignedObject {
+		res.Error = &apiErrorBody{Code: code, Message: message}
+		return res
+	}
+
+	bucketName := h.opts.BucketName
+	if obj.Bucket == "" {
+		res.Bucket = bucketName
+	} else if obj.Bucket != bucketName {
+		return fail(ErrKind_InvalidRequest, fmt.Sprintf("bucket %q isn't served", obj.Bucket))
+	}
+	method := strings.ToUpper(obj.Method)
+	switch method {
+	case "":
+		method = http.MethodGet
+	case http.MethodGet, http.MethodHead:
+	default:
+		return fail(ErrKind_MethodNotAllowed, fmt.Sprintf("method %q not allowed", obj.Method))
+	}
+	objectName, err := normalizeKey(obj.Key, h.opts.KeyPolicy, h.opts.MaxKeyLength)
+	if err == nil && objectName == "" {
+		err = errKeyInvalidChar
+	}
+	if err != nil {
+		return fail(ErrKind_InvalidObjectKey, err.Error())
+	}
+	res.Key = objectName
+	// blocked keys are reported as not found like redirects do
+	if !h.filter.Allow(objectName) {
+		return fail(ErrKind_ResourceNotFound, "object not found")
+	}
+
+	// route rules apply like on redirects, explicit overrides win
+	r := h.routes.Match(objectName)
+	var overrides url.Values
+	if r != nil && r.Response != nil {
+		overrides, _ = h.responses.Of(&fasthttp.Args{}, r.Response, objectName)
+	}
+	for k, v := range obj.ResponseOverrides {
+		k = strings.ToLower(k)
+		if !responseOverrideParams[k] || !validHeaderValue(v) {
+			return fail(ErrKind_InvalidRequest, fmt.Sprintf("response override %q not allowed", k))
+		}
+		if overrides == nil {
+			overrides = url.Values{}
+		}
+		overrides.Set(k, v)
+	}
+	if err = checkResponseOverrides(h.signerOf(r), overrides); err != nil {
+		return fail(ErrKind_ResponseOverride, err.Error())
+	}
+	// the API may select versions without the `versionId` query rule
+	var versionID string
+	if obj.VersionID != "" {
+		if versionID, err = checkVersionID(obj.VersionID); err != nil {
+			return fail(ErrKind_ObjectVersion, err.Error())
+		}
+	}
+	if _, ok := h.signerOf(r).(versionSigner); !ok && versionID != "" {
+		return fail(ErrKind_ObjectVersion, errVersionsUnsupported.Error())
+	}
+	signReq := signRequest{
+		Method:            method,
+		Bucket:            bucketName,
+		Key:               objectName,
+		VersionID:         versionID,
+		Expiry:            h.opts.URLExpiry,
+		ResponseOverrides: overrides,
+	}
+	if expiry := time.Duration(obj.Expiry); expiry > 0 && (h.opts.URLExpiry <= 0 || expiry < h.opts.URLExpiry) {
+		signReq.Expiry = expiry
+	}
+	if r != nil {
+		signReq.RoutePrefix = r.Prefix
+		signReq.Credentials = r.Credentials
+	}
+
+	info, err := statVersion(ctx, h.backendOf(r), bucketName, objectName, versionID)
+	if errors.Cause(err) == errVersionsUnsupported {
+		return fail(ErrKind_ObjectVersion, err.Error())
+	}
+	if err != nil {
+		h.logger.Debugw("sign stat",
+			"bucket", bucketName,
+			"objectName", objectName,
+			"error", err)
+		return fail(ErrKind_ResourceNotFound, "object not found")
+	}
+	res.Exists = true
+	res.Size = info.Size
+	res.ContentType = info.ContentType
+	res.ETag = info.ETag
+	if versionID == "" && h.versionOf(r).PinLatest {
+		signReq.VersionID = pinnedVersion(info)
+	}
+	res.VersionID = signReq.VersionID
+	if !info.LastModified.IsZero() {
+		lastModified := info.LastModified.UTC()
+		res.LastModified = &lastModified
+	}
+
+	signed, err := h.signerOf(r).SignURL(ctx, signReq)
+	if err != nil {
+		h.logger.Errorw("sign",
+			"bucket", bucketName,
+			"objectName", objectName,
+			"error", err)
+		return fail(ErrKind_SignURL, "failed to sign URL")
+	}
+	res.URL = signed.URL
+	if !signed.ExpireAt.IsZero() {
+		res.ExpiresAt = &signed.ExpireAt
+	}
+	for _, cookie := range signed.Cookies {
+		res.Cookies = append(res.Cookies, cookie.String())
+	}
+	return
+}
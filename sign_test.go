@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigningHandlerSign(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "a"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a", "b.txt"), []byte("hello"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "secret.txt"), []byte("nope"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "100%.txt"), []byte("full"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a b.txt"), []byte("space"), 0o644))
+
+	opts := defaultObsOpts
+	opts.BucketName = "bucket"
+	opts.URLExpiry = time.Hour
+	opts.KeyPatterns = "!secret.txt"
+	apiOpts := defaultObsAPIOpts
+	apiOpts.Tokens = "token"
+	c := newTestServer(t, &serverFS{}, serverOptions{
+		Opts:    &opts,
+		FSOpts:  &obsFSOptions{Root: root, Secret: "test"},
+		APIOpts: &apiOpts,
+	})
+
+	resp := doTestAPIRequest(t, c, "http://signer/_api/sign", "token", `{"objects":[
+		{"key":"a/b.txt"},
+		{"bucket":"bucket","key":"/a//b.txt","expiry":"1m","method":"head"},
+		{"key":"a/b.txt","expiry":"2h"},
+		{"key":"a/missing.txt"},
+		{"key":"secret.txt"},
+		{"key":"../a/b.txt"},
+		{"key":""},
+		{"bucket":"other","key":"a/b.txt"},
+		{"key":"a/b.txt","method":"PUT"},
+		{"key":"a/b.txt","response_overrides":{"x-amz-acl":"public-read"}},
+		{"key":"a/b.txt","version_id":"v1"}
+	]}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode(), string(resp.Body()))
+	var res apiSignResponse
+	require.NoError(t, json.Unmarshal(resp.Body(), &res))
+	require.Len(t, res.Objects, 11)
+
+	o := res.Objects[0]
+	require.Nil(t, o.Error)
+	require.True(t, o.Exists)
+	require.Equal(t, "bucket", o.Bucket)
+	require.Equal(t, "a/b.txt", o.Key)
+	require.Equal(t, int64(5), o.Size)
+	require.NotNil(t, o.LastModified)
+	require.True(t, strings.HasPrefix(o.URL, "/_obj/a/b.txt?"), o.URL)
+	require.WithinDuration(t, time.Now().Add(time.Hour), *o.ExpiresAt, time.Minute)
+
+	require.Nil(t, res.Objects[1].Error)
+	require.Equal(t, "a/b.txt", res.Objects[1].Key)
+	require.WithinDuration(t, time.Now().Add(time.Minute), *res.Objects[1].ExpiresAt, time.Minute)
+	// the server expiry caps the requested one
+	require.WithinDuration(t, time.Now().Add(time.Hour), *res.Objects[2].ExpiresAt, time.Minute)
+
+	for i, code := range []string{
+		ErrKind_ResourceNotFound,
+		ErrKind_ResourceNotFound,
+		ErrKind_InvalidObjectKey,
+		ErrKind_InvalidObjectKey,
+		ErrKind_InvalidRequest,
+		ErrKind_MethodNotAllowed,
+		ErrKind_InvalidRequest,
+		ErrKind_ObjectVersion,
+	} {
+		o := res.Objects[i+3]
+		require.NotNil(t, o.Error, i+3)
+		require.Equal(t, code, o.Error.Code, i+3)
+		require.False(t, o.Exists, i+3)
+		require.Empty(t, o.URL, i+3)
+	}
+
+	// the signed URL is usable
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer"+res.Objects[0].URL)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	require.Equal(t, "hello", string(resp.Body()))
+
+	// keys are taken as is, not percent-decoded
+	resp = doTestAPIRequest(t, c, "http://signer/_api/sign", "token", `{"objects":[
+		{"key":"100%.txt"},
+		{"key":"a%20b.txt"}
+	]}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode(), string(resp.Body()))
+	res = apiSignResponse{}
+	require.NoError(t, json.Unmarshal(resp.Body(), &res))
+	require.Nil(t, res.Objects[0].Error)
+	require.Equal(t, "100%.txt", res.Objects[0].Key)
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer"+res.Objects[0].URL)
+	require.Equal(t, http.StatusOK, resp.StatusCode())
+	require.Equal(t, "full", string(resp.Body()))
+	require.Equal(t, "a%20b.txt", res.Objects[1].Key)
+	require.NotNil(t, res.Objects[1].Error)
+	require.Equal(t, ErrKind_ResourceNotFound, res.Objects[1].Error.Code)
+
+	for _, body := range []string{`not json`, `{}`, `{"objects":[]}`} {
+		resp = doTestAPIRequest(t, c, "http://signer/_api/sign", "token", body)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode(), body)
+	}
+	resp = doTestAPIRequest(t, c, "http://signer/_api/sign", "", `{"objects":[{"key":"a/b.txt"}]}`)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+}
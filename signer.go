@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// signRequest is the object access a URL signer signs for.
+type signRequest struct {
+	Method string
+	Bucket string
+	Key    string
+	// explicit object version, empty is the latest
+	VersionID string
+	// zero or `maxURLExpiry` means no expiry, signers clamp it to
+	// what they support.
+	Expiry time.Duration
+	// signed response header overrides, ex. `response-content-disposition`
+	ResponseOverrides url.Values
+
+	// prefix of the matched route
+	RoutePrefix string
+	// credential set of the matched route, empty is the default
+	Credentials string
+}
+
+// expireAt returns the expiry time of req, zero means no expiry.
+func (req signRequest) expireAt(now time.Time) time.Time {
+	if req.Expiry == maxURLExpiry || req.Expiry <= 0 {
+		return time.Time{}
+	}
+	return now.UTC().Add(req.Expiry)
+}
+
+// expires returns the UNIX time req expires at, max signed value of
+// int64 when there's no expiry.
+func (req signRequest) expires(now time.Time) (int64, time.Time) {
+	expireAt := req.expireAt(now)
+	if expireAt.IsZero() {
+		return int64(^uint64(0) / 2), expireAt // ~250years
+	}
+	return expireAt.Unix(), expireAt
+}
+
+// query returns the signed query parameters of req, response overrides
+// and version.
+func (req signRequest) query() url.Values {
+	if req.VersionID == "" {
+		return req.ResponseOverrides
+	}
+	query := url.Values{versionIDParam: {req.VersionID}}
+	for k, v := range req.ResponseOverrides {
+		query[k] = v
+	}
+	return query
+}
+
+// signedURL is a signed URL with its cache hints.
+type signedURL struct {
+	URL string
+	// zero means the URL never expires
+	ExpireAt time.Time
+	// cookies to set along with the redirect
+	Cookies []*http.Cookie
+}
+
+// URLSigner signs object access URLs, independent of the backend the
+// object is checked against.
+type URLSigner interface {
+	Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error)
+	Name() string
+	SignURL(ctx context.Context, req signRequest) (*signedURL, error)
+}
+
+// overrideRedirectURL applies redirect scheme and host for signatures
+// that don't cover the host.
+func overrideRedirectURL(u *url.URL, opts obsOptions) {
+	if opts.RedirectSecure {
+		u.Scheme = "https"
+	} else {
+		u.Scheme = "http"
+	}
+
+	if hostRedirect := opts.HostRedirect; hostRedirect != "" {
+		u.Host = hostRedirect
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"storj.io/uplink"
+)
+
+// storjState is the registered edge credentials of shares, persisted to
+// be reused across restarts.
+type storjState struct {
+	// digest of the grant and share prefixes the credentials belong to
+	Fingerprint string                     `json:"fingerprint"`
+	Shares      map[string]storjStateShare `json:"shares"`
+}
+
+type storjStateShare struct {
+	AccessKeyID string `json:"access_key_id"`
+	SecretKey   string `json:"secret_key"`
+	Endpoint    string `json:"endpoint"`
+	// zero never expires
+	NotAfter time.Time `json:"not_after"`
+	RenewAt  time.Time `json:"renew_at"`
+}
+
+// storjStateFile stores storjState encrypted with AES-256-GCM, the file
+// is the nonce followed by the sealed JSON.
+type storjStateFile struct {
+	file string
+	aead cipher.AEAD
+}
+
+// storjStateKeySize is the AES-256 key size.
+const storjStateKeySize = 32
+
+// newStorjStateFile returns the state file encrypted with key, 32 random
+// bytes encoded in hex or base64, ex. `openssl rand -hex 32`.
+func newStorjStateFile(file, key string) (_ *storjStateFile, err error) {
+	var aesKey []byte
+	if aesKey, err = parseStorjStateKey(key); err != nil {
+		return
+	}
+	var block cipher.Block
+	if block, err = aes.NewCipher(aesKey); err != nil {
+		return
+	}
+	var aead cipher.AEAD
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return
+	}
+	return &storjStateFile{file: file, aead: aead}, nil
+}
+
+// parseStorjStateKey decodes a hex or base64 key of storjStateKeySize
+// bytes, passphrases are rejected.
+func parseStorjStateKey(key string) ([]byte, error) {
+	if key == "" {
+		return nil, errors.New("state file needs an encryption key")
+	}
+	if b, err := hex.DecodeString(key); err == nil && len(b) == storjStateKeySize {
+		return b, nil
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if b, err := encoding.DecodeString(key); err == nil && len(b) == storjStateKeySize {
+			return b, nil
+		}
+	}
+	return nil, errors.Errorf("state file key must be %d bytes in hex or base64", storjStateKeySize)
+}
+
+// Load reads the state, nil if the file doesn't exist.
+func (f *storjStateFile) Load() (_ *storjState, err error) {
+	var b []byte
+	if b, err = os.ReadFile(f.file); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	nonceSize := f.aead.NonceSize()
+	if len(b) < nonceSize {
+		err = errors.New("state file is truncated")
+		return
+	}
+	var plaintext []byte
+	if plaintext, err = f.aead.Open(nil, b[:nonceSize], b[nonceSize:], nil); err != nil {
+		err = errors.Wrap(err, "decrypt state file")
+		return
+	}
+	var state storjState
+	if err = json.Unmarshal(plaintext, &state); err != nil {
+		err = errors.Wrap(err, "parse state file")
+		return
+	}
+	return &state, nil
+}
+
+// Save replaces the state file, readable by the owner only.
+func (f *storjStateFile) Save(state *storjState) (err error) {
+	var plaintext []byte
+	if plaintext, err = json.Marshal(state); err != nil {
+		return
+	}
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	b := f.aead.Seal(nonce, nonce, plaintext, nil)
+
+	var tmp *os.File
+	if tmp, err = os.CreateTemp(filepath.Dir(f.file), filepath.Base(f.file)+".*"); err != nil {
+		err = errors.Wrap(err, "create state file")
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		err = errors.Wrap(err, "write state file")
+		return
+	}
+	// CreateTemp files are 0600 already
+	if err = os.Rename(tmp.Name(), f.file); err != nil {
+		err = errors.Wrap(err, "replace state file")
+	}
+	return
+}
+
+// storjFingerprint digests the grant, auth service, share prefixes and
+// lifetime, persisted credentials of other ones aren't reused.
+func storjFingerprint(access *uplink.Access, authService string, prefixes []uplink.SharePrefix, ttl time.Duration) (_ string, err error) {
+	var grant string
+	if grant, err = access.Serialize(); err != nil {
+		return
+	}
+	h := sha256.New()
+	h.Write([]byte(grant))
+	h.Write([]byte{0})
+	h.Write([]byte(authService))
+	for _, prefix := range prefixes {
+		h.Write([]byte{0})
+		h.Write([]byte(prefix.Bucket))
+		h.Write([]byte{0})
+		h.Write([]byte(prefix.Prefix))
+	}
+	h.Write([]byte{0})
+	h.Write([]byte(ttl.String()))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
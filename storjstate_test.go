@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"storj.io/uplink"
+	"storj.io/uplink/edge"
+)
+
+// 32 bytes in hex
+const testStorjStateKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func TestStorjStateFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "storj.state")
+	f, err := newStorjStateFile(file, testStorjStateKey)
+	require.NoError(t, err)
+
+	state, err := f.Load()
+	require.NoError(t, err)
+	require.Nil(t, state)
+
+	want := &storjState{Fingerprint: "fp", Shares: map[string]storjStateShare{
+		"read": {AccessKeyID: "id", SecretKey: "secret", Endpoint: "https://gateway.example.com", NotAfter: time.Unix(1700000000, 0).UTC()},
+	}}
+	require.NoError(t, f.Save(want))
+	fi, err := os.Stat(file)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	b, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "secret")
+
+	state, err = f.Load()
+	require.NoError(t, err)
+	require.Equal(t, want, state)
+
+	// the same key in base64
+	same, err := newStorjStateFile(file, base64.StdEncoding.EncodeToString([]byte{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
+	}))
+	require.NoError(t, err)
+	state, err = same.Load()
+	require.NoError(t, err)
+	require.Equal(t, want, state)
+
+	other, err := newStorjStateFile(file, strings.Repeat("ff", 32))
+	require.NoError(t, err)
+	_, err = other.Load()
+	require.Error(t, err)
+
+	// passphrases and short keys are rejected
+	for _, key := range []string{"", "key", "correct horse battery staple", strings.Repeat("ff", 16)} {
+		_, err = newStorjStateFile(file, key)
+		require.Error(t, err, key)
+	}
+}
+
+func TestStorjFingerprint(t *testing.T) {
+	access, err := uplink.ParseAccess(testStorjAccessGrant)
+	require.NoError(t, err)
+	prefixes := []uplink.SharePrefix{{Bucket: "bucket", Prefix: "a/"}}
+	fp, err := storjFingerprint(access, "auth.example.com:7777", prefixes, time.Hour)
+	require.NoError(t, err)
+	same, err := storjFingerprint(access, "auth.example.com:7777", prefixes, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, fp, same)
+	for _, other := range []func() (string, error){
+		func() (string, error) { return storjFingerprint(access, "auth.example.com:7777", nil, time.Hour) },
+		func() (string, error) {
+			return storjFingerprint(access, "auth.example.com:7777", []uplink.SharePrefix{{Bucket: "bucket", Prefix: "b/"}}, time.Hour)
+		},
+		func() (string, error) { return storjFingerprint(access, "auth.example.com:7777", prefixes, 0) },
+		func() (string, error) {
+			return storjFingerprint(access, "auth.other.example.com:7777", prefixes, time.Hour)
+		},
+	} {
+		otherFP, err := other()
+		require.NoError(t, err)
+		require.NotEqual(t, fp, otherFP)
+	}
+}
+
+func TestStorjStateReuse(t *testing.T) {
+	access, err := uplink.ParseAccess(testStorjAccessGrant)
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "storj.state")
+
+	var registrations int
+	newClient := func(prefix string) *storjAggegrateClient {
+		state, err := newStorjStateFile(file, testStorjStateKey)
+		require.NoError(t, err)
+		c, err := (&storjAggegrateClient{
+			registerAccess: func(ctx context.Context, access *uplink.Access, opts *edge.RegisterAccessOptions) (*edge.Credentials, error) {
+				registrations++
+				return &edge.Credentials{AccessKeyID: fmt.Sprintf("key%d", registrations), SecretKey: "secret", Endpoint: "https://gateway.example.com"}, nil
+			},
+			access:       access,
+			readShare:    &storjShare{name: "read", permission: uplink.ReadOnlyPermission(), public: true},
+			uploadShare:  &storjShare{name: "upload", permission: uplink.Permission{AllowUpload: true}},
+			prefixes:     []uplink.SharePrefix{{Bucket: "bucket", Prefix: prefix}},
+			shareTTL:     time.Hour,
+			shareBaseURL: "https://link.example.com",
+			state:        state,
+			persisted:    map[string]storjStateShare{},
+			logger:       zap.NewNop().Sugar(),
+		}).Init(context.Background())
+		require.NoError(t, err)
+		return c
+	}
+	ctx := context.Background()
+
+	c := newClient("a/")
+	require.Equal(t, 1, registrations)
+	creds, err := c.UploadCredentials(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "key2", creds.AccessKeyID)
+
+	// restarts reuse both
+	c = newClient("a/")
+	require.Equal(t, 2, registrations)
+	require.Equal(t, "key1", c.readShare.creds.AccessKeyID)
+	creds, err = c.UploadCredentials(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "key2", creds.AccessKeyID)
+	require.WithinDuration(t, time.Now().Add(time.Hour), c.readShare.notAfter, time.Minute)
+
+	// refreshed once due
+	c.readShare.renewAt = time.Now().Add(-time.Second)
+	_, _, err = c.JoinShareURL(ctx, "bucket", "a/b", nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, registrations)
+	c = newClient("a/")
+	require.Equal(t, 3, registrations)
+	require.Equal(t, "key3", c.readShare.creds.AccessKeyID)
+
+	// another scope registers again
+	c = newClient("b/")
+	require.Equal(t, 4, registrations)
+	require.Equal(t, "key4", c.readShare.creds.AccessKeyID)
+}
+
+func TestStorjAuthServiceAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	accepted := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			select {
+			case accepted <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// the grant can't open a project offline, the stub is only dialed to register
+	access, err := uplink.ParseAccess(testStorjAccessGrant)
+	require.NoError(t, err)
+	edgeConfig := edge.Config{AuthServiceAddress: ln.Addr().String(), InsecureSkipVerify: true}
+	c := &storjAggegrateClient{
+		edgeConfig:     &edgeConfig,
+		registerAccess: edgeConfig.RegisterAccess,
+		access:         access,
+		readShare:      &storjShare{name: "read", permission: uplink.ReadOnlyPermission(), public: true},
+		persisted:      map[string]storjStateShare{},
+		logger:         zap.NewNop().Sugar(),
+	}
+	_, err = c.Init(ctx)
+	require.Error(t, err)
+	select {
+	case <-accepted:
+	case <-ctx.Done():
+		t.Fatal("auth service stub wasn't dialed")
+	}
+
+	client, err := newObsStorjClient(ctx, obsStorjOptions{
+		AccessKeyID:        "placeholder",
+		AuthServiceAddress: ln.Addr().String(),
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, ln.Addr().String(), client.edgeConfig.AuthServiceAddress)
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	ErrKind_UploadPolicy = "OBS_UPLOAD_POLICY"
+)
+
+// jsonDuration is a time.Duration read from a JSON duration string.
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(b, &s); err != nil {
+		return
+	}
+	var v time.Duration
+	if v, err = time.ParseDuration(s); err != nil {
+		return
+	}
+	*d = jsonDuration(v)
+	return
+}
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// uploadPolicy restricts presigned uploads, zero fields of a route
+// policy fall back to the server defaults.
+type uploadPolicy struct {
+	// object key template, ex. `uploads/{date}/{uuid}.{ext}`
+	KeyTemplate string `json:"key_template,omitempty"`
+	// max object size in bytes
+	MaxSize int64 `json:"max_size,omitempty"`
+	// allowed content types, `type/*` wildcards, empty allows any
+	ContentTypes []string `json:"content_types,omitempty"`
+	// presigned URL lifetime
+	Expiry jsonDuration `json:"expiry,omitempty"`
+	// where browsers are redirected after a POST upload, empty
+	// responds 204
+	SuccessRedirect string `json:"success_redirect,omitempty"`
+
+	tmpl *keyTemplate
+}
+
+// compile fills zero fields from def and compiles the key template.
+func (p *uploadPolicy) compile(def *uploadPolicy) (err error) {
+	if def != nil {
+		if p.KeyTemplate == "" {
+			p.KeyTemplate = def.KeyTemplate
+		}
+		if p.MaxSize == 0 {
+			p.MaxSize = def.MaxSize
+		}
+		if p.ContentTypes == nil {
+			p.ContentTypes = def.ContentTypes
+		}
+		if p.Expiry == 0 {
+			p.Expiry = def.Expiry
+		}
+		if p.SuccessRedirect == "" {
+			p.SuccessRedirect = def.SuccessRedirect
+		}
+	}
+	if p.MaxSize <= 0 || p.MaxSize > maxMultipartUploadSize {
+		p.MaxSize = maxMultipartUploadSize
+	}
+	if p.tmpl, err = newKeyTemplate(p.KeyTemplate); err != nil {
+		err = errors.Wrap(err, "key template")
+		return
+	}
+	// minio.PostPolicy doesn't escape condition values
+	if strings.ContainsAny(p.KeyTemplate+p.SuccessRedirect, `"\`) {
+		err = errors.New("quotes and backslashes aren't allowed")
+		return
+	}
+	if p.SuccessRedirect != "" {
+		var u *url.URL
+		if u, err = url.Parse(p.SuccessRedirect); err != nil || !u.IsAbs() {
+			err = errors.Errorf("success redirect %q isn't an absolute URL", p.SuccessRedirect)
+			return
+		}
+	}
+	return
+}
+
+// PutMaxSize returns the max size of a single request upload.
+func (p *uploadPolicy) PutMaxSize() int64 {
+	if p.MaxSize > maxUploadSize {
+		return maxUploadSize
+	}
+	return p.MaxSize
+}
+
+// AllowContentType reports whether the media type of contentType is
+// allowed.
+func (p *uploadPolicy) AllowContentType(contentType string) bool {
+	if len(p.ContentTypes) == 0 {
+		return true
+	}
+	return matchContentType(p.ContentTypes, contentType)
+}
+
+// matchContentType reports whether the media type of contentType is
+// one of allowed, `type/*` wildcards.
+func matchContentType(allowed []string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range allowed {
+		allowed = strings.ToLower(allowed)
+		if allowed == mediaType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	errTemplateUnknownPlaceholder = errors.New("unknown placeholder")
+	errTemplateUnclosed           = errors.New("unclosed placeholder")
+	errTemplateNoUnique           = errors.New("needs {uuid} to not overwrite objects")
+)
+
+// key template placeholders and the values they match
+var keyTemplatePlaceholders = map[string]string{
+	"uuid": `[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}`,
+	"ext":  `[a-z0-9]{1,16}`,
+	"date": `[0-9]{4}/[0-9]{2}/[0-9]{2}`,
+}
+
+var uploadExtPattern = regexp.MustCompile(`^` + keyTemplatePlaceholders["ext"] + `$`)
+
+// keyTemplate generates and validates upload object keys.
+type keyTemplate struct {
+	parts   []string // literals at even indexes, placeholders at odd
+	pattern *regexp.Regexp
+}
+
+func newKeyTemplate(s string) (t *keyTemplate, err error) {
+	s = strings.TrimLeft(s, "/")
+	t = &keyTemplate{}
+	var expr strings.Builder
+	expr.WriteString("^")
+	hasUUID := false
+	for {
+		literal, rest, found := strings.Cut(s, "{")
+		t.parts = append(t.parts, literal)
+		expr.WriteString(regexp.QuoteMeta(literal))
+		if !found {
+			break
+		}
+		var name string
+		if name, s, found = strings.Cut(rest, "}"); !found {
+			err = errTemplateUnclosed
+			return
+		}
+		sub, exist := keyTemplatePlaceholders[name]
+		if !exist {
+			err = errors.Wrapf(errTemplateUnknownPlaceholder, "{%s}", name)
+			return
+		}
+		hasUUID = hasUUID || name == "uuid"
+		t.parts = append(t.parts, name)
+		expr.WriteString(sub)
+	}
+	if !hasUUID {
+		err = errTemplateNoUnique
+		return
+	}
+	expr.WriteString("$")
+	t.pattern = regexp.MustCompile(expr.String())
+	return
+}
+
+// Prefix returns the literal prefix of the generated keys.
+func (t *keyTemplate) Prefix() string {
+	return t.parts[0]
+}
+
+// UsesExt reports whether keys have the {ext} placeholder.
+func (t *keyTemplate) UsesExt() bool {
+	for i := 1; i < len(t.parts); i += 2 {
+		if t.parts[i] == "ext" {
+			return true
+		}
+	}
+	return false
+}
+
+// Generate generates a new key.
+func (t *keyTemplate) Generate(ext string, now time.Time) string {
+	var b strings.Builder
+	for i, part := range t.parts {
+		if i%2 == 0 {
+			b.WriteString(part)
+			continue
+		}
+		switch part {
+		case "uuid":
+			b.WriteString(newUUID())
+		case "ext":
+			b.WriteString(ext)
+		case "date":
+			b.WriteString(now.UTC().Format("2006/01/02"))
+		}
+	}
+	return b.String()
+}
+
+// Match reports whether key could have been generated by t.
+func (t *keyTemplate) Match(key string) bool {
+	return t.pattern.MatchString(key)
+}
+
+// uploadExt returns the lowercase extension of filename, or the
+// extension of contentType if filename has none.
+func uploadExt(filename, contentType string) (ext string, err error) {
+	ext = strings.ToLower(strings.TrimPrefix(path.Ext(filename), "."))
+	if ext == "" && contentType != "" {
+		if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+			ext = strings.TrimPrefix(exts[0], ".")
+		}
+	}
+	if !uploadExtPattern.MatchString(ext) {
+		return "", errors.Errorf("invalid file extension %q", ext)
+	}
+	return
+}
+
+// uploadRequest is the object upload an uploader presigns for.
+type uploadRequest struct {
+	Bucket      string
+	Key         string
+	ContentType string
+	Size        int64
+	Expiry      time.Duration
+	// credential set of the matched route, empty is the default
+	Credentials string
+}
+
+// signedUpload is a presigned upload, the client has to send Headers
+// along.
+type signedUpload struct {
+	Method   string
+	URL      string
+	Headers  map[string]string
+	ExpireAt time.Time
+}
+
+// postPolicyRequest is the browser form upload a POST policy is signed
+// for.
+type postPolicyRequest struct {
+	Bucket string
+	// key form field, the only key the policy allows
+	Key string
+	// exact content type, or a prefix with ContentTypePrefix
+	ContentType       string
+	ContentTypePrefix bool
+	MaxSize           int64
+	SuccessRedirect   string
+	Expiry            time.Duration
+	// credential set of the matched route, empty is the default
+	Credentials string
+}
+
+// signedPostPolicy is a signed POST policy, Fields have to be posted
+// along with the file as `multipart/form-data` to URL.
+type signedPostPolicy struct {
+	URL      string
+	Fields   map[string]string
+	ExpireAt time.Time
+}
+
+// objectUploader presigns object uploads for a backend.
+type objectUploader interface {
+	Init(ctx context.Context, opts serverOptions, clients *clientPool) (err error)
+	Name() string
+	SignUpload(ctx context.Context, req uploadRequest) (*signedUpload, error)
+	SignPostPolicy(ctx context.Context, req postPolicyRequest) (*signedPostPolicy, error)
+}
+
+type apiUploadRequest struct {
+	// route prefix whose policy generates the key, ignored with Key
+	Prefix string `json:"prefix,omitempty"`
+	// client chosen key, must match the key template
+	Key         string `json:"key,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size"`
+}
+
+type apiUploadResponse struct {
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Key       string            `json:"key"`
+	Headers   map[string]string `json:"headers"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// uploadPolicyOf returns upload policy of the route, r can be nil.
+func (h *signingHandler) uploadPolicyOf(r *route) *uploadPolicy {
+	if r != nil && r.Upload != nil {
+		return r.Upload
+	}
+	return h.uploadPolicy
+}
+
+// upload presigns a PUT of a key the server generates from the key
+// template, or a client key matching it.
+func (h *signingHandler) upload(ctx *fasthttp.RequestCtx, callCtx context.Context) {
+	if !ctx.IsPost() {
+		h.apiError(ctx, http.StatusMethodNotAllowed, ErrKind_MethodNotAllowed, "")
+		return
+	}
+	var req apiUploadRequest
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_InvalidRequest, err)
+		return
+	}
+
+	r, policy, ok := h.uploadRouteOf(ctx, req.Prefix, &req.Key)
+	if !ok {
+		return
+	}
+	if req.Size <= 0 || req.Size > policy.PutMaxSize() {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_UploadPolicy, errors.Errorf("size must be within 1..%d bytes", policy.PutMaxSize()))
+		return
+	}
+	if req.ContentType == "" {
+		req.ContentType = "application/octet-stream"
+	}
+	if !policy.AllowContentType(req.ContentType) {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_UploadPolicy, errors.Errorf("content type %q not allowed", req.ContentType))
+		return
+	}
+	key, ok := h.uploadKey(ctx, r, policy, req.Key, req.Filename, req.ContentType)
+	if !ok {
+		return
+	}
+	uploader, ok := h.uploaderOf(ctx, r)
+	if !ok {
+		return
+	}
+
+	ureq := uploadRequest{
+		Bucket:      h.opts.BucketName,
+		Key:         key,
+		ContentType: req.ContentType,
+		Size:        req.Size,
+		Expiry:      time.Duration(policy.Expiry),
+	}
+	if r != nil {
+		ureq.Credentials = r.Credentials
+	}
+	signed, err := uploader.SignUpload(callCtx, ureq)
+	if err != nil {
+		h.apiError(ctx, http.StatusInternalServerError, ErrKind_SignURL, err)
+		return
+	}
+
+	h.logger.Infow("upload",
+		"bucket", ureq.Bucket,
+		"objectName", key,
+		"size", req.Size,
+		"contentType", req.ContentType)
+	h.apiJSON(ctx, http.StatusOK, apiUploadResponse{
+		Method:    signed.Method,
+		URL:       signed.URL,
+		Key:       key,
+		Headers:   signed.Headers,
+		ExpiresAt: signed.ExpireAt,
+	})
+}
+
+// uploadRouteOf returns the route and upload policy of a client key,
+// normalized in place, or of a route prefix. Without key nor prefix,
+// it's the route the default template generates keys under. ok is
+// false when an error response has been written.
+func (h *signingHandler) uploadRouteOf(ctx *fasthttp.RequestCtx, prefix string, key *string) (r *route, policy *uploadPolicy, ok bool) {
+	if *key != "" {
+		normalized, err := normalizeKey(*key, keyPolicyStrict, h.opts.MaxKeyLength)
+		if err != nil || normalized == "" || strings.HasSuffix(normalized, "/") {
+			h.apiError(ctx, http.StatusBadRequest, ErrKind_InvalidObjectKey, errors.Errorf("invalid key %q", *key))
+			return
+		}
+		*key = normalized
+		r = h.routes.Match(normalized)
+	} else if prefix != "" {
+		if r = h.routes.Match(prefix); r == nil || r.Prefix != strings.TrimLeft(prefix, "/") {
+			h.apiError(ctx, http.StatusBadRequest, ErrKind_UploadPolicy, errors.Errorf("unknown route %q", prefix))
+			return
+		}
+	} else {
+		r = h.routes.Match(h.uploadPolicy.tmpl.Prefix())
+	}
+	return r, h.uploadPolicyOf(r), true
+}
+
+// uploadKey generates a key from the template of policy, or checks the
+// client key against it. ok is false when an error response has been
+// written.
+func (h *signingHandler) uploadKey(ctx *fasthttp.RequestCtx, r *route, policy *uploadPolicy, key, filename, contentType string) (_ string, ok bool) {
+	if key == "" {
+		var ext string
+		if policy.tmpl.UsesExt() {
+			var err error
+			if ext, err = uploadExt(filename, contentType); err != nil {
+				h.apiError(ctx, http.StatusBadRequest, ErrKind_UploadPolicy, err)
+				return
+			}
+		}
+		key = policy.tmpl.Generate(ext, time.Now())
+	} else if !policy.tmpl.Match(key) {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_UploadPolicy, errors.Errorf("key doesn't match %q", policy.KeyTemplate))
+		return
+	}
+	if !h.filter.Allow(key) {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_UploadPolicy, errors.Errorf("key %q not allowed", key))
+		return
+	}
+	if h.routes.Match(key) != r {
+		h.apiError(ctx, http.StatusInternalServerError, ErrKind_UploadPolicy, errors.Errorf("key template %q escapes its route", policy.KeyTemplate))
+		return
+	}
+	return key, true
+}
+
+// uploaderOf returns uploader of the route backend, r can be nil. ok is
+// false when an error response has been written.
+func (h *signingHandler) uploaderOf(ctx *fasthttp.RequestCtx, r *route) (_ objectUploader, ok bool) {
+	backend := h.defaultBackend
+	if r != nil && r.Backend != "" {
+		backend = r.Backend
+	}
+	uploader, exist := h.uploaders[backend]
+	if !exist {
+		h.apiError(ctx, http.StatusBadRequest, ErrKind_UploadPolicy, errors.Errorf("backend %q doesn't support uploads", backend))
+		return
+	}
+	return uploader, true
+}
+
+// uploadHeaders returns the headers an upload of req is signed with.
+func uploadHeaders(req uploadRequest) map[string]string {
+	return map[string]string{
+		"Content-Type":   req.ContentType,
+		"Content-Length": strconv.FormatInt(req.Size, 10),
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func TestKeyTemplate(t *testing.T) {
+	tmpl, err := newKeyTemplate("/uploads/{date}/{uuid}.{ext}")
+	require.NoError(t, err)
+	require.Equal(t, "uploads/", tmpl.Prefix())
+	require.True(t, tmpl.UsesExt())
+
+	key := tmpl.Generate("jpg", time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC))
+	require.True(t, strings.HasPrefix(key, "uploads/2023/01/02/"), key)
+	require.True(t, strings.HasSuffix(key, ".jpg"), key)
+	require.True(t, tmpl.Match(key))
+	require.NotEqual(t, key, tmpl.Generate("jpg", time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+	for _, key := range []string{
+		"uploads/2023/01/02/not-a-uuid.jpg",
+		"uploads/2023/01/02/0f8fad5b-d9cb-469f-a165-70867728950e.JPG",
+		"uploads/2023/01/02/0f8fad5b-d9cb-469f-a165-70867728950e.jpg/x",
+		"other/2023/01/02/0f8fad5b-d9cb-469f-a165-70867728950e.jpg",
+	} {
+		require.False(t, tmpl.Match(key), key)
+	}
+	require.True(t, tmpl.Match("uploads/2023/01/02/0f8fad5b-d9cb-469f-a165-70867728950e.jpg"))
+
+	for _, s := range []string{"uploads/{uuid", "uploads/{name}.{ext}", "uploads/{ext}"} {
+		_, err = newKeyTemplate(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestUploadPolicyContentTypes(t *testing.T) {
+	p := &uploadPolicy{ContentTypes: []string{"image/*", "application/pdf"}}
+	require.True(t, p.AllowContentType("image/png"))
+	require.True(t, p.AllowContentType("Application/PDF; charset=binary"))
+	require.False(t, p.AllowContentType("text/html"))
+	require.False(t, p.AllowContentType("imagex/png"))
+	require.False(t, p.AllowContentType("not a type"))
+
+	require.True(t, (&uploadPolicy{}).AllowContentType("text/html"))
+}
+
+func TestUploadExt(t *testing.T) {
+	ext, err := uploadExt("Photo.JPG", "")
+	require.NoError(t, err)
+	require.Equal(t, "jpg", ext)
+	ext, err = uploadExt("", "application/pdf")
+	require.NoError(t, err)
+	require.Equal(t, "pdf", ext)
+	_, err = uploadExt("a.tar.g-z", "")
+	require.Error(t, err)
+	_, err = uploadExt("", "")
+	require.Error(t, err)
+}
+
+func doTestAPIRequest(t *testing.T, c *fasthttp.Client, uri, token, body string) *fasthttp.Response {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.Header.SetMethod(http.MethodPost)
+	req.SetRequestURI(uri)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.SetContentType("application/json")
+	req.SetBodyString(body)
+	resp := &fasthttp.Response{}
+	require.NoError(t, c.Do(req, resp))
+	return resp
+}
+
+func TestSigningHandlerUpload(t *testing.T) {
+	opts := testS3ServerOptions(t, "minio.local:9000", `{"routes":[
+		{"prefix":"avatars/","upload":{"key_template":"avatars/{uuid}.{ext}","max_size":1024,"content_types":["image/png"]}}
+	]}`)
+	opts.Opts.HostRedirect = "s3.example.com"
+	opts.Opts.RedirectSecure = true
+	opts.Opts.KeyPatterns = "!**/*.gif"
+	apiOpts := defaultObsAPIOpts
+	apiOpts.Tokens = "token-a, token-b"
+	apiOpts.UploadContentTypes = "image/*,application/pdf"
+	apiOpts.UploadMaxSize = 1 << 20
+	opts.APIOpts = &apiOpts
+	c := newTestServer(t, &serverS3{}, opts)
+
+	// authentication
+	resp := doTestAPIRequest(t, c, "http://signer/_api/upload", "", `{}`)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+	require.NotEmpty(t, resp.Header.Peek("WWW-Authenticate"))
+	resp = doTestAPIRequest(t, c, "http://signer/_api/upload", "token-c", `{}`)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	// server generated key
+	resp = doTestAPIRequest(t, c, "http://signer/_api/upload", "token-b",
+		`{"filename":"photo.JPG","content_type":"image/jpeg","size":1000}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode(), string(resp.Body()))
+	var res apiUploadResponse
+	require.NoError(t, json.Unmarshal(resp.Body(), &res))
+	require.Equal(t, http.MethodPut, res.Method)
+	require.Regexp(t, `^uploads/[0-9a-f-]{36}\.jpg$`, res.Key)
+	require.Equal(t, map[string]string{"Content-Type": "image/jpeg", "Content-Length": "1000"}, res.Headers)
+	require.WithinDuration(t, time.Now().Add(15*time.Minute), res.ExpiresAt, time.Minute)
+	u, err := url.Parse(res.URL)
+	require.NoError(t, err)
+	require.Equal(t, "https", u.Scheme)
+	require.Equal(t, "s3.example.com", u.Host)
+	require.Equal(t, "/bucket/"+res.Key, u.Path)
+	require.Equal(t, "content-length;content-type;host", u.Query().Get("X-Amz-SignedHeaders"))
+	require.Equal(t, "900", u.Query().Get("X-Amz-Expires"))
+
+	// client key
+	key := "uploads/0f8fad5b-d9cb-469f-a165-70867728950e.pdf"
+	resp = doTestAPIRequest(t, c, "http://signer/_api/upload", "token-a",
+		`{"key":"`+key+`","content_type":"application/pdf","size":10}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode(), string(resp.Body()))
+	require.NoError(t, json.Unmarshal(resp.Body(), &res))
+	require.Equal(t, key, res.Key)
+
+	// route policy
+	resp = doTestAPIRequest(t, c, "http://signer/_api/upload", "token-a",
+		`{"prefix":"avatars/","content_type":"image/png","size":1024}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode(), string(resp.Body()))
+	require.NoError(t, json.Unmarshal(resp.Body(), &res))
+	require.Regexp(t, `^avatars/[0-9a-f-]{36}\.png$`, res.Key)
+
+	for _, body := range []string{
+		`not json`,
+		`{"filename":"a.html","content_type":"text/html","size":10}`,
+		`{"filename":"a.png","content_type":"image/png","size":0}`,
+		`{"filename":"a.png","content_type":"image/png","size":2097152}`,
+		`{"prefix":"avatars/","content_type":"image/png","size":1025}`,
+		`{"prefix":"avatars/","content_type":"image/jpeg","size":10}`,
+		`{"prefix":"unknown/","content_type":"image/png","size":10}`,
+		`{"key":"uploads/mine.png","content_type":"image/png","size":10}`,
+		`{"key":"uploads/../0f8fad5b-d9cb-469f-a165-70867728950e.png","content_type":"image/png","size":10}`,
+		// keys aren't percent-decoded into another one
+		`{"key":"uploads%2F0f8fad5b-d9cb-469f-a165-70867728950e.pdf","content_type":"application/pdf","size":10}`,
+		`{"filename":"a.gif","content_type":"image/gif","size":10}`,
+	} {
+		resp = doTestAPIRequest(t, c, "http://signer/_api/upload", "token-a", body)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode(), body)
+		require.NotEmpty(t, resp.Header.Peek("x-error-code"), body)
+	}
+
+	resp = doTestAPIRequest(t, c, "http://signer/_api/unknown", "token-a", `{}`)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode())
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer/_api/upload")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+}
@@ -1,6 +1,15 @@
 package main
 
-import "unsafe"
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
 
 func ok1[T any](res T, err error) T {
 	return res
@@ -23,3 +32,32 @@ func unwrap1[T any](res T, err error) T {
 func unsafeByteSliceToString(b []byte) string {
 	return *(*string)(unsafe.Pointer(&b))
 }
+
+// parseRSAPrivateKey parses PEM encoded PKCS#8 or PKCS#1 RSA private key.
+func parseRSAPrivateKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA private key")
+	}
+	return key, nil
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	unwrap1(rand.Read(b[:]))
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
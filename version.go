@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	ErrKind_ObjectVersion = "OBS_OBJECT_VERSION"
+)
+
+const (
+	versionIDParam = "versionId"
+	// versionId value of the current version
+	latestVersionID = "latest"
+	// S3 version IDs are at most 1024 bytes
+	maxVersionIDLength = 1024
+)
+
+var errVersionsUnsupported = errors.New("object versions unsupported")
+
+// versionRule enables object versions of a route.
+type versionRule struct {
+	// `versionId` query parameter selects the version
+	Query bool `json:"query,omitempty"`
+	// latest version is resolved to its explicit ID in the signed URL
+	PinLatest bool `json:"pin_latest,omitempty"`
+}
+
+func (vr versionRule) Enabled() bool {
+	return vr.Query || vr.PinLatest
+}
+
+// versionedBackend is a backend that stats object versions, the
+// objectInfo.VersionID of StatObject is the latest one.
+type versionedBackend interface {
+	objectBackend
+	StatObjectVersion(ctx context.Context, bucket, key, versionID string) (*objectInfo, error)
+}
+
+// versionSigner is a signer that honors signRequest.VersionID.
+type versionSigner interface {
+	URLSigner
+	signsVersions()
+}
+
+// versionOf returns the version rule of the route, the server one if
+// the route has none, r can be nil.
+func (h *signingHandler) versionOf(r *route) versionRule {
+	if r != nil && r.Version != nil {
+		return *r.Version
+	}
+	return versionRule{Query: h.opts.VersionQuery, PinLatest: h.opts.VersionPinLatest}
+}
+
+// initVersions checks backends and signers of versioned routes support
+// versions.
+func (h *signingHandler) initVersions() (err error) {
+	if err = h.checkVersions(nil); err != nil {
+		return
+	}
+	for _, r := range h.routes.routes {
+		if err = h.checkVersions(r); err != nil {
+			return errors.Wrapf(err, "route %q", r.Prefix)
+		}
+	}
+	return
+}
+
+func (h *signingHandler) checkVersions(r *route) error {
+	if !h.versionOf(r).Enabled() {
+		return nil
+	}
+	if _, ok := h.backendOf(r).(versionedBackend); !ok {
+		return errors.Errorf("backend %q can't stat object versions", h.backendOf(r).Name())
+	}
+	if _, ok := h.signerOf(r).(versionSigner); !ok {
+		return errors.Errorf("signer %q can't sign object versions", h.signerOf(r).Name())
+	}
+	return nil
+}
+
+// requestedVersion returns the `versionId` query parameter, empty for
+// the latest version. It's an error if rule doesn't allow it.
+func requestedVersion(args *fasthttp.Args, rule versionRule) (string, error) {
+	if !args.Has(versionIDParam) {
+		return "", nil
+	}
+	if !rule.Query {
+		return "", errors.Errorf("query parameter %q not allowed", versionIDParam)
+	}
+	return checkVersionID(string(args.Peek(versionIDParam)))
+}
+
+// checkVersionID validates an explicit version ID, `latest` is empty.
+func checkVersionID(versionID string) (string, error) {
+	if versionID == latestVersionID {
+		return "", nil
+	}
+	if versionID == "" || len(versionID) > maxVersionIDLength || !validHeaderValue(versionID) {
+		return "", errors.New("invalid version ID")
+	}
+	return versionID, nil
+}
+
+// pinnedVersion returns the version ID the latest version info is
+// pinned to, empty if unversioned. The `null` version of a suspended
+// bucket can be overwritten.
+func pinnedVersion(info *objectInfo) string {
+	if info.VersionID == "null" {
+		return ""
+	}
+	return info.VersionID
+}
+
+// statVersion stats versionID of key, empty is the latest version.
+func statVersion(ctx context.Context, backend objectBackend, bucket, key, versionID string) (*objectInfo, error) {
+	if versionID == "" {
+		return backend.StatObject(ctx, bucket, key)
+	}
+	vb, ok := backend.(versionedBackend)
+	if !ok {
+		return nil, errVersionsUnsupported
+	}
+	return vb.StatObjectVersion(ctx, bucket, key, versionID)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func TestRequestedVersion(t *testing.T) {
+	args := &fasthttp.Args{}
+	versionID, err := requestedVersion(args, versionRule{})
+	require.NoError(t, err)
+	require.Empty(t, versionID)
+
+	args.Parse("versionId=v1")
+	_, err = requestedVersion(args, versionRule{PinLatest: true})
+	require.Error(t, err)
+	versionID, err = requestedVersion(args, versionRule{Query: true})
+	require.NoError(t, err)
+	require.Equal(t, "v1", versionID)
+
+	for value, want := range map[string]string{"latest": "", "": "!", "a\nb": "!"} {
+		versionID, err = checkVersionID(value)
+		if want == "!" {
+			require.Error(t, err, value)
+			continue
+		}
+		require.NoError(t, err, value)
+		require.Equal(t, want, versionID, value)
+	}
+
+	require.Equal(t, "k=v", signRequest{ResponseOverrides: url.Values{"k": {"v"}}}.query().Encode())
+	require.Equal(t, "k=v&versionId=v1", signRequest{VersionID: "v1", ResponseOverrides: url.Values{"k": {"v"}}}.query().Encode())
+}
+
+func TestSigningHandlerVersions(t *testing.T) {
+	endpoint := newTestS3Endpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		versionID := r.URL.Query().Get("versionId")
+		switch {
+		case r.URL.Path == "/bucket/a.txt" && (versionID == "" || versionID == "v2"):
+			w.Header().Set("X-Amz-Version-Id", "v2")
+		case r.URL.Path == "/bucket/a.txt" && versionID == "v1":
+			w.Header().Set("X-Amz-Version-Id", "v1")
+		case r.URL.Path == "/bucket/pinned/b.txt" && versionID == "":
+			w.Header().Set("X-Amz-Version-Id", "v3")
+		case r.URL.Path == "/bucket/pinned/null.txt" && versionID == "":
+			w.Header().Set("X-Amz-Version-Id", "null")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+	})
+	opts := testS3ServerOptions(t, endpoint, `{"routes":[
+		{"prefix":"pinned/","version":{"pin_latest":true}}
+	]}`)
+	opts.Opts.VersionQuery = true
+	c := newTestServer(t, &serverS3{}, opts)
+	location := func(uri string) url.Values {
+		resp := doTestRequest(t, c, http.MethodGet, uri)
+		require.Equal(t, http.StatusMovedPermanently, resp.StatusCode(), uri)
+		u, err := url.Parse(string(resp.Header.Peek("Location")))
+		require.NoError(t, err)
+		return u.Query()
+	}
+
+	require.False(t, location("http://signer/a.txt").Has("versionId"))
+	require.False(t, location("http://signer/a.txt?versionId=latest").Has("versionId"))
+	require.Equal(t, "v1", location("http://signer/a.txt?versionId=v1").Get("versionId"))
+
+	resp := doTestRequest(t, c, http.MethodGet, "http://signer/a.txt?versionId=v9")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode())
+
+	// the route pins the latest version, without the query parameter
+	require.Equal(t, "v3", location("http://signer/pinned/b.txt").Get("versionId"))
+	require.False(t, location("http://signer/pinned/null.txt").Has("versionId"))
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer/pinned/b.txt?versionId=v3")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode())
+	require.Equal(t, ErrKind_ObjectVersion, string(resp.Header.Peek("x-error-code")))
+
+	// versions need a versioned backend and signer
+	h := &signingHandler{
+		opts:           obsOptions{VersionPinLatest: true},
+		defaultBackend: backendFSName,
+		defaultSigner:  signerS3V2Name,
+		backends:       map[string]objectBackend{backendFSName: &backendFS{}},
+		signers:        map[string]URLSigner{signerS3V2Name: &signerS3V2{}},
+		routes:         &routeTable{},
+	}
+	require.Error(t, h.initVersions())
+	h.backends[backendFSName] = &backendS3{}
+	require.NoError(t, h.initVersions())
+	h.signers[signerS3V2Name] = &signerFS{}
+	require.Error(t, h.initVersions())
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	defaultWebsiteIndex = "index.html"
+	// error documents are read into memory
+	maxErrorDocumentSize = 1 << 20
+)
+
+// websiteRule turns a route into a static website, document keys are
+// relative to the route prefix.
+type websiteRule struct {
+	// index document of directory-like keys, empty uses the server one
+	Index string `json:"index,omitempty"`
+	// served in place of missing keys, ex. `index.html` for SPAs
+	Fallback string `json:"fallback,omitempty"`
+	// served with status 404 for missing keys, ex. `404.html`
+	ErrorDocument string `json:"error_document,omitempty"`
+}
+
+// website is a resolved websiteRule.
+type website struct {
+	index string
+	// object keys, empty if unset
+	fallback      string
+	errorDocument string
+}
+
+// objectReader is a backend that reads objects, ex. website error
+// documents served along with a 404.
+type objectReader interface {
+	objectBackend
+	ReadObject(ctx context.Context, bucket, key string, maxSize int64) ([]byte, *objectInfo, error)
+}
+
+// newWebsite resolves rule of the route at prefix, index is the server
+// index document.
+func newWebsite(rule websiteRule, prefix, index, keyPolicy string) (site *website, err error) {
+	site = &website{index: rule.Index}
+	if site.index == "" {
+		site.index = index
+	}
+	if site.index == "" || strings.Contains(site.index, "/") {
+		return nil, errors.Errorf("invalid index document %q", site.index)
+	}
+	documentKey := func(document string) (string, error) {
+		if document == "" {
+			return "", nil
+		}
+		key, err := normalizeObjectKey(prefix+strings.TrimLeft(document, "/"), keyPolicy, 0)
+		if err != nil || key == "" || strings.HasSuffix(key, "/") {
+			return "", errors.Errorf("invalid document %q", document)
+		}
+		return key, nil
+	}
+	if site.fallback, err = documentKey(rule.Fallback); err != nil {
+		return nil, errors.Wrap(err, "fallback")
+	}
+	if site.errorDocument, err = documentKey(rule.ErrorDocument); err != nil {
+		return nil, errors.Wrap(err, "error document")
+	}
+	return
+}
+
+// initWebsites resolves the server and route websites.
+func (h *signingHandler) initWebsites() (err error) {
+	h.websites = map[*route]*website{}
+	if h.opts.WebsiteIndex != "" {
+		if h.website, err = newWebsite(websiteRule{ErrorDocument: h.opts.WebsiteErrorDocument}, "", h.opts.WebsiteIndex, h.opts.KeyPolicy); err != nil {
+			return
+		}
+		if err = h.checkWebsite(nil, h.website); err != nil {
+			return
+		}
+	}
+	index := h.opts.WebsiteIndex
+	if index == "" {
+		index = defaultWebsiteIndex
+	}
+	for _, r := range h.routes.routes {
+		if r.Website == nil {
+			continue
+		}
+		var site *website
+		if site, err = newWebsite(*r.Website, r.Prefix, index, h.opts.KeyPolicy); err == nil {
+			err = h.checkWebsite(r, site)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "route %q", r.Prefix)
+		}
+		h.websites[r] = site
+	}
+	return
+}
+
+func (h *signingHandler) checkWebsite(r *route, site *website) error {
+	if site.errorDocument == "" {
+		return nil
+	}
+	if _, ok := h.backendOf(r).(objectReader); !ok {
+		return errors.Errorf("backend %q can't read error documents", h.backendOf(r).Name())
+	}
+	return nil
+}
+
+// websiteOf returns website of the route, nil if it isn't one, r can
+// be nil.
+func (h *signingHandler) websiteOf(r *route) *website {
+	if site, exist := h.websites[r]; exist {
+		return site
+	}
+	return h.website
+}
+
+// websiteMiss handles a missing key of a website, a directory without
+// trailing slash is redirected to it, then fallback is served, then the
+// error document. ok is false when a response has been written.
+func (h *signingHandler) websiteMiss(ctx *fasthttp.RequestCtx, callCtx context.Context, r *route, site *website, bucket, key string, statErr error) (fallback string, ok bool) {
+	backend := h.backendOf(r)
+	if key != "" && !strings.HasSuffix(key, "/") {
+		if _, err := backend.StatObject(callCtx, bucket, key+"/"+site.index); err == nil {
+			location := h.directoryLocation(ctx, key)
+			if query := ctx.URI().QueryString(); len(query) > 0 {
+				location += "?" + string(query)
+			}
+			ctx.Redirect(location, http.StatusFound)
+			return
+		}
+	}
+	if site.fallback != "" && h.filter.Allow(site.fallback) {
+		if _, err := backend.StatObject(callCtx, bucket, site.fallback); err == nil {
+			return site.fallback, true
+		}
+	}
+	h.notFound(ctx, callCtx, r, site, bucket, statErr)
+	return
+}
+
+// directoryLocation is the path of the directory key with a trailing
+// slash. It is built from the normalized key, the raw path may start with
+// `//` and redirect to another host.
+func (h *signingHandler) directoryLocation(ctx *fasthttp.RequestCtx, key string) string {
+	path := "/" + key + "/"
+	if h.opts.RemoveBucketName {
+		// the bucket segment resolveObjectName stripped
+		if name, err := normalizeObjectKey(unsafeByteSliceToString(ctx.URI().PathOriginal()), h.opts.KeyPolicy, 0); err == nil {
+			if bucket, _, found := strings.Cut(name, "/"); found {
+				path = "/" + bucket + path
+			}
+		}
+	}
+	return (&url.URL{Path: path}).EscapedPath()
+}
+
+// notFound responds 404, with the error document of site if any.
+func (h *signingHandler) notFound(ctx *fasthttp.RequestCtx, callCtx context.Context, r *route, site *website, bucket string, err any) {
+	ctx.SetStatusCode(http.StatusNotFound)
+	h.reportError(ctx, ErrKind_ResourceNotFound, err)
+	if site == nil || site.errorDocument == "" || !h.filter.Allow(site.errorDocument) {
+		return
+	}
+	body, info, readErr := h.backendOf(r).(objectReader).ReadObject(callCtx, bucket, site.errorDocument, maxErrorDocumentSize)
+	if readErr != nil {
+		h.logger.Warnw("error document",
+			"bucket", bucket,
+			"objectName", site.errorDocument,
+			"error", readErr)
+		return
+	}
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+	ctx.SetContentType(contentType)
+	ctx.SetBody(body)
+}
+
+// websiteRedirectLocation returns the `x-amz-website-redirect-location`
+// of an object if valid, S3 only allows absolute paths and URLs.
+func websiteRedirectLocation(location string) string {
+	if strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") ||
+		strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		if validHeaderValue(location) {
+			return location
+		}
+	}
+	return ""
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func TestNewWebsite(t *testing.T) {
+	site, err := newWebsite(websiteRule{Fallback: "index.html", ErrorDocument: "/errors/404.html"}, "app/", "index.htm", keyPolicyCanonicalize)
+	require.NoError(t, err)
+	require.Equal(t, &website{index: "index.htm", fallback: "app/index.html", errorDocument: "app/errors/404.html"}, site)
+
+	for _, rule := range []websiteRule{
+		{Index: "a/index.html"},
+		{Fallback: "../../index.html"},
+		{ErrorDocument: "errors/"},
+	} {
+		_, err = newWebsite(rule, "app/", "index.html", keyPolicyCanonicalize)
+		require.Error(t, err, rule)
+	}
+	_, err = newWebsite(websiteRule{}, "", "", keyPolicyCanonicalize)
+	require.Error(t, err)
+}
+
+func TestWebsiteRedirectLocation(t *testing.T) {
+	for location, want := range map[string]string{
+		"/docs/new.html":           "/docs/new.html",
+		"https://example.com/a":    "https://example.com/a",
+		"//evil.example.com/a":     "",
+		"javascript:alert(1)":      "",
+		"relative.html":            "",
+		"/a\r\nSet-Cookie: a=b":    "",
+		"":                         "",
+		"http://example.com/a?b=c": "http://example.com/a?b=c",
+	} {
+		require.Equal(t, want, websiteRedirectLocation(location), location)
+	}
+}
+
+func TestSigningHandlerWebsite(t *testing.T) {
+	opts := testFSServerOptions(t, map[string]string{
+		"index.html":          "home",
+		"404.html":            "not found page",
+		"docs/index.html":     "docs",
+		"docs/a.html":         "a",
+		"app/index.html":      "spa",
+		"app/assets/app.js":   "js",
+		"private/secret.html": "secret",
+	}, `{"routes":[
+		{"prefix":"app/","website":{"fallback":"index.html"}}
+	]}`)
+	opts.Opts.KeyPatterns = "!private/**"
+	opts.Opts.WebsiteIndex = "index.html"
+	opts.Opts.WebsiteErrorDocument = "404.html"
+	c := newTestServer(t, &serverFS{}, opts)
+	follow := func(uri string) string {
+		resp := doTestRequest(t, c, http.MethodGet, uri)
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode(), uri)
+		resp = doTestRequest(t, c, http.MethodGet, string(resp.Header.Peek("Location")))
+		require.Equal(t, http.StatusOK, resp.StatusCode(), uri)
+		return string(resp.Body())
+	}
+
+	require.Equal(t, "home", follow("http://signer/"))
+	require.Equal(t, "docs", follow("http://signer/docs/"))
+	require.Equal(t, "a", follow("http://signer/docs/a.html"))
+
+	// directory without trailing slash
+	resp := doTestRequest(t, c, http.MethodGet, "http://signer/docs?x=1")
+	require.Equal(t, http.StatusFound, resp.StatusCode())
+	require.Equal(t, "http://signer/docs/?x=1", string(resp.Header.Peek("Location")))
+	// the location is the normalized key, never the raw path
+	for _, path := range []string{"//evil.example.com/../docs", "/./docs"} {
+		// sent as is, the client would normalize the path
+		conn, err := c.Dial("signer")
+		require.NoError(t, err)
+		_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: signer\r\n\r\n", path)
+		require.NoError(t, err)
+		resp = &fasthttp.Response{}
+		require.NoError(t, resp.Read(bufio.NewReader(conn)))
+		conn.Close()
+		require.Equal(t, http.StatusFound, resp.StatusCode(), path)
+		require.Equal(t, "http://signer/docs/", string(resp.Header.Peek("Location")), path)
+	}
+
+	// SPA fallback of the route
+	require.Equal(t, "spa", follow("http://signer/app/users/1"))
+	require.Equal(t, "js", follow("http://signer/app/assets/app.js"))
+
+	// error document of the server
+	for _, uri := range []string{"http://signer/missing.html", "http://signer/private/secret.html"} {
+		resp = doTestRequest(t, c, http.MethodGet, uri)
+		require.Equal(t, http.StatusNotFound, resp.StatusCode(), uri)
+		require.Equal(t, "not found page", string(resp.Body()), uri)
+		require.True(t, strings.HasPrefix(string(resp.Header.ContentType()), "text/html"), uri)
+	}
+
+	// error documents need a backend reading objects
+	h := &signingHandler{
+		defaultBackend: backendStorjName,
+		backends:       map[string]objectBackend{backendStorjName: &backendStorj{}},
+	}
+	require.Error(t, h.checkWebsite(nil, &website{index: "index.html", errorDocument: "404.html"}))
+	require.NoError(t, h.checkWebsite(nil, &website{index: "index.html", fallback: "index.html"}))
+}
+
+func TestSigningHandlerWebsiteRedirect(t *testing.T) {
+	endpoint := newTestS3Endpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/old.html":
+			w.Header().Set("X-Amz-Website-Redirect-Location", "/new.html")
+		case "/bucket/bad.html":
+			w.Header().Set("X-Amz-Website-Redirect-Location", "//evil.example.com/")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+	})
+	opts := testS3ServerOptions(t, endpoint, "")
+	opts.Opts.WebsiteIndex = "index.html"
+	c := newTestServer(t, &serverS3{}, opts)
+
+	resp := doTestRequest(t, c, http.MethodGet, "http://signer/old.html")
+	require.Equal(t, http.StatusMovedPermanently, resp.StatusCode())
+	require.Equal(t, "http://signer/new.html", string(resp.Header.Peek("Location")))
+
+	// invalid locations are ignored, the object is signed
+	resp = doTestRequest(t, c, http.MethodGet, "http://signer/bad.html")
+	require.Equal(t, http.StatusMovedPermanently, resp.StatusCode())
+	require.Contains(t, string(resp.Header.Peek("Location")), "/bucket/bad.html?")
+}